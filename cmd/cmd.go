@@ -1,7 +1,10 @@
 package cmd
 
 import (
+	"fmt"
+	"io"
 	"os"
+	"time"
 
 	e "github.com/rami3l/golox/errors"
 	"github.com/rami3l/golox/vm"
@@ -20,6 +23,14 @@ func App() (app *cobra.Command) {
 
 	defaultVerbosityStr := "INFO"
 	verbosity := app.Flags().StringP("verbosity", "v", defaultVerbosityStr, "logging verbosity")
+	intMode := app.Flags().Bool("int", false, "evaluate integer literals as exact integers")
+	implicitReturn := app.Flags().Bool("implicit-return", false, "return the value of the final expression statement of a function body")
+	strictNatives := app.Flags().Bool("strict-natives", false, "make redefining a native function an error instead of a warning")
+	warnShadow := app.Flags().Bool("warn-shadow", false, "warn about local variables shadowing other variables")
+	testMode := app.Flags().Bool("test", false, "run FILE as a test against its // expect: comments")
+	noColor := app.Flags().Bool("no-color", false, "disable colored error messages, which are only enabled in a terminal")
+	profile := app.Flags().Bool("profile", false, "print the execution count of each opcode to stderr")
+	stats := app.Flags().Bool("stats", false, "print the running time, the instruction count and the peak stack depth to stderr")
 
 	app.Run = func(_ *cobra.Command, args []string) {
 		verbosityLvl, err := logrus.ParseLevel(*verbosity)
@@ -27,9 +38,47 @@ func App() (app *cobra.Command) {
 			verbosityLvl, _ = logrus.ParseLevel(defaultVerbosityStr)
 		}
 		logrus.SetLevel(verbosityLvl)
-		logrus.SetFormatter(&easy.Formatter{LogFormat: "%lvl% %msg%\n"})
+		var formatter logrus.Formatter = &easy.Formatter{LogFormat: "%lvl% %msg%\n"}
+		if !*noColor && isColorTerm(os.Stderr) {
+			formatter = colorFormatter{formatter}
+		}
+		logrus.SetFormatter(formatter)
 
-		if err := appMain(args); err != nil {
+		opts := []vm.Option{}
+		if *intMode {
+			opts = append(opts, vm.WithIntMode())
+		}
+		if *implicitReturn {
+			opts = append(opts, vm.WithImplicitReturn())
+		}
+		if *strictNatives {
+			opts = append(opts, vm.WithStrictNatives())
+		}
+		if *warnShadow {
+			opts = append(opts, vm.WithWarnShadow())
+		}
+		if *profile {
+			opts = append(opts, vm.WithProfiling())
+		}
+		vm_ := vm.NewVM(opts...)
+		if *testMode {
+			if len(args) != 1 {
+				logrus.Fatalln("--test requires a FILE")
+			}
+			if err := runTestFile(vm_, args[0], os.Stdout); err != nil {
+				logrus.Fatalln(err)
+			}
+			return
+		}
+		var statsOut io.Writer
+		if *stats {
+			statsOut = os.Stderr
+		}
+		err = appMain(vm_, args, statsOut)
+		if *profile {
+			fmt.Fprint(os.Stderr, vm_.ProfileDump())
+		}
+		if err != nil {
 			logrus.Fatalln(err)
 			os.Exit(1)
 		}
@@ -37,23 +86,32 @@ func App() (app *cobra.Command) {
 	return
 }
 
-func appMain(args []string) error {
-	vm_ := vm.NewVM()
-
+// appMain runs the REPL or the file given in `args`,
+// and then reports the execution statistics to `statsOut` if it's not nil.
+func appMain(vm_ *vm.VM, args []string, statsOut io.Writer) (err error) {
+	if statsOut != nil {
+		vm_.SetStats(true)
+	}
+	start := time.Now()
 	switch len(args) {
 	case 0:
-		return vm_.REPL()
+		err = vm_.REPL()
 	case 1:
-		src, err := os.ReadFile(args[0])
-		if err != nil {
-			return err
-		}
-		_, err = vm_.Interpret(string(src), false)
-		if err != nil {
-			return err
+		err = vm_.RunFile(args[0])
+		if warnings := vm_.Warnings(); warnings != nil {
+			logrus.Warnln(warnings)
 		}
 	default:
 		panic(e.Unreachable)
 	}
-	return nil
+	if statsOut != nil {
+		printStats(statsOut, vm_.Stats(), time.Since(start))
+	}
+	return
+}
+
+func printStats(w io.Writer, stats vm.Stats, elapsed time.Duration) {
+	fmt.Fprintf(w, "time:         %s\n", elapsed)
+	fmt.Fprintf(w, "instructions: %d\n", stats.Insts)
+	fmt.Fprintf(w, "peak stack:   %d\n", stats.PeakStack)
 }
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MakeNowJust/heredoc/v2"
+	e "github.com/rami3l/golox/errors"
+	"github.com/rami3l/golox/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	easy "github.com/t-tomalak/logrus-easy-formatter"
+)
+
+func runTestSrc(t *testing.T, src string) (report string, err error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.lox")
+	assert.Nil(t, os.WriteFile(path, []byte(src), 0o644))
+	var out bytes.Buffer
+	err = runTestFile(vm.NewVM(), path, &out)
+	return out.String(), err
+}
+
+func TestRunTestPass(t *testing.T) {
+	t.Parallel()
+	report, err := runTestSrc(t, heredoc.Doc(`
+		print 1 + 2; // expect: 3
+		var s = "foo";
+		// A comment that is not an expectation.
+		print s; // expect: "foo"
+		print 1, 2; // expect: 1 2
+	`))
+	assert.Nil(t, err)
+	assert.Equal(t, "PASS: 3 expectation(s)\n", report)
+}
+
+func TestRunTestFail(t *testing.T) {
+	t.Parallel()
+	report, err := runTestSrc(t, heredoc.Doc(`
+		print 1; // expect: 1
+		print 2; // expect: 3
+		print 4;
+	`))
+	assert.ErrorContains(t, err, "test failed with 2 failure(s) against 2 expectation(s)")
+	assert.Equal(t, "FAIL [L2]: expected \"3\", got \"2\"\nFAIL: unexpected output \"4\"\n", report)
+}
+
+func TestRunTestMissingOutput(t *testing.T) {
+	t.Parallel()
+	report, err := runTestSrc(t, heredoc.Doc(`
+		print 1; // expect: 1
+		print nil + 1; // expect: 2
+	`))
+	assert.ErrorContains(t, err, "test failed with 2 failure(s)")
+	assert.Contains(t, report, "FAIL [L2]: expected \"2\", got no output\n")
+	assert.Contains(t, report, "FAIL: runtime error [L2]")
+}
+
+func TestColorFormatter(t *testing.T) {
+	t.Parallel()
+	err := &e.RuntimeError{Reason: "operand must be a number", Line: 42}
+	entry := &logrus.Entry{Message: err.Error(), Level: logrus.ErrorLevel}
+	inner := &easy.Formatter{LogFormat: "%lvl% %msg%"}
+
+	colored, fmtErr := colorFormatter{inner}.Format(entry)
+	assert.Nil(t, fmtErr)
+	assert.Equal(t, "ERROR \x1b[31mruntime error\x1b[0m \x1b[33m[L42]\x1b[0m: operand must be a number", string(colored))
+
+	plain, fmtErr := inner.Format(entry)
+	assert.Nil(t, fmtErr)
+	assert.Equal(t, "ERROR runtime error [L42]: operand must be a number", string(plain))
+	assert.NotContains(t, string(plain), "\x1b[")
+}
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "stats.lox")
+	assert.Nil(t, os.WriteFile(path, []byte("var a = 1 + 2;"), 0o644))
+	var stats bytes.Buffer
+	assert.Nil(t, appMain(vm.NewVM(), []string{path}, &stats))
+	assert.Regexp(t, `^time: +\S+\ninstructions: +6\npeak stack: +3\n$`, stats.String())
+}
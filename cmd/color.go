@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"os"
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The ANSI escape codes used to colorize the error messages.
+const (
+	ansiRed    = "\x1b[31m"
+	ansiYellow = "\x1b[33m"
+	ansiReset  = "\x1b[0m"
+)
+
+var (
+	// errorKindRegexp matches the kind of an error in its message, e.g. `runtime error`.
+	errorKindRegexp = regexp.MustCompile(`\b(compilation|runtime) error\b`)
+	// locationRegexp matches the source location in an error message, e.g. `[L42]`.
+	locationRegexp = regexp.MustCompile(`\[L\d+\]`)
+)
+
+// colorize highlights the error kinds in red and the source locations in yellow in the message `msg`.
+func colorize(msg string) string {
+	msg = errorKindRegexp.ReplaceAllString(msg, ansiRed+"$0"+ansiReset)
+	return locationRegexp.ReplaceAllString(msg, ansiYellow+"$0"+ansiReset)
+}
+
+// isColorTerm reports whether the output to `f` should be colorized by default,
+// i.e. if `f` is a terminal and the `NO_COLOR` environment variable is not set.
+func isColorTerm(f *os.File) bool {
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// colorFormatter is a logrus.Formatter that colorizes the messages before formatting them with the inner Formatter.
+type colorFormatter struct{ logrus.Formatter }
+
+func (f colorFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	colored := *entry
+	colored.Message = colorize(entry.Message)
+	return f.Formatter.Format(&colored)
+}
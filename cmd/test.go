@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/rami3l/golox/vm"
+)
+
+// expectRegexp matches an expectation comment such as `print 1 + 2; // expect: 3`.
+var expectRegexp = regexp.MustCompile(`// expect: ?(.*)$`)
+
+type expectation struct {
+	line int
+	want string
+}
+
+// parseExpectations collects the `// expect: <output>` comments in `src` in order of appearance.
+func parseExpectations(src string) (res []expectation) {
+	src = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(src)
+	for i, line := range strings.Split(src, "\n") {
+		if m := expectRegexp.FindStringSubmatch(line); m != nil {
+			res = append(res, expectation{line: i + 1, want: strings.TrimRight(m[1], " \t")})
+		}
+	}
+	return
+}
+
+// runTestFile runs the file at `path` as a test script. See runTest for more details.
+func runTestFile(vm_ *vm.VM, path string, report io.Writer) error {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return runTest(vm_, string(src), report)
+}
+
+// runTest runs `src` as a test script, comparing the lines printed by the script
+// against its `// expect: <output>` comments one by one.
+// The report is written to `report`, and an error is returned if any of the expectations fails.
+func runTest(vm_ *vm.VM, src string, report io.Writer) error {
+	expects := parseExpectations(src)
+
+	var out bytes.Buffer
+	vm_.SetStdout(&out)
+	_, runErr := vm_.Interpret(src, false)
+
+	gots := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if out.Len() == 0 {
+		gots = nil
+	}
+
+	failed := 0
+	for i, expect := range expects {
+		switch {
+		case i >= len(gots):
+			fmt.Fprintf(report, "FAIL [L%d]: expected %q, got no output\n", expect.line, expect.want)
+			failed++
+		case gots[i] != expect.want:
+			fmt.Fprintf(report, "FAIL [L%d]: expected %q, got %q\n", expect.line, expect.want, gots[i])
+			failed++
+		}
+	}
+	for i := len(expects); i < len(gots); i++ {
+		fmt.Fprintf(report, "FAIL: unexpected output %q\n", gots[i])
+		failed++
+	}
+	if runErr != nil {
+		fmt.Fprintf(report, "FAIL: %s\n", runErr)
+		failed++
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("test failed with %d failure(s) against %d expectation(s)", failed, len(expects))
+	}
+	fmt.Fprintf(report, "PASS: %d expectation(s)\n", len(expects))
+	return nil
+}
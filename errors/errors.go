@@ -13,13 +13,35 @@ func (e *CompilationError) Error() string {
 	return fmt.Sprintf("compilation error [L%d]: %s", e.Line, e.Reason)
 }
 
+// CompilationWarning is a non-fatal diagnostic reported by the compiler.
+type CompilationWarning struct {
+	Reason string
+	Line   int
+}
+
+func (e *CompilationWarning) Error() string {
+	return fmt.Sprintf("compilation warning [L%d]: %s", e.Line, e.Reason)
+}
+
 type RuntimeError struct {
 	Reason string
 	Line   int
+	// The name of the function and the bytecode offset of the instruction that failed.
+	Fun string
+	IP  int
 }
 
 func (e *RuntimeError) Error() string {
 	return fmt.Sprintf("runtime error [L%d]: %s", e.Line, e.Reason)
 }
 
+// BreakpointHit is returned when the execution pauses before running the given line.
+type BreakpointHit struct {
+	Line int
+}
+
+func (e *BreakpointHit) Error() string {
+	return fmt.Sprintf("hit breakpoint [L%d]", e.Line)
+}
+
 const Unreachable = "internal error: entered unreachable code"
@@ -2,8 +2,9 @@ package vm
 
 import (
 	"fmt"
+	"strings"
 
-	"github.com/rami3l/golox/utils"
+	"golang.org/x/exp/slices"
 )
 
 //go:generate go run golang.org/x/tools/cmd/stringer -type=OpCode
@@ -17,6 +18,9 @@ const (
 	// OpConst(idx) pushes the constant at `idx`.
 	// ( -- const )
 	OpConst
+	// OpConstImm(n) pushes the small integer `n` as a number, without using the constant pool.
+	// ( -- n )
+	OpConstImm
 	// OpNil() pushes a nil.
 	// ( -- nil )
 	OpNil
@@ -29,6 +33,12 @@ const (
 	// OpPop() pops a value.
 	// ( val -- )
 	OpPop
+	// OpDup() duplicates the value at the stack top.
+	// ( val -- val val )
+	OpDup
+	// OpDup2() duplicates the 2 values at the stack top.
+	// ( a b -- a b a b )
+	OpDup2
 	// OpGetLocal(slot) pushes the local at the given `slot`.
 	// ( -- local )
 	OpGetLocal
@@ -51,6 +61,9 @@ const (
 	// OpSetUpval(slot) sets the upval at the given `slot` to point at `val`.
 	// ( val -- val )
 	OpSetUpval
+	// OpArgs() pushes the list of all the arguments passed to the current function.
+	// ( -- args )
+	OpArgs
 	// OpGetProp(name) pushes the property (field/method) `this.name`.
 	// ( this -- prop )
 	OpGetProp
@@ -60,15 +73,42 @@ const (
 	// OpGetSuper(name) binds the `super.name` method.
 	// ( this super -- bound )
 	OpGetSuper
+	// OpList(n) collects the `n` elements at the stack top into a new list.
+	// ( elems...[n] -- list )
+	OpList
+	// OpListSpread(n) is like OpList, except that the spread lists among the `n` elements are expanded.
+	// ( elems...[n] -- list )
+	OpListSpread
+	// OpSpread() marks the list at the stack top to be expanded by the following OpListSpread or OpCallSpread.
+	// ( list -- spread )
+	OpSpread
+	// OpGetIndex() pushes the element `obj[key]`.
+	// ( obj key -- elem )
+	OpGetIndex
+	// OpSetIndex() sets the element `obj[key]` to `val`.
+	// ( obj key val -- val )
+	OpSetIndex
 	// OpEqual() tests equality.
 	// ( x y -- xEqY )
 	OpEqual
+	// OpIsNil() tests equality with nil, i.e. `x == nil`.
+	// ( x -- xEqNil )
+	OpIsNil
+	// OpIsTrue() tests equality with true, i.e. `x == true`.
+	// ( x -- xEqTrue )
+	OpIsTrue
+	// OpIsFalse() tests equality with false, i.e. `x == false`.
+	// ( x -- xEqFalse )
+	OpIsFalse
 	// OpGreater() tests "greater than".
 	// ( x y -- xGtY )
 	OpGreater
 	// OpLess() tests "less than".
 	// ( x y -- xLtY )
 	OpLess
+	// OpIn() tests whether `x` is an element of a list, a key of a map, or a substring of a string.
+	// ( x container -- xInContainer )
+	OpIn
 	// OpNot() logically negates a value.
 	// ( x -- notX )
 	OpNot
@@ -78,6 +118,15 @@ const (
 	// OpAdd() adds 2 values.
 	// ( x y -- xAddY )
 	OpAdd
+	// OpAddConst(slot, n) adds the small integer `n` to the local at the given `slot`.
+	// It is the superinstruction of `OpGetLocal(slot) OpConstImm(n) OpAdd()`.
+	// ( -- localAddN )
+	OpAddConst
+	// OpConcat(last) adds the 2 values at the stack top like OpAdd, as one of the `+`s of a chain such as `a + b + c`.
+	// The strings are appended to a VConcat kept at the stack top until the `last` OpConcat of the chain,
+	// which converts it back to a string, so that the chain doesn't build a new string for each `+`.
+	// ( lhs rhs -- lhsAddRhs )
+	OpConcat
 	// OpSub() subtracts 2 values.
 	// ( x y -- xSubY )
 	OpSub
@@ -90,6 +139,9 @@ const (
 	// OpPrint() pops and prints a value.
 	// ( val -- )
 	OpPrint
+	// OpPrintN(n) pops and prints `n` values on one line, separated by spaces.
+	// ( vals...[n] -- )
+	OpPrintN
 	// OpJump(hi, lo) increments the IP by (hi<<8|lo).
 	// ( -- )
 	OpJump
@@ -99,9 +151,42 @@ const (
 	// OpLoop(hi, lo) decrements the IP by (hi<<8|lo).
 	// ( -- )
 	OpLoop
+	// OpIter() gets an iterator out of `iterable` by calling `iterable.__iter__()`.
+	// ( iterable -- iter )
+	OpIter
+	// OpNext(hi, lo) advances `iter` by calling `iter.__next__()`.
+	// If the result is `done`, `iter` is popped and the IP is incremented by (hi<<8|lo).
+	// ( iter -- next ) or ( iter -- )
+	OpNext
+	// OpTry(hi, lo) installs an exception handler,
+	// which resumes at the IP incremented by (hi<<8|lo) with the thrown value pushed.
+	// ( -- )
+	OpTry
+	// OpTryFinally(hi, lo) installs an exception handler for a finally block,
+	// which resumes at the IP incremented by (hi<<8|lo) with the error to be rethrown pushed.
+	// ( -- )
+	OpTryFinally
+	// OpEndTry() uninstalls the innermost exception handler.
+	// ( -- )
+	OpEndTry
+	// OpThrow() throws `val`, unwinding the stack to the innermost exception handler.
+	// ( val -- )
+	OpThrow
+	// OpGetCleanup() replaces the resource of a `with` statement with its bound `__exit__` method,
+	// or its bound `close` method if there is no `__exit__`.
+	// ( res -- cleanup )
+	OpGetCleanup
 	// OpCall(argCount) calls `callee` with a argument list of length `argCount`.
 	// ( callee args...[argCount] -- res )
 	OpCall
+	// OpCallSpread(n) is like OpCall, except that the spread lists among the `n` arguments are expanded.
+	// ( callee args...[n] -- res )
+	OpCallSpread
+	// OpCallNamed(names, argCount) is like OpCall,
+	// except that the last arguments are named by the list constant `names`,
+	// and are moved to the positions of the parameters with the same names.
+	// ( callee args...[argCount] -- res )
+	OpCallNamed
 	// OpInvoke(name, argCount) calls the `name` method of `this` with a argument list of length `argCount`.
 	// This is a superinstruction for OpGetProp(name) + OpCall(argCount).
 	// ( this args...[argCount] -- res )
@@ -110,8 +195,8 @@ const (
 	// This is an inexact superinstruction for OpGetSuper(name) + OpCall(argCount).
 	// ( this args...[argCount] super -- res )
 	OpSuperInvoke
-	// OpClos(fun, (isLocal, idx)...[fun.upvalCount]) makes a new closure
-	// out of `fun` and given `upval` (isLocal, idx) pairs.
+	// OpClos(fun, (kind, idx)...[fun.upvalCount]) makes a new closure
+	// out of `fun` and given `upval` (kind, idx) pairs, where `kind` is an UpvalKind.
 	// ( -- clos )
 	OpClos
 	// OpCloseUpval() closes and pops `openUpval`.
@@ -126,6 +211,22 @@ const (
 	// OpMethod(name) registers a new `method` under `class` using the given `name`.
 	// ( class method -- class )
 	OpMethod
+	// OpDecorate(n) makes a decorated method out of `method` and the `n` decorators below it,
+	// which are only applied once the method is bound to an instance. See VDecorated.
+	// ( decorators...[n] method -- decorated )
+	OpDecorate
+	// OpField(name) registers `name` as a field of the instances of `class` stored in a fixed slot.
+	// ( class -- class )
+	OpField
+)
+
+// UpvalKind tells OpClos where to capture an upval from.
+type UpvalKind byte
+
+const (
+	UpvalFromUpval UpvalKind = iota // An existing upval of the enclosing closure.
+	UpvalFromLocal                  // A local of the enclosing function, captured by reference.
+	UpvalByValue                    // A local of the enclosing function that is never reassigned, captured by value.
 )
 
 type Chunk struct {
@@ -133,6 +234,11 @@ type Chunk struct {
 	// Contract: len(lines) == len(code)
 	lines  []int
 	consts []Value
+	// The string constants, indexed the same way as consts, with nil for the other constants.
+	// This allows reading the identifiers used by the instructions without any type assertion.
+	strs []*VStr
+	// The function constants used by OpClos, indexed the same way as consts, with nil for the other constants.
+	funs []*VFun
 }
 
 func NewChunk() *Chunk { return &Chunk{} }
@@ -145,10 +251,58 @@ func (c *Chunk) Write(b byte, line int) {
 func (c *Chunk) AddConst(const_ Value) (idx int) {
 	idx = len(c.consts)
 	c.consts = append(c.consts, const_)
+	str, _ := const_.(*VStr)
+	c.strs = append(c.strs, str)
+	fun, _ := const_.(*VFun)
+	c.funs = append(c.funs, fun)
 	return
 }
 
+// truncateConsts removes the constants from `idx` onwards.
+func (c *Chunk) truncateConsts(idx int) {
+	c.consts, c.strs, c.funs = c.consts[:idx], c.strs[:idx], c.funs[:idx]
+}
+
 func (c *Chunk) DisassembleInst(offset int) (res string, newOffset int) {
+	return c.disassembleInst(offset, nil)
+}
+
+// strConstIn returns the string constant loaded by the code in [start, end), if it is a single OpConst.
+func (c *Chunk) strConstIn(start, end int) (res *VStr, ok bool) {
+	if end-start != 2 || OpCode(c.code[start]) != OpConst {
+		return nil, false
+	}
+	res = c.strs[c.code[start+1]]
+	return res, res != nil
+}
+
+// moveBefore moves the code from `mid` to the end before the code in [start, mid),
+// so that it runs first although it has been emitted last.
+// Contract: No jump crosses `start` or `mid` in either direction.
+func (c *Chunk) moveBefore(start, mid int) {
+	code := append(slices.Clone(c.code[mid:]), c.code[start:mid]...)
+	copy(c.code[start:], code)
+	lines := append(slices.Clone(c.lines[mid:]), c.lines[start:mid]...)
+	copy(c.lines[start:], lines)
+}
+
+// jumpTarget returns the destination of the jump instruction at `offset`, if it is one.
+func (c *Chunk) jumpTarget(offset int) (target int, ok bool) {
+	switch inst := OpCode(c.code[offset]); inst {
+	case OpJump, OpJumpUnless, OpLoop, OpNext, OpTry, OpTryFinally:
+		jump := int(c.code[offset+1])<<8 | int(c.code[offset+2])
+		if inst == OpLoop {
+			jump = -jump
+		}
+		return offset + 3 + jump, true
+	default:
+		return Uninit, false
+	}
+}
+
+// disassembleInst disassembles the instruction at `offset`.
+// If `labels` is not nil, jump targets are printed using the label numbers found in `labels`.
+func (c *Chunk) disassembleInst(offset int, labels map[int]int) (res string, newOffset int) {
 	appendf := func(format string, a ...any) { res += fmt.Sprintf(format, a...) }
 
 	appendf("%04d ", offset)
@@ -162,32 +316,39 @@ func (c *Chunk) DisassembleInst(offset int) (res string, newOffset int) {
 	case OpClos:
 		const_ := c.code[offset+1]
 		offset += 2
-		fun := c.consts[const_].(*VFun)
+		fun := c.funs[const_]
 		appendf("%-16s %4d %s", inst, const_, fun)
 		for i := 0; i < fun.upvalCount; i++ {
-			isLocal, idx := utils.IntToBool(c.code[offset]), c.code[offset+1]
-			isLocalStr := "upvalue"
-			if isLocal {
-				isLocalStr = "local"
+			kind, idx := UpvalKind(c.code[offset]), c.code[offset+1]
+			kindStr := "upvalue"
+			switch kind {
+			case UpvalFromLocal:
+				kindStr = "local"
+			case UpvalByValue:
+				kindStr = "value"
 			}
 			appendf(
 				"\n%04d    |                     %s %d",
-				offset, isLocalStr, idx,
+				offset, kindStr, idx,
 			)
 			offset += 2
 		}
 		return res, offset
 	// Jump operators.
-	case OpJump, OpJumpUnless, OpLoop: // `jumpInstruction`
-		jump := int(c.code[offset+1])<<8 | int(c.code[offset+2])
-		if inst == OpLoop {
-			jump = -jump
+	case OpJump, OpJumpUnless, OpLoop, OpNext, OpTry, OpTryFinally: // `jumpInstruction`
+		target, _ := c.jumpTarget(offset)
+		if label, ok := labels[target]; ok {
+			appendf("%-16s L%d", inst, label)
+		} else {
+			appendf("%-16s %4d -> %d", inst, offset, target)
 		}
-		appendf("%-16s %4d -> %d", inst, offset,
-			offset+3+jump)
 		return res, offset + 3
 	// Binary operators.
-	case OpInvoke, OpSuperInvoke: // `invokeInstruction`
+	case OpAddConst:
+		slot, n := c.code[offset+1], c.code[offset+2]
+		appendf("%-16s %4d + %d", inst, slot, n)
+		return res, offset + 3
+	case OpInvoke, OpSuperInvoke, OpCallNamed: // `invokeInstruction`
 		const_, argCount := c.code[offset+1], c.code[offset+2]
 		appendf(
 			"%-16s (%d args) %4d '%s'",
@@ -195,12 +356,12 @@ func (c *Chunk) DisassembleInst(offset int) (res string, newOffset int) {
 		)
 		return res, offset + 3
 	// Unary operators.
-	case OpConst, OpGetGlobal, OpDefGlobal, OpSetGlobal, OpGetProp, OpSetProp, OpClass, OpMethod: // `constantInstruction`
+	case OpConst, OpGetGlobal, OpDefGlobal, OpSetGlobal, OpGetProp, OpSetProp, OpClass, OpMethod, OpField: // `constantInstruction`
 		const_ := c.code[offset+1]
 		appendf("%-16s %4d '%s'", inst, const_, c.consts[const_])
 		return res, offset + 2
-	case OpGetLocal, OpSetLocal, OpCall,
-		OpGetUpval, OpSetUpval: // `byteInstruction`
+	case OpConstImm, OpGetLocal, OpSetLocal, OpCall, OpCallSpread, OpList, OpListSpread, OpPrintN, OpConcat,
+		OpGetUpval, OpSetUpval, OpDecorate: // `byteInstruction`
 		slot := c.code[offset+1]
 		appendf("%-16s %4d", inst, slot)
 		return res, offset + 2
@@ -211,6 +372,62 @@ func (c *Chunk) DisassembleInst(offset int) (res string, newOffset int) {
 	}
 }
 
+// DisassembleLabeled disassembles the chunk like Disassemble,
+// except that jump targets are replaced by symbolic labels (L0, L1, ...),
+// which are also printed before the instructions they point to.
+func (c *Chunk) DisassembleLabeled(name string) (res string) {
+	// First pass: collect all jump targets.
+	targets := []int{}
+	for i := 0; i < len(c.code); {
+		if target, ok := c.jumpTarget(i); ok {
+			targets = append(targets, target)
+		}
+		_, i = c.disassembleInst(i, nil)
+	}
+	// Number the labels in the order of their positions.
+	slices.Sort(targets)
+	labels := map[int]int{}
+	for _, target := range targets {
+		if _, ok := labels[target]; !ok {
+			labels[target] = len(labels)
+		}
+	}
+
+	// Second pass: print the instructions with their labels.
+	res = fmt.Sprintf("== %s ==\n", name)
+	for i := 0; i < len(c.code); {
+		if label, ok := labels[i]; ok {
+			res += fmt.Sprintf("L%d:\n", label)
+		}
+		var delta string
+		delta, i = c.disassembleInst(i, labels)
+		res += delta + "\n"
+	}
+	// A jump might also target the end of the chunk.
+	if label, ok := labels[len(c.code)]; ok {
+		res += fmt.Sprintf("L%d:\n", label)
+	}
+	return res
+}
+
+// DisassembleWithSource disassembles the chunk like Disassemble,
+// except that each run of instructions is preceded by the source line it comes from,
+// taken from `src` which should be the source code that the chunk has been compiled from.
+func (c *Chunk) DisassembleWithSource(name string, src string) (res string) {
+	srcLines := strings.Split(strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(src), "\n")
+	res = fmt.Sprintf("== %s ==\n", name)
+	for i, prevLine := 0, 0; i < len(c.code); {
+		if line := c.lines[i]; line != prevLine && line >= 1 && line <= len(srcLines) {
+			res += fmt.Sprintf("; %4d: %s\n", line, srcLines[line-1])
+			prevLine = line
+		}
+		var delta string
+		delta, i = c.DisassembleInst(i)
+		res += delta + "\n"
+	}
+	return res
+}
+
 func (c *Chunk) Disassemble(name string) (res string) {
 	res = fmt.Sprintf("== %s ==\n", name)
 	for i := 0; i < len(c.code); {
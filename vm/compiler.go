@@ -3,7 +3,7 @@ package vm
 import (
 	"fmt"
 	"math"
-	"strconv"
+	"strings"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/rami3l/golox/debug"
@@ -18,37 +18,83 @@ type Parser struct {
 	*Compiler
 	ClassCompiler *ClassCompiler
 	errors        *multierror.Error
+	warnings      *multierror.Error // Non-fatal diagnostics, which don't fail the compilation.
 	prev, curr    Token
+	lhsStart      int  // The offset at which the code of the LHS of the infix expression being compiled starts.
 	panicMode     bool // Whether the parser is in error recovery and trying to sync.
+	intMode       bool // Whether integer literals should be compiled to VInts instead of VNums.
+	isExpr        bool // Whether the last source has been compiled as a single expression in REPL mode.
+	warnShadow    bool // Whether to warn about locals shadowing other variables.
+	// Whether a final expression statement in a function body should return its value instead of nil.
+	implicitReturn bool
+	nesting        int // The number of expressions being parsed, each nested in the previous one.
+	maxNesting     int // The limit of nesting, which is unlimited if not positive.
+	// The names of the globals declared by the sources compiled successfully so far,
+	// which are kept across compilations since the VM keeps the globals as well.
+	globals map[string]struct{}
+	// The names of the globals declared by the source being compiled,
+	// which are only added to `globals` if the compilation succeeds.
+	newGlobals map[string]struct{}
+	// The names of the predefined native functions, which shouldn't be redefined by accident.
+	natives       map[string]struct{}
+	strictNatives bool // Whether redefining a native function is an error rather than a warning.
+	// The names of the functions to be hoisted in the blocks scanned ahead by scanHoisted,
+	// keyed by the scanner offset right after the first token of each block.
+	hoisted map[int][]Token
 }
 
-func NewParser() *Parser { return &Parser{} }
+// DefaultMaxNesting is the default limit of expression nesting of a Parser. See Parser.SetMaxNesting.
+const DefaultMaxNesting = 1000
+
+func NewParser() *Parser { return &Parser{maxNesting: DefaultMaxNesting} }
 
 type (
 	Compiler struct {
-		enclosing    *Compiler
-		fun          *VFun
-		loopStart    *int
-		locals       []Local
-		upvals       []Upval
-		loopEndHoles []int
-		funType      FunType
-		depth        int
+		enclosing *Compiler
+		fun       *VFun
+		loop      *Loop // The innermost loop being compiled in the current function.
+		try       *Try  // The innermost try block being compiled in the current function.
+		locals    []Local
+		upvals    []Upval
+		funType   FunType
+		depth     int
+		// The start and the end offsets of the code of the last expression statement in the function,
+		// used for implicit returns.
+		lastExprStmt [2]int
+	}
+
+	Loop struct {
+		enclosing *Loop
+		endHoles  []int // The jumps to be patched to the end of the loop, e.g. `break`s.
+		start     int   // The target of `continue`.
+		depth     int   // The scope depth outside of the loop body.
+		try       *Try  // The innermost try block enclosing the loop.
+	}
+
+	// Try is a try block, the exception handler of which is installed while the block is running.
+	Try struct {
+		enclosing *Try
+		// The local slot of the closure compiled from the finally block, or Uninit if there is none.
+		finallySlot int
 	}
 
 	Local struct {
 		name       Token
 		depth      int
 		isCaptured bool
+		isUsed     bool // Whether the local has ever been referenced by name.
+		isHoisted  bool // Whether the local is a hoisted function whose declaration hasn't been reached.
 	}
 	Upval struct {
-		isLocal bool // Whether the upval is captured from local or from an existing upval in the outer function.
-		idx     int  // The index at which the actual value can be found in the VM stack.
+		kind UpvalKind // Whether the upval is captured from local (by reference or by value) or from an existing upval in the outer function.
+		idx  int       // The index at which the actual value can be found in the VM stack.
 	}
 
 	ClassCompiler struct {
 		enclosing *ClassCompiler
 		hasSuper  bool
+		fields    []Token // The fields set by `this.field = ...` in `init`.
+		methods   []Token // The methods declared so far in the class body.
 	}
 )
 
@@ -60,11 +106,12 @@ const (
 	FInit
 	FMethod
 	FScript
+	FFinally
 )
 
 func NewCompiler(enclosing *Compiler, funType FunType) *Compiler {
 	this := Local{}
-	if funType != FFun {
+	if funType != FFun && funType != FFinally {
 		this = Local{
 			name:  syntheticThis,
 			depth: 0, // A sentinel depth != Uninit.
@@ -75,7 +122,8 @@ func NewCompiler(enclosing *Compiler, funType FunType) *Compiler {
 		fun:       NewVFun(),
 		funType:   funType,
 		// Reserve the locals slot 0 for "this".
-		locals: []Local{this},
+		locals:       []Local{this},
+		lastExprStmt: [2]int{Uninit, Uninit},
 	}
 }
 
@@ -133,10 +181,53 @@ func (p *Parser) mkConst(val Value) (idx byte) {
 	return byte(const_)
 }
 
+// SetWarnShadow sets whether a warning should be reported when a local variable
+// shadows a global or a local of an enclosing scope, which is off by default.
+// Only the globals declared in the sources compiled by this Parser are known to it.
+func (p *Parser) SetWarnShadow(on bool) { p.warnShadow = on }
+
+// SetNatives sets the names of the native functions predefined as globals,
+// the redefinition of which at the top level is reported as a warning, or as an error in strict mode.
+func (p *Parser) SetNatives(names ...string) {
+	p.natives = make(map[string]struct{}, len(names))
+	for _, name := range names {
+		p.natives[name] = struct{}{}
+	}
+}
+
+// SetStrictNatives sets whether redefining a native function is a compilation error instead of a warning.
+func (p *Parser) SetStrictNatives(on bool) { p.strictNatives = on }
+
+// SetImplicitReturn sets whether a function (or a method other than `init`) whose body ends with
+// an expression statement should return the value of that expression, like in Ruby, instead of nil.
+func (p *Parser) SetImplicitReturn(on bool) { p.implicitReturn = on }
+
+// SetIntMode sets whether integer literals should be compiled to exact VInts instead of VNums.
+func (p *Parser) SetIntMode(on bool) { p.intMode = on }
+
+// SetMaxNesting caps how deeply expressions can be nested, e.g. in `((((x))))` or `----x`,
+// beyond which a compilation error is reported instead of exhausting the Go stack.
+// A zero or negative `max` means unlimited.
+func (p *Parser) SetMaxNesting(max int) { p.maxNesting = max }
+
 func (p *Parser) num(_canAssign bool) {
-	val, err := strconv.ParseFloat(p.prev.String(), 64)
-	p.errors = multierror.Append(p.errors, err)
-	p.emitConst(VNum(val))
+	res, err := parseNumLit(p.prev.String(), p.intMode)
+	if err != nil {
+		p.errors = multierror.Append(p.errors, err)
+	}
+	num, ok := res.(VNum)
+	if !ok {
+		p.emitConst(res)
+		return
+	}
+	val := float64(num)
+	// Optimization: Small integers are very common (e.g. loop counters),
+	// so they are encoded in the instruction itself instead of taking up a constant slot.
+	if val >= 0 && val <= math.MaxUint8 && val == math.Trunc(val) {
+		p.emitBytes(byte(OpConstImm), byte(val))
+		return
+	}
+	p.emitConst(num)
 }
 
 func (p *Parser) grouping(_canAssign bool) {
@@ -153,14 +244,20 @@ func (p *Parser) lit(_canAssign bool) {
 	case TTrue:
 		p.emitBytes(byte(OpTrue))
 	default:
-		panic(e.Unreachable)
+		p.errorUnsupported()
 	}
 }
 
 func (p *Parser) str(_canAssign bool) {
-	runes := p.prev.Runes
-	// COPY the lexeme inside the quotes as a string.
-	unquoted := string(runes[1 : len(runes)-1])
+	unquote := func(tk Token) string {
+		// COPY the lexeme inside the quotes as a string.
+		return string(tk.Runes[1 : len(tk.Runes)-1])
+	}
+	unquoted := unquote(p.prev)
+	// Adjacent string literals are concatenated at compile time, e.g. `"foo" "bar"` is `"foobar"`.
+	for p.match(TStr) {
+		unquoted += unquote(p.prev)
+	}
 	p.emitConst(NewVStr(unquoted))
 }
 
@@ -190,7 +287,18 @@ func (p *Parser) super(_canAssign bool) {
 		// We're heap allocating an ObjBoundMethod for each super call,
 		// even though most of the time the very next instruction is an OpCall
 		// that immediately unpacks that bound method, invokes and then discards it.
-		argCount := p.argList()
+		argsStart := len(p.currChunk().code)
+		argCount, hasSpread, names := p.argList()
+		if hasSpread || len(names) > 0 {
+			// The superinstruction only takes positional arguments, so fall back to a regular call,
+			// where the method is bound before the arguments are evaluated.
+			getStart := len(p.currChunk().code)
+			p.namedVar(syntheticSuper, false)
+			p.emitBytes(byte(OpGetSuper), methodConst)
+			p.currChunk().moveBefore(argsStart, getStart)
+			p.emitCall(argCount, hasSpread, names)
+			return
+		}
 		p.namedVar(syntheticSuper, false)
 		p.emitBytes(byte(OpSuperInvoke), methodConst, byte(argCount))
 	} else {
@@ -221,19 +329,48 @@ func (p *Parser) namedVar(name Token, canAssign bool) {
 	} else if slot = p.resolveUpval(name); slot != Uninit {
 		// name is captured by the current closure.
 		arg, get, set = byte(slot), OpGetUpval, OpSetUpval
+	} else if p.funType != FScript && name.String() == "arguments" {
+		// name is the list of the arguments passed to the current function, which is read-only.
+		if p.funType == FFinally {
+			p.Error("can't use 'arguments' in a finally block")
+		}
+		p.fun.usesArgs = true
+		p.emitBytes(byte(OpArgs))
+		return
 	} else {
 		// name is a global variable.
 		arg, get, set = p.identConst(&name), OpGetGlobal, OpSetGlobal
 	}
 
-	if canAssign && p.match(TEqual) {
+	switch op, isCompound := compoundOps[p.curr.Type]; {
+	case canAssign && p.match(TEqual):
+		if set == OpSetGlobal {
+			p.checkReadOnly(name, "can't assign to `%v`")
+		}
 		p.expr()
 		p.emitBytes(byte(set), arg)
-	} else {
+	case canAssign && isCompound:
+		// `name op= val` is `name = name op val`.
+		p.advance()
+		if set == OpSetGlobal {
+			p.checkReadOnly(name, "can't assign to `%v`")
+		}
+		p.emitBytes(byte(get), arg)
+		p.expr()
+		p.emitBytes(byte(op), byte(set), arg)
+	default:
 		p.emitBytes(byte(get), arg)
 	}
 }
 
+// compoundOps maps the compound assignment operators to the instructions of their binary operators.
+var compoundOps = map[TokenType]OpCode{
+	TPlusEqual:  OpAdd,
+	TMinusEqual: OpSub,
+	TStarEqual:  OpMul,
+	TSlashEqual: OpDiv,
+}
+
 func (p *Parser) unary(_canAssign bool) {
 	op := p.prev.Type
 
@@ -247,42 +384,146 @@ func (p *Parser) unary(_canAssign bool) {
 	case TMinus:
 		p.emitBytes(byte(OpNeg))
 	default:
-		panic(e.Unreachable)
+		p.errorUnsupported()
 	}
 }
 
 func (p *Parser) binary(_canAssign bool) {
-	op := p.prev.Type
+	op, opLine := p.prev.Type, p.prev.Line
 	rule := parseRules[op]
+	lhsStart, rhsStart := p.lhsStart, len(p.currChunk().code)
 
 	// Compile the RHS.
 	p.parsePrec(rule.Prec + 1)
 
-	// Emit the operator instruction.
+	// Optimization: Concatenation of string constants is folded at compile time.
+	if op == TPlus && p.foldStrConcat(lhsStart, rhsStart) {
+		return
+	}
+	// Optimization: OpAddConst superinstruction.
+	if op == TPlus && p.foldAddConst(lhsStart, rhsStart, opLine) {
+		return
+	}
+	// Optimization: OpConcat superinstruction.
+	if op == TPlus && p.check(TPlus) {
+		p.concat(opLine)
+		return
+	}
+
+	// Emit the operator instruction at the operator's line,
+	// so that runtime errors point at the operator even if the RHS spans multiple lines.
+	var ops []OpCode
 	switch op {
-	case TBangEqual:
-		p.emitBytes(byte(OpEqual), byte(OpNot))
-	case TEqualEqual:
-		p.emitBytes(byte(OpEqual))
+	case TBangEqual, TEqualEqual:
+		ops = []OpCode{OpEqual}
+		// Optimization: Comparisons with a literal, e.g. `x == nil`, use a specialized instruction.
+		if isLit, ok := p.foldEqLit(rhsStart); ok {
+			ops = []OpCode{isLit}
+		}
+		if op == TBangEqual {
+			ops = append(ops, OpNot)
+		}
 	case TGreater:
-		p.emitBytes(byte(OpGreater))
+		ops = []OpCode{OpGreater}
 	case TGreaterEqual:
-		p.emitBytes(byte(OpLess), byte(OpNot))
+		ops = []OpCode{OpLess, OpNot}
 	case TLess:
-		p.emitBytes(byte(OpLess))
+		ops = []OpCode{OpLess}
 	case TLessEqual:
-		p.emitBytes(byte(OpGreater), byte(OpNot))
+		ops = []OpCode{OpGreater, OpNot}
+	case TIn:
+		ops = []OpCode{OpIn}
 	case TPlus:
-		p.emitBytes(byte(OpAdd))
+		ops = []OpCode{OpAdd}
 	case TMinus:
-		p.emitBytes(byte(OpSub))
+		ops = []OpCode{OpSub}
 	case TStar:
-		p.emitBytes(byte(OpMul))
+		ops = []OpCode{OpMul}
 	case TSlash:
-		p.emitBytes(byte(OpDiv))
+		ops = []OpCode{OpDiv}
+	default:
+		p.errorUnsupported()
+	}
+	for _, op := range ops {
+		p.currChunk().Write(byte(op), opLine)
+	}
+}
+
+// concat compiles the rest of a chain of `+` after its first 2 operands, e.g. `+ c + d` in `a + b + c + d`,
+// emitting an OpConcat for each `+` at its line, the first one being at `line`.
+// Each `+` is still applied as soon as its RHS is evaluated, like OpAdd.
+func (p *Parser) concat(line int) {
+	p.currChunk().Write(byte(OpConcat), line)
+	p.currChunk().Write(0, line)
+	for p.match(TPlus) {
+		line := p.prev.Line
+		p.parsePrec(PrecTerm + 1)
+		last := byte(0)
+		if !p.check(TPlus) {
+			last = 1
+		}
+		p.currChunk().Write(byte(OpConcat), line)
+		p.currChunk().Write(last, line)
+	}
+}
+
+// foldStrConcat replaces the code of `lhs + rhs` with a single constant,
+// if both the LHS (starting at `lhsStart`) and the RHS (starting at `rhsStart`) are string constants.
+func (p *Parser) foldStrConcat(lhsStart, rhsStart int) (ok bool) {
+	chunk := p.currChunk()
+	lhs, ok := chunk.strConstIn(lhsStart, rhsStart)
+	if !ok {
+		return false
+	}
+	rhs, ok := chunk.strConstIn(rhsStart, len(chunk.code))
+	if !ok {
+		return false
+	}
+	// Drop the operands' constants if nothing else refers to them, i.e. they are the latest ones.
+	if n := len(chunk.consts); int(chunk.code[lhsStart+1]) == n-2 && int(chunk.code[rhsStart+1]) == n-1 {
+		chunk.truncateConsts(n - 2)
+	}
+	chunk.code, chunk.lines = chunk.code[:lhsStart], chunk.lines[:lhsStart]
+	p.emitConst(NewVStr(lhs.Inner() + rhs.Inner()))
+	return true
+}
+
+// foldAddConst replaces the code of `lhs + rhs` with an OpAddConst at `line`,
+// if the LHS (starting at `lhsStart`) is a local and the RHS (starting at `rhsStart`) is a small integer,
+// e.g. `i + 1`.
+func (p *Parser) foldAddConst(lhsStart, rhsStart, line int) (ok bool) {
+	chunk := p.currChunk()
+	if rhsStart-lhsStart != 2 || OpCode(chunk.code[lhsStart]) != OpGetLocal ||
+		len(chunk.code)-rhsStart != 2 || OpCode(chunk.code[rhsStart]) != OpConstImm {
+		return false
+	}
+	slot, n := chunk.code[lhsStart+1], chunk.code[rhsStart+1]
+	chunk.code, chunk.lines = chunk.code[:lhsStart], chunk.lines[:lhsStart]
+	for _, b := range []byte{byte(OpAddConst), slot, n} {
+		chunk.Write(b, line)
+	}
+	return true
+}
+
+// foldEqLit removes the code of the RHS (starting at `rhsStart`) of `lhs == rhs` if it is a literal
+// of nil, true or false, and returns the instruction that compares the LHS with it instead.
+func (p *Parser) foldEqLit(rhsStart int) (isLit OpCode, ok bool) {
+	chunk := p.currChunk()
+	if len(chunk.code)-rhsStart != 1 {
+		return
+	}
+	switch OpCode(chunk.code[rhsStart]) {
+	case OpNil:
+		isLit = OpIsNil
+	case OpTrue:
+		isLit = OpIsTrue
+	case OpFalse:
+		isLit = OpIsFalse
 	default:
-		panic(e.Unreachable)
+		return
 	}
+	chunk.code, chunk.lines = chunk.code[:rhsStart], chunk.lines[:rhsStart]
+	return isLit, true
 }
 
 func (p *Parser) and(_canAssign bool) {
@@ -309,15 +550,45 @@ func (p *Parser) or(_canAssign bool) {
 	p.patchJump(endJump) // --> then
 }
 
-func (p *Parser) call(_canAssign bool) {
-	argCount := p.argList()
-	p.emitBytes(byte(OpCall), byte(argCount))
+func (p *Parser) call(_canAssign bool) { p.emitCall(p.argList()) }
+
+// emitCall emits the call instruction for the arguments compiled by argList.
+func (p *Parser) emitCall(argCount int, hasSpread bool, names []Token) {
+	switch {
+	case hasSpread && len(names) > 0:
+		p.Error("can't mix spread arguments with named arguments")
+	case hasSpread:
+		p.emitBytes(byte(OpCallSpread), byte(argCount))
+	case len(names) > 0:
+		nameVals := make([]Value, len(names))
+		for i, name := range names {
+			nameVals[i] = NewVStr(name.String())
+		}
+		p.emitBytes(byte(OpCallNamed), p.mkConst(NewVList(nameVals...)), byte(argCount))
+	default:
+		p.emitBytes(byte(OpCall), byte(argCount))
+	}
 }
 
-func (p *Parser) argList() (argCount int) {
+// argList compiles the arguments of a call, reporting whether any of them is spread by `...`,
+// and the names of the trailing named arguments, e.g. `width` and `height` in `f(1, width: 2, height: 3)`.
+func (p *Parser) argList() (argCount int, hasSpread bool, names []Token) {
 	if !p.check(TRParen) {
 		for {
-			p.expr()
+			if p.check(TIdent) && p.peekToken().Type == TColon {
+				p.advance()
+				name := p.prev
+				if slices.IndexFunc(names, name.Eq) != -1 {
+					p.Error("duplicate named argument")
+				}
+				names = append(names, name)
+				p.advance() // Consume the colon.
+			} else if len(names) > 0 {
+				p.ErrorAtCurr("positional arguments must come before named arguments")
+			}
+			if p.elem(TRParen) {
+				hasSpread = true
+			}
 			if argCount++; argCount >= math.MaxUint8 {
 				p.Error("too many arguments")
 			}
@@ -333,38 +604,244 @@ func (p *Parser) argList() (argCount int) {
 func (p *Parser) dot(canAssign bool) {
 	name := p.consume(TIdent, "expect property name after '.'")
 	nameConst := p.identConst(name)
-	switch {
+	switch op, isCompound := compoundOps[p.curr.Type]; {
 	case canAssign && p.match(TEqual):
+		if name != nil && p.isThisInInit(p.lhsStart) {
+			p.addField(*name)
+		}
 		p.expr()
 		p.emitBytes(byte(OpSetProp), nameConst)
+	case canAssign && isCompound:
+		// `obj.name op= val` is `obj.name = obj.name op val`, but `obj` is only evaluated once.
+		p.advance()
+		p.emitBytes(byte(OpDup), byte(OpGetProp), nameConst)
+		p.expr()
+		p.emitBytes(byte(op), byte(OpSetProp), nameConst)
 	case p.match(TLParen):
 		// Optimization: OpInvoke superinstruction.
-		argCount := p.argList()
+		argsStart := len(p.currChunk().code)
+		argCount, hasSpread, names := p.argList()
+		if hasSpread || len(names) > 0 {
+			// The superinstruction only takes positional arguments, so fall back to a regular call,
+			// where the method is bound before the arguments are evaluated.
+			getStart := len(p.currChunk().code)
+			p.emitBytes(byte(OpGetProp), nameConst)
+			p.currChunk().moveBefore(argsStart, getStart)
+			p.emitCall(argCount, hasSpread, names)
+			return
+		}
 		p.emitBytes(byte(OpInvoke), nameConst, byte(argCount))
 	default:
 		p.emitBytes(byte(OpGetProp), nameConst)
 	}
 }
 
+// isThisInInit reports whether the code from `start` onwards pushes `this` in an initializer.
+func (p *Parser) isThisInInit(start int) bool {
+	code := p.currChunk().code[start:]
+	return p.funType == FInit && len(code) == 2 && OpCode(code[0]) == OpGetLocal && code[1] == 0
+}
+
+// addField records `name` as a field of the class being compiled.
+func (p *Parser) addField(name Token) {
+	for _, field := range p.ClassCompiler.fields {
+		if field.Eq(name) {
+			return
+		}
+	}
+	p.ClassCompiler.fields = append(p.ClassCompiler.fields, name)
+}
+
+func (p *Parser) subscript(canAssign bool) {
+	p.expr()
+	p.consume(TRBracket, "expect ']' after subscript")
+	switch op, isCompound := compoundOps[p.curr.Type]; {
+	case canAssign && p.match(TEqual):
+		p.expr()
+		p.emitBytes(byte(OpSetIndex))
+	case canAssign && isCompound:
+		// `obj[key] op= val` is `obj[key] = obj[key] op val`, but `obj` and `key` are only evaluated once.
+		p.advance()
+		p.emitBytes(byte(OpDup2), byte(OpGetIndex))
+		p.expr()
+		p.emitBytes(byte(op), byte(OpSetIndex))
+	default:
+		p.emitBytes(byte(OpGetIndex))
+	}
+}
+
+func (p *Parser) list(_canAssign bool) {
+	elemCount, hasSpread := 0, false
+	if !p.check(TRBracket) {
+		for {
+			if p.elem(TRBracket) {
+				hasSpread = true
+			}
+			if elemCount++; elemCount > math.MaxUint8 {
+				p.Error("too many elements in list literal")
+			}
+			if !p.match(TComma) || p.check(TRBracket) { // Allow a trailing comma.
+				break
+			}
+		}
+	}
+	p.consume(TRBracket, "expect ']' after list elements")
+	if hasSpread {
+		p.emitBytes(byte(OpListSpread), byte(elemCount))
+		return
+	}
+	p.emitBytes(byte(OpList), byte(elemCount))
+}
+
 func (p *Parser) expr() { p.parsePrec(PrecAssign) }
 
+// elem compiles an element of a comma-separated list closed by `closing`, such as a call argument,
+// reporting whether it's spread by `...`, e.g. `...args`.
+// If the element is malformed, the parser recovers at the next `,` or `closing` on the same nesting level,
+// so that errors in the following elements can be reported as well.
+func (p *Parser) elem(closing TokenType) (isSpread bool) {
+	wasPanicking := p.panicMode
+	isSpread = p.match(TDotDotDot)
+	p.expr()
+	if isSpread {
+		p.emitBytes(byte(OpSpread))
+	}
+	if wasPanicking || !p.panicMode {
+		return
+	}
+	for depth := 0; ; p.advance() {
+		switch p.curr.Type {
+		case TLParen, TLBracket, TLBrace:
+			depth++
+		case TRParen, TRBracket, TRBrace:
+			if depth == 0 {
+				if p.check(closing) {
+					p.panicMode = false
+				}
+				return
+			}
+			depth--
+		case TComma:
+			if depth == 0 {
+				p.panicMode = false
+				return
+			}
+		case TSemi, TEOF:
+			// Leave the rest to the statement-level sync.
+			return
+		}
+	}
+}
+
 func (p *Parser) exprStmt() {
+	start := len(p.currChunk().code)
 	p.expr()
 	p.consume(TSemi, "expect ';' after value")
 	p.emitBytes(byte(OpPop))
+	p.lastExprStmt = [2]int{start, len(p.currChunk().code)}
 }
 
+// printStmt compiles `print a, b, c;`, which prints all values on one line separated by spaces.
+// The commas here are separators with the lowest precedence,
+// so each value is a full assignment expression.
 func (p *Parser) printStmt() {
-	p.expr()
+	valCount := 0
+	for {
+		p.expr()
+		if valCount++; valCount > math.MaxUint8 {
+			p.Error("too many values to print")
+		}
+		if !p.match(TComma) {
+			break
+		}
+	}
 	p.consume(TSemi, "expect ';' after value")
-	p.emitBytes(byte(OpPrint))
+	if valCount == 1 {
+		p.emitBytes(byte(OpPrint))
+		return
+	}
+	p.emitBytes(byte(OpPrintN), byte(valCount))
 }
 
-func (p *Parser) block() {
+// block compiles the rest of a block after its '{',
+// reporting whether the block ends with an expression statement, the OpPop of which ends the code.
+func (p *Parser) block() (endsWithExpr bool) {
+	p.hoistFuns()
 	for !p.check(TRBrace) && !p.check(TEOF) {
+		start := len(p.currChunk().code)
 		p.decl()
+		endsWithExpr = p.lastExprStmt == [2]int{start, len(p.currChunk().code)}
 	}
 	p.consume(TRBrace, "expect '}' after block")
+	return
+}
+
+// hoistFuns declares the functions declared directly in the block being compiled in advance,
+// so that local functions can refer to each other regardless of the order of their declarations.
+// Before its declaration is reached, a hoisted function is only visible to the nested functions,
+// where it is nil until then, so a direct reference still resolves to the variable it shadows, if any.
+func (p *Parser) hoistFuns() {
+	if p.depth == 0 {
+		return
+	}
+	names, ok := p.hoisted[p.Scanner.curr]
+	if !ok {
+		p.scanHoisted()
+		names = p.hoisted[p.Scanner.curr]
+	}
+	for _, name := range names {
+		if p.hoistedSlot(name, false) != Uninit || p.isDeclaredInScope(name) {
+			continue // Leave the error reporting to the declaration itself.
+		}
+		p.warnIfShadowing(name)
+		p.emitBytes(byte(OpNil))
+		p.addLocal(name)
+		p.markInit()
+		p.locals[len(p.locals)-1].isHoisted = true
+	}
+}
+
+// scanHoisted looks ahead in the block starting at the current token,
+// recording the functions declared directly in it and in each of its nested blocks in p.hoisted.
+// Scanning the nested blocks at once keeps the compilation linear however deep they are.
+func (p *Parser) scanHoisted() {
+	if p.hoisted == nil {
+		p.hoisted = map[int][]Token{}
+	}
+	saved := *p.Scanner
+	defer func() { *p.Scanner = saved }()
+	var blocks []int // The keys of the blocks enclosing the current token.
+	opening := true  // Whether the current token is the first one of a block.
+	for prev, curr := (Token{}), p.curr; curr.Type != TEOF; prev, curr = curr, p.ScanToken() {
+		if opening {
+			blocks = append(blocks, p.Scanner.curr)
+			p.hoisted[p.Scanner.curr] = nil
+			opening = false
+		}
+		switch {
+		case curr.Type == TLBrace:
+			opening = true
+		case curr.Type == TRBrace:
+			if blocks = blocks[:len(blocks)-1]; len(blocks) == 0 {
+				return
+			}
+		case curr.Type == TIdent && prev.Type == TFun:
+			block := blocks[len(blocks)-1]
+			p.hoisted[block] = append(p.hoisted[block], curr)
+		}
+	}
+}
+
+// hoistedSlot returns the slot of the hoisted function `name` in the current scope, or Uninit if there's none.
+// If `take` is set, the function is marked as declared.
+func (p *Parser) hoistedSlot(name Token, take bool) (slot int) {
+	for i := len(p.locals) - 1; i >= 0 && p.locals[i].depth == p.depth; i-- {
+		if local := &p.locals[i]; local.isHoisted && name.Eq(local.name) {
+			local.isHoisted = !take
+			return i
+		}
+	}
+	return Uninit
 }
 
 func (p *Parser) ifStmt() {
@@ -395,7 +872,7 @@ func (p *Parser) whileStmt() {
 	exitJump := p.emitJump(OpJumpUnless)
 	p.emitBytes(byte(OpPop)) // Pop the condition.
 	p.stmt()
-	p.emitLoop(*p.loopStart)
+	p.emitLoop(p.loop.start)
 
 	p.patchJump(exitJump) // Pop the condition.
 	p.emitBytes(byte(OpPop))
@@ -407,8 +884,13 @@ func (p *Parser) forStmt() {
 	p.beginScope()
 	defer p.endScope()
 
-	// init
 	p.consume(TLParen, "expect '(' after 'for'")
+	if p.check(TIdent) && p.peekToken().Type == TIn {
+		p.forInStmt()
+		return
+	}
+
+	// init
 	switch {
 	case p.match(TSemi):
 		// Noop.
@@ -431,8 +913,8 @@ func (p *Parser) forStmt() {
 
 	// incr
 	if !p.match(TRParen) {
-		bodyJump := p.emitJump(OpJump) // <-- body
-		p.beginLoop()                  // <-- incr
+		bodyJump := p.emitJump(OpJump)         // <-- body
+		p.loop.start = len(p.currChunk().code) // <-- incr
 		// Parse an exprStmt sans the trailing ';'.
 		p.expr()
 		p.emitBytes(byte(OpPop)) // Pure side effect.
@@ -445,7 +927,7 @@ func (p *Parser) forStmt() {
 
 	// body
 	p.stmt()
-	p.emitLoop(*p.loopStart) // --> towards incr (if exists, otherwise next iteration)
+	p.emitLoop(p.loop.start) // --> towards incr (if exists, otherwise next iteration)
 
 	if exitJump != nil {
 		p.patchJump(*exitJump)   // --> !!cond == false
@@ -454,21 +936,58 @@ func (p *Parser) forStmt() {
 	p.endLoop()
 }
 
+// forInStmt compiles the rest of a `for (x in iterable) body` loop after the '('.
+//
+// The iterator is obtained with `iterable.__iter__()`, and stored in a hidden local.
+// Then `iter.__next__()` is called before each iteration, until `done` is returned.
+// The loop variable `x` is bound afresh in each iteration.
+func (p *Parser) forInStmt() {
+	name := p.consume(TIdent, "expect loop variable name")
+	p.consume(TIn, "expect 'in' after loop variable")
+	p.expr()
+	p.consume(TRParen, "expect ')' after for-in clauses")
+
+	p.emitBytes(byte(OpIter))
+	p.addLocal(syntheticToken(TIdent, "(iter)"))
+	p.markInit()
+	iterSlot := byte(len(p.locals) - 1)
+
+	start := p.beginLoop()
+	p.emitBytes(byte(OpGetLocal), iterSlot)
+	exitJump := p.emitJump(OpNext) // <-- `done`
+
+	p.beginScope()
+	p.addLocal(*name)
+	p.markInit()
+	p.locals[len(p.locals)-1].isUsed = true // The loop variable is allowed to be unused, e.g. to repeat `n` times.
+	p.stmt()
+	p.endScope()
+	p.emitLoop(start)
+
+	p.patchJump(exitJump) // --> `done`
+	p.endLoop()
+}
+
 func (p *Parser) breakStmt() {
 	p.consume(TSemi, "expect ';' after 'break'")
+	p.exitTries(p.loop.try)
+	p.discardLocals(p.loop.depth)
 	hole := p.emitJump(OpJump)
-	p.loopEndHoles = append(p.loopEndHoles, hole)
+	p.loop.endHoles = append(p.loop.endHoles, hole)
 }
 
 func (p *Parser) continueStmt() {
 	p.consume(TSemi, "expect ';' after 'continue'")
-	p.emitLoop(*p.loopStart)
+	p.exitTries(p.loop.try)
+	p.discardLocals(p.loop.depth)
+	p.emitLoop(p.loop.start)
 }
 
 func (p *Parser) returnStmt() {
 	switch {
 	case p.match(TSemi):
 		// `return;`
+		p.exitTries(nil)
 		p.emitReturn()
 		return
 	case p.funType == FInit:
@@ -480,20 +999,250 @@ func (p *Parser) returnStmt() {
 	// `return val;`
 	p.expr()
 	p.consume(TSemi, "expect ';' after return value")
+	p.exitTries(nil)
 	p.emitBytes(byte(OpReturn))
 }
 
+// tryStmt compiles the rest of a try statement after the `try`.
+func (p *Parser) tryStmt() {
+	hasCatch, hasFinally := p.scanTryClauses()
+	switch {
+	case hasFinally:
+		p.tryFinally(hasCatch)
+	default:
+		p.tryCatch()
+	}
+}
+
+// tryCatch compiles `{ body } catch (e) { handler }`.
+//
+// The exception handler is installed before running the body, and uninstalled afterwards.
+// When a value is thrown in the body, the stack is unwound to where it was before the body,
+// and the handler runs with the thrown value bound to `e`.
+func (p *Parser) tryCatch() {
+	p.consume(TLBrace, "expect '{' after 'try'")
+	catchJump := p.emitJump(OpTry) // <-- `catch`
+	p.try = &Try{enclosing: p.try, finallySlot: Uninit}
+	p.beginScope()
+	p.block()
+	p.endScope()
+	p.try = p.try.enclosing
+	p.emitBytes(byte(OpEndTry))
+	endJump := p.emitJump(OpJump) // <-- `end`
+
+	p.patchJump(catchJump) // --> `catch`
+	p.consume(TCatch, "expect 'catch' or 'finally' after try block")
+	p.consume(TLParen, "expect '(' after 'catch'")
+	p.beginScope()
+	// The thrown value is already on the stack, so it is just like a local variable.
+	name := p.consume(TIdent, "expect exception variable name")
+	if name != nil {
+		p.declVar()
+		p.markInit()
+		p.locals[len(p.locals)-1].isUsed = true // The exception is allowed to be ignored.
+	}
+	p.consume(TRParen, "expect ')' after exception variable name")
+	p.consume(TLBrace, "expect '{' before catch block")
+	p.block()
+	p.endScope()
+	p.patchJump(endJump) // --> `end`
+}
+
+// tryFinally compiles `{ body } [catch (e) { handler }] finally { cleanup }`,
+// where the cleanup runs exactly once whenever the body (and the handler) is exited:
+// by completing normally, by throwing, or by jumping out with `return`, `break` or `continue`.
+//
+// The cleanup is compiled to a closure stored in a hidden local, which is called on every exit path.
+// Since the cleanup comes after the body in the source, it is placed after the body in the bytecode,
+// and the execution jumps over the body to create the closure first:
+//
+//	    OpNil               ; The hidden local.
+//	    OpJump -> init
+//	body:
+//	    OpTryFinally -> rethrow
+//	    <body>
+//	    OpEndTry
+//	    <call cleanup>
+//	    OpJump -> end
+//	rethrow:
+//	    <call cleanup>
+//	    OpThrow             ; Rethrow the error pushed by the handler.
+//	init:
+//	    OpClos <cleanup>
+//	    OpSetLocal <hidden local>
+//	    OpPop
+//	    OpLoop -> body
+//	end:
+func (p *Parser) tryFinally(hasCatch bool) {
+	p.beginScope()
+	p.emitBytes(byte(OpNil))
+	p.addLocal(syntheticToken(TIdent, "(finally)"))
+	p.markInit()
+	slot := len(p.locals) - 1
+	initJump := p.emitJump(OpJump) // <-- `init`
+
+	body := len(p.currChunk().code)
+	rethrowJump := p.emitJump(OpTryFinally) // <-- `rethrow`
+	p.try = &Try{enclosing: p.try, finallySlot: slot}
+	if hasCatch {
+		p.tryCatch()
+	} else {
+		p.consume(TLBrace, "expect '{' after 'try'")
+		p.beginScope()
+		p.block()
+		p.endScope()
+	}
+	p.try = p.try.enclosing
+	p.emitBytes(byte(OpEndTry))
+	p.callFinally(slot)
+	endJump := p.emitJump(OpJump) // <-- `end`
+
+	p.patchJump(rethrowJump) // --> `rethrow`
+	p.callFinally(slot)
+	p.emitBytes(byte(OpThrow))
+
+	p.patchJump(initJump) // --> `init`
+	p.consume(TFinally, "expect 'finally' after catch block")
+	p.wrapCompiler(FFinally)
+	p.beginScope()
+	p.consume(TLBrace, "expect '{' after 'finally'")
+	p.block()
+	p.endClos()
+	p.emitBytes(byte(OpSetLocal), byte(slot), byte(OpPop))
+	p.emitLoop(body)
+
+	p.patchJump(endJump) // --> `end`
+	p.endScope()
+}
+
+// withStmt compiles `with (name = resource) { body }`,
+// which is like `{ var name = resource; try { body } finally { name.__exit__(); } }`,
+// except that `name.close()` is called instead if there is no `__exit__` method.
+//
+// Since the cleanup is a bound method rather than a block, it is stored in the hidden local directly:
+//
+//	    <resource>          ; The local `name`.
+//	    OpGetLocal <name>
+//	    OpGetCleanup        ; The hidden local.
+//	    OpTryFinally -> rethrow
+//	    <body>
+//	    OpEndTry
+//	    <call cleanup>
+//	    OpJump -> end
+//	rethrow:
+//	    <call cleanup>
+//	    OpThrow             ; Rethrow the error pushed by the handler.
+//	end:
+func (p *Parser) withStmt() {
+	p.consume(TLParen, "expect '(' after 'with'")
+	p.beginScope()
+	p.parseVar("expect resource name")
+	p.consume(TEqual, "expect '=' after resource name")
+	p.expr()
+	p.consume(TRParen, "expect ')' after resource")
+	p.markInit()
+	resSlot := len(p.locals) - 1
+	p.locals[resSlot].isUsed = true // The resource is used by the cleanup.
+
+	p.emitBytes(byte(OpGetLocal), byte(resSlot), byte(OpGetCleanup))
+	p.addLocal(syntheticToken(TIdent, "(finally)"))
+	p.markInit()
+	slot := len(p.locals) - 1
+
+	rethrowJump := p.emitJump(OpTryFinally) // <-- `rethrow`
+	p.try = &Try{enclosing: p.try, finallySlot: slot}
+	p.consume(TLBrace, "expect '{' after 'with' clause")
+	p.beginScope()
+	p.block()
+	p.endScope()
+	p.try = p.try.enclosing
+	p.emitBytes(byte(OpEndTry))
+	p.callFinally(slot)
+	endJump := p.emitJump(OpJump) // <-- `end`
+
+	p.patchJump(rethrowJump) // --> `rethrow`
+	p.callFinally(slot)
+	p.emitBytes(byte(OpThrow))
+
+	p.patchJump(endJump) // --> `end`
+	p.endScope()
+}
+
+// callFinally calls the cleanup closure of a finally block stored in the given local slot.
+func (p *Parser) callFinally(slot int) {
+	p.emitBytes(byte(OpGetLocal), byte(slot), byte(OpCall), 0, byte(OpPop))
+}
+
+// scanTryClauses looks ahead for the catch and finally clauses after the body of a try statement,
+// without consuming anything.
+func (p *Parser) scanTryClauses() (hasCatch, hasFinally bool) {
+	saved := *p.Scanner
+	defer func() { *p.Scanner = saved }()
+
+	// skipBlock skips over the rest of a block after its '{'.
+	skipBlock := func() {
+		for depth := 1; depth > 0; {
+			switch p.ScanToken().Type {
+			case TLBrace:
+				depth++
+			case TRBrace:
+				depth--
+			case TEOF:
+				return
+			}
+		}
+	}
+	if !p.check(TLBrace) {
+		return
+	}
+	skipBlock()
+	next := p.ScanToken()
+	if hasCatch = next.Type == TCatch; hasCatch {
+		for next = p.ScanToken(); next.Type != TLBrace && next.Type != TEOF; next = p.ScanToken() {
+		}
+		skipBlock()
+		next = p.ScanToken()
+	}
+	return hasCatch, next.Type == TFinally
+}
+
+// exitTries uninstalls the handlers of the try blocks being compiled until `until` is reached,
+// running their finally blocks if any, which is required before jumping out of them.
+func (p *Parser) exitTries(until *Try) {
+	for try := p.try; try != until; try = try.enclosing {
+		p.emitBytes(byte(OpEndTry))
+		if try.finallySlot != Uninit {
+			p.callFinally(try.finallySlot)
+		}
+	}
+}
+
+func (p *Parser) throwStmt() {
+	p.expr()
+	p.consume(TSemi, "expect ';' after thrown value")
+	p.emitBytes(byte(OpThrow))
+}
+
 func (p *Parser) stmt() {
 	switch {
 	case p.match(TBreak):
 		if !p.isInLoop() {
-			p.Error("expect 'break' in a loop")
+			if p.funType == FFinally {
+				// The finally block is compiled to a closure, so the enclosing loops are out of reach.
+				p.Error("can't break out of a finally block")
+			} else {
+				p.Error("expect 'break' in a loop")
+			}
 			return
 		}
 		p.breakStmt()
 	case p.match(TContinue):
 		if !p.isInLoop() {
-			p.Error("expect 'continue' in a loop")
+			if p.funType == FFinally {
+				p.Error("can't continue out of a finally block")
+			} else {
+				p.Error("expect 'continue' in a loop")
+			}
 			return
 		}
 		p.continueStmt()
@@ -504,13 +1253,23 @@ func (p *Parser) stmt() {
 	case p.match(TIf):
 		p.ifStmt()
 	case p.match(TReturn):
-		if p.funType == FScript {
+		switch p.funType {
+		case FScript:
 			p.Error("can't return from top-level code")
 			return
+		case FFinally:
+			p.Error("can't return from a finally block")
+			return
 		}
 		p.returnStmt()
 	case p.match(TWhile):
 		p.whileStmt()
+	case p.match(TWith):
+		p.withStmt()
+	case p.match(TTry):
+		p.tryStmt()
+	case p.match(TThrow):
+		p.throwStmt()
 	case p.match(TLBrace):
 		p.beginScope()
 		p.block()
@@ -523,6 +1282,10 @@ func (p *Parser) stmt() {
 func (p *Parser) fun_(ty FunType) {
 	p.wrapCompiler(ty)
 	p.beginScope()
+	// The body isn't nested in the enclosing expression, if any, e.g. in the case of a class expression.
+	nesting := p.nesting
+	p.nesting = 0
+	defer func() { p.nesting = nesting }()
 
 	p.consume(TLParen, "expect '(' after function name")
 	if !p.check(TRParen) {
@@ -531,7 +1294,9 @@ func (p *Parser) fun_(ty FunType) {
 				p.ErrorAtCurr("too many parameters")
 			}
 			param := p.parseVar("expect parameter name")
+			p.fun.params = append(p.fun.params, NewVStr(p.prev.String()))
 			p.defVar(param)
+			p.locals[len(p.locals)-1].isUsed = true // Parameters are allowed to be unused.
 			if !p.match(TComma) {
 				break
 			}
@@ -539,25 +1304,67 @@ func (p *Parser) fun_(ty FunType) {
 	}
 	p.consume(TRParen, "expect ')' after parameters")
 	p.consume(TLBrace, "expect '{' before function body")
-	p.block()
+	if p.block() && p.implicitReturn && (ty == FFun || ty == FMethod) {
+		// Return the value of the final expression statement instead of popping it.
+		code := p.currChunk().code
+		code[len(code)-1] = byte(OpReturn)
+	}
+	p.endClos()
+}
 
+// endClos ends the current Compiler and emits the instruction to create a closure out of the compiled function.
+func (p *Parser) endClos() {
 	// Because we end Compiler completely when we reach the end of the function body,
 	// there's no need to close the lingering outermost scope
 	fun, upvals := p.endCompiler()
 	p.emitBytes(byte(OpClos), p.mkConst(fun))
 	debug.AssertEq(len(upvals), fun.upvalCount)
 	for _, upval := range upvals {
-		p.emitBytes(utils.BoolToInt[byte](upval.isLocal), byte(upval.idx))
+		p.emitBytes(byte(upval.kind), byte(upval.idx))
 	}
 }
 
-func (p *Parser) funDecl() {
+// funDecl compiles a function declaration,
+// wrapping the function with the `decoratorCount` decorators already on the stack.
+func (p *Parser) funDecl(decoratorCount int) {
+	if slot := p.hoistedSlot(p.curr, true); slot != Uninit {
+		// The local has been declared in advance, so we just need to initialize it.
+		p.advance()
+		p.fun_(FFun)
+		p.applyDecorators(decoratorCount)
+		p.emitBytes(byte(OpSetLocal), byte(slot), byte(OpPop))
+		return
+	}
+	// If the function is a local, its slot is where the first decorator lives,
+	// which is exactly where the decorated function ends up.
 	global := p.parseVar("expect function name")
 	if validName := p.checkPrev(TIdent); validName {
 		p.markInit()
 		defer p.defVar(global)
 	}
 	p.fun_(FFun)
+	p.applyDecorators(decoratorCount)
+}
+
+// decorators compiles the decorators `@expr` before a function or method declaration,
+// leaving them on the stack in order.
+// A decorator can be any call expression, e.g. `@memoize` or `@log.with("prefix")`.
+func (p *Parser) decorators() (count int) {
+	for p.match(TAt) {
+		p.parsePrec(PrecCall)
+		count++
+	}
+	return
+}
+
+// applyDecorators replaces the function on the stack top with the result of
+// calling the `count` decorators below it, from the innermost to the outermost,
+// so that `@a @b fun f() {}` defines `f` as `a(b(f))`.
+// ( decorators... fun -- decorated )
+func (p *Parser) applyDecorators(count int) {
+	for i := 0; i < count; i++ {
+		p.emitBytes(byte(OpCall), 1)
+	}
 }
 
 func (p *Parser) varDecl() {
@@ -604,36 +1411,158 @@ func (p *Parser) classDecl() {
 		p.ClassCompiler.hasSuper = true
 	}
 	p.namedVar(*name, false) // Push the class onto the stack for further modifications.
-	p.consume(TLBrace, "expect '{' before class body")
-	for !p.check(TRBrace) && !p.check(TEOF) {
+	p.classBody()
+	p.emitBytes(byte(OpPop)) // Pop off the class.
+}
+
+// classExpr compiles an anonymous class expression `class { methods... }`, leaving the class on the stack.
+// Anonymous classes can't inherit from other classes.
+func (p *Parser) classExpr(_canAssign bool) {
+	name := syntheticToken(TIdent, "(anonymous)")
+	p.emitBytes(byte(OpClass), p.identConst(&name))
+	p.wrapClassCompiler()
+	defer p.unwrapClassCompiler()
+	p.classBody()
+}
+
+// classBody compiles the methods of the class at the stack top.
+func (p *Parser) classBody() {
+	if p.consume(TLBrace, "expect '{' before class body") == nil {
+		return
+	}
+	// Stop at the first error, since the class body can't be synced method by method.
+	for !p.check(TRBrace) && !p.check(TEOF) && !p.panicMode {
 		p.method()
 	}
 	p.consume(TRBrace, "expect '}' after class body")
-	p.emitBytes(byte(OpPop)) // Pop off the class.
+	// Optimization: The fields set in `init` are stored in fixed slots of the instances.
+	for _, field := range p.ClassCompiler.fields {
+		p.emitBytes(byte(OpField), p.identConst(&field))
+	}
 }
 
+// enumDecl compiles `enum Name { Member, ... }` to a namespace instance of a class called `Name`,
+// where each `Name.Member` is bound to a unique sentinel instance of a class called `Name.Member`.
+func (p *Parser) enumDecl() {
+	name := p.consume(TIdent, "expect enum name")
+	if name == nil {
+		return
+	}
+	nameConst := p.identConst(name)
+	p.declVar()
+	p.emitBytes(byte(OpClass), nameConst, byte(OpCall), 0)
+	p.defVar(&nameConst)
+
+	p.consume(TLBrace, "expect '{' before enum body")
+	members := []Token{}
+	for !p.check(TRBrace) && !p.check(TEOF) {
+		member := p.consume(TIdent, "expect enum member name")
+		if member == nil {
+			return
+		}
+		if slices.IndexFunc(members, member.Eq) != -1 {
+			p.Error("already a member with this name in this enum")
+		}
+		members = append(members, *member)
+
+		p.namedVar(*name, false)
+		sentinelName := syntheticToken(TIdent, name.String()+"."+member.String())
+		p.emitBytes(byte(OpClass), p.identConst(&sentinelName), byte(OpCall), 0)
+		p.emitBytes(byte(OpSetProp), p.identConst(member), byte(OpPop))
+		if !p.match(TComma) {
+			break
+		}
+	}
+	p.consume(TRBrace, "expect '}' after enum body")
+}
+
+// method compiles a method declaration.
+// Decorators can only wrap the method after `this` is bound, so they are applied lazily, see VDecorated.
 func (p *Parser) method() {
+	decoratorCount := p.decorators()
+	if decoratorCount > math.MaxUint8 {
+		p.Error("too many decorators")
+	}
+	// `abstract` is only a keyword when followed by a method name, so it's still allowed as a method name.
+	isAbstract := p.check(TIdent) && p.curr.String() == "abstract" && p.peekToken().Type == TIdent
+	if isAbstract {
+		p.advance()
+		if decoratorCount > 0 {
+			p.Error("an abstract method can't be decorated")
+		}
+	}
 	name := p.consume(TIdent, "expect method name")
+	if name == nil {
+		return
+	}
+	if slices.IndexFunc(p.ClassCompiler.methods, name.Eq) != -1 {
+		p.Error("already a method with this name in this class")
+	}
+	p.ClassCompiler.methods = append(p.ClassCompiler.methods, *name)
 	ty := FMethod
 	if name.Eq(Token{Type: TIdent, Runes: []rune("init")}) {
 		ty = FInit
 	}
-	p.fun_(ty)
+	if ty == FInit && decoratorCount > 0 {
+		p.Error("an initializer can't be decorated")
+	}
+	if isAbstract {
+		if ty == FInit {
+			p.Error("an initializer can't be abstract")
+		}
+		p.abstractMethod(name)
+	} else {
+		p.fun_(ty)
+		if decoratorCount > 0 {
+			p.emitBytes(byte(OpDecorate), byte(decoratorCount))
+		}
+	}
 	p.emitBytes(byte(OpMethod), p.identConst(name))
 }
 
+// abstractMethod compiles the rest of the bodyless method declaration `abstract name(params...);`,
+// leaving a VAbstract on the stack. The parameters are only for documentation purposes.
+func (p *Parser) abstractMethod(name *Token) {
+	p.consume(TLParen, "expect '(' after method name")
+	if !p.check(TRParen) {
+		for {
+			p.consume(TIdent, "expect parameter name")
+			if !p.match(TComma) {
+				break
+			}
+		}
+	}
+	p.consume(TRParen, "expect ')' after parameters")
+	p.consume(TSemi, "expect ';' after abstract method declaration")
+	p.emitConst(&VAbstract{name: NewVStr(name.String())})
+}
+
 func (p *Parser) decl() {
+	start := p.Scanner.curr
 	switch {
-	case p.match(TClass):
+	case p.check(TClass) && p.peekToken().Type == TIdent:
+		p.advance()
 		p.classDecl()
+	case p.match(TEnum):
+		p.enumDecl()
 	case p.match(TFun):
-		p.funDecl()
+		p.funDecl(0)
+	case p.check(TAt):
+		decoratorCount := p.decorators()
+		if p.consume(TFun, "expect 'fun' after decorators") != nil {
+			p.funDecl(decoratorCount)
+		}
 	case p.match(TVar):
 		p.varDecl()
 	default:
 		p.stmt()
 	}
 	if p.panicMode {
+		// Skip the offending token if the failing declaration hasn't consumed anything, e.g. a stray `)`,
+		// since `sync` might stop right there and the caller would then retry on the same token forever.
+		if p.Scanner.curr == start && !p.check(TEOF) {
+			p.advance()
+		}
 		p.sync()
 	}
 }
@@ -651,6 +1580,7 @@ var parseRules []ParseRule
 func init() {
 	parseRules = []ParseRule{
 		TLParen:       {(*Parser).grouping, (*Parser).call, PrecCall},
+		TLBracket:     {(*Parser).list, (*Parser).subscript, PrecCall},
 		TDot:          {nil, (*Parser).dot, PrecCall},
 		TMinus:        {(*Parser).unary, (*Parser).binary, PrecTerm},
 		TPlus:         {nil, (*Parser).binary, PrecTerm},
@@ -663,10 +1593,12 @@ func init() {
 		TGreaterEqual: {nil, (*Parser).binary, PrecComp},
 		TLess:         {nil, (*Parser).binary, PrecComp},
 		TLessEqual:    {nil, (*Parser).binary, PrecComp},
+		TIn:           {nil, (*Parser).binary, PrecComp},
 		TIdent:        {(*Parser).var_, nil, PrecNone},
 		TStr:          {(*Parser).str, nil, PrecNone},
 		TNum:          {(*Parser).num, nil, PrecNone},
 		TAnd:          {nil, (*Parser).and, PrecAnd},
+		TClass:        {(*Parser).classExpr, nil, PrecNone},
 		TFalse:        {(*Parser).lit, nil, PrecNone},
 		TNil:          {(*Parser).lit, nil, PrecNone},
 		TOr:           {nil, (*Parser).or, PrecOr},
@@ -678,15 +1610,27 @@ func init() {
 }
 
 func (p *Parser) parsePrec(prec Prec) {
-	p.advance()
+	// Every nested expression, be it a grouping, a unary operand or an argument, recurses through here.
+	if p.maxNesting > 0 && p.nesting >= p.maxNesting {
+		p.ErrorAtCurr("expression too deeply nested")
+		if !p.check(TEOF) {
+			p.advance() // Skip the offending token to make sure that the parser makes progress.
+		}
+		return
+	}
+	p.nesting++
+	defer func() { p.nesting-- }()
 
 	// Parse LHS.
-	prefix := parseRules[p.prev.Type].Prefix
+	prefix := parseRules[p.curr.Type].Prefix
 	if prefix == nil {
-		p.Error("expect expression")
+		// Leave the token in place, since it might be a delimiter that the caller can recover at.
+		p.ErrorAtCurr("expect expression")
 		return
 	}
+	p.advance()
 	canAssign := prec <= PrecAssign
+	lhsStart := len(p.currChunk().code)
 	prefix(p, canAssign)
 
 	// Parse RHS if there's one maintaining rule.Prec >= prec.
@@ -697,12 +1641,14 @@ func (p *Parser) parsePrec(prec Prec) {
 		}
 		p.advance()
 		if rule.Infix == nil {
-			panic(e.Unreachable)
+			p.errorUnsupported()
+			return
 		}
+		p.lhsStart = lhsStart
 		rule.Infix(p, canAssign)
 	}
 
-	if canAssign && p.match(TEqual) {
+	if _, isCompound := compoundOps[p.curr.Type]; canAssign && (p.match(TEqual) || isCompound) {
 		p.Error("invalid assignment target")
 		p.advance()
 	}
@@ -720,10 +1666,17 @@ func (p *Parser) advance() {
 		if p.curr = p.ScanToken(); !p.check(TErr) {
 			break
 		}
-		p.Error(p.curr.String())
+		p.ErrorAtCurr(p.curr.String())
 	}
 }
 
+// peekToken returns the token after the current one without consuming anything.
+func (p *Parser) peekToken() Token {
+	saved := *p.Scanner
+	defer func() { *p.Scanner = saved }()
+	return p.ScanToken()
+}
+
 func (p *Parser) match(ty TokenType) (matched bool) {
 	if !p.check(ty) {
 		return false
@@ -746,6 +1699,7 @@ func (p *Parser) consume(ty TokenType, errorMsg string) *Token {
 /* Compiling helpers */
 
 func (p *Parser) Compile(src string, isREPL bool) (res *VFun, err error) {
+	p.isExpr = false
 	res, err = p.compileWithRule(src, func(p *Parser) {
 		for !p.match(TEOF) {
 			p.decl()
@@ -753,18 +1707,57 @@ func (p *Parser) Compile(src string, isREPL bool) (res *VFun, err error) {
 	})
 	if isREPL && err != nil {
 		declsErr := err
-		p.errors = nil
 		res, err = p.compileWithRule(src, (*Parser).expr)
+		p.isExpr = err == nil
 		if err != nil {
 			err = fmt.Errorf("%w\ncaused by:\n%s", declsErr, err)
 		}
 	}
+	if err == nil {
+		p.commitGlobals()
+	}
 	return
 }
 
+// commitGlobals records the globals declared by the source just compiled as known ones.
+// A failed compilation doesn't record them, since its globals will never be defined.
+func (p *Parser) commitGlobals() {
+	if len(p.newGlobals) == 0 {
+		return
+	}
+	if p.globals == nil {
+		p.globals = make(map[string]struct{}, len(p.newGlobals))
+	}
+	for name := range p.newGlobals {
+		p.globals[name] = struct{}{}
+	}
+}
+
+// ResetGlobals forgets the globals declared by the sources compiled so far,
+// e.g. when the VM has cleared its globals.
+func (p *Parser) ResetGlobals() { p.globals = nil }
+
+// isGlobal returns whether `name` is a global declared by the sources compiled so far,
+// including the source being compiled.
+func (p *Parser) isGlobal(name string) bool {
+	if _, ok := p.globals[name]; ok {
+		return true
+	}
+	_, ok := p.newGlobals[name]
+	return ok
+}
+
 func (p *Parser) compileWithRule(src string, rule func(*Parser)) (res *VFun, err error) {
+	// Report the internal limits hit by the compiler, such as too many constants, as compilation errors.
+	defer func() {
+		if r := recover(); r != nil {
+			p.panicMode = false
+			p.Error(panicReason(r))
+			res, err = nil, p.errors.ErrorOrNil()
+		}
+	}()
+	p.reset(src)
 	p.wrapCompiler(FScript)
-	p.Scanner = NewScanner(src)
 
 	p.advance()
 	rule(p)
@@ -773,6 +1766,22 @@ func (p *Parser) compileWithRule(src string, rule func(*Parser)) (res *VFun, err
 	return
 }
 
+// reset prepares the Parser for compiling `src` from scratch,
+// reusing the buffers allocated by previous compilations where possible.
+func (p *Parser) reset(src string) {
+	if p.Scanner == nil {
+		p.Scanner = NewScanner(src)
+	} else {
+		p.Scanner.Reset(src)
+	}
+	p.Compiler, p.ClassCompiler = nil, nil
+	p.errors, p.warnings, p.panicMode = nil, nil, false
+	p.prev, p.curr = Token{}, Token{}
+	p.nesting = 0
+	p.hoisted = nil
+	p.newGlobals = nil
+}
+
 func (p *Parser) currChunk() *Chunk { return p.fun.chunk }
 
 func (p *Parser) emitBytes(bs ...byte) {
@@ -791,6 +1800,10 @@ func (p *Parser) emitReturn() {
 }
 
 func (p *Parser) endCompiler() (fun *VFun, upvals []Upval) {
+	// The outermost scope of a function is never explicitly ended, so check the locals in it here.
+	for _, local := range p.locals {
+		p.warnIfUnused(local)
+	}
 	p.emitReturn()
 	fun, upvals = p.fun, p.upvals
 	if debug.DEBUG {
@@ -835,10 +1848,70 @@ func (p *Parser) parseVar(errorMsg string) *byte {
 }
 
 func (p *Parser) declVar() {
+	name := p.prev
 	if p.depth == 0 {
+		p.checkReadOnly(name, "can't redefine `%v`")
+		if p.newGlobals == nil {
+			p.newGlobals = map[string]struct{}{}
+		}
+		p.checkNativeRedef(name)
+		p.newGlobals[name.String()] = struct{}{}
 		return
 	}
-	name := p.prev
+	if p.isDeclaredInScope(name) {
+		p.Error("already a variable with this name in this scope")
+	} else {
+		p.warnIfShadowing(name)
+	}
+	p.addLocal(name)
+}
+
+// warnIfShadowing reports a warning if shadow warnings are enabled and the new local `name`
+// shadows a local of an enclosing scope (in any enclosing function) or a known global.
+func (p *Parser) warnIfShadowing(name Token) {
+	if !p.warnShadow {
+		return
+	}
+	for c := p.Compiler; c != nil; c = c.enclosing {
+		for _, local := range c.locals {
+			// Synthetic locals such as `this` have no source position and can't be shadowed by accident.
+			if local.name.Line != 0 && name.Eq(local.name) {
+				p.WarnAt(name, fmt.Sprintf("local variable `%v` shadows a local variable of an enclosing scope", name))
+				return
+			}
+		}
+	}
+	if p.isGlobal(name.String()) {
+		p.WarnAt(name, fmt.Sprintf("local variable `%v` shadows a global variable", name))
+	}
+}
+
+// checkNativeRedef reports the new global `name` if it overwrites a native function.
+// A global which has been declared before is not reported again.
+func (p *Parser) checkNativeRedef(name Token) {
+	if _, ok := p.natives[name.String()]; !ok {
+		return
+	}
+	if p.isGlobal(name.String()) {
+		return
+	}
+	if p.strictNatives {
+		p.Error(fmt.Sprintf("can't redefine native function `%v`", name))
+		return
+	}
+	p.WarnAt(name, fmt.Sprintf("global variable `%v` redefines a native function", name))
+}
+
+// checkReadOnly reports the error `format` about `name` if it is a read-only predefined global such as `done`.
+// Only globals are concerned, so a local or a parameter can still be named `done`.
+func (p *Parser) checkReadOnly(name Token, format string) {
+	if _, ok := readOnlyGlobals[name.String()]; ok {
+		p.ErrorAt(name, fmt.Sprintf(format, name))
+	}
+}
+
+// isDeclaredInScope reports whether a local variable called `name` has been declared in the current scope.
+func (p *Parser) isDeclaredInScope(name Token) bool {
 	// Search for the latest variable declaration of the same name.
 	for i := len(p.locals) - 1; i >= 0; i-- {
 		local := p.locals[i]
@@ -846,51 +1919,83 @@ func (p *Parser) declVar() {
 			break // Variable shadowing in a deeper scope is allowed.
 		}
 		if name.Eq(local.name) {
-			p.Error("already a variable with this name in this scope")
+			return true
 		}
 	}
-	p.addLocal(name)
+	return false
 }
 
+// beginLoop enters a new loop starting at the current position.
 func (p *Parser) beginLoop() (start int) {
 	start = len(p.currChunk().code)
-	p.loopStart = &start
+	p.loop = &Loop{enclosing: p.loop, start: start, depth: p.depth, try: p.try}
 	return
 }
 
+// endLoop patches the pending jumps to the current position and exits the innermost loop.
 func (p *Parser) endLoop() {
-	for _, hole := range p.loopEndHoles {
+	for _, hole := range p.loop.endHoles {
 		p.patchJump(hole)
 	}
-
-	p.loopStart = nil
-	p.loopEndHoles = p.loopEndHoles[:0]
+	p.loop = p.loop.enclosing
 }
 
-func (c *Compiler) isInLoop() bool { return c.loopStart != nil }
+// isInLoop reports whether a loop is being compiled in the current function.
+// Loops don't span function boundaries, since each Compiler has its own loop stack.
+func (c *Compiler) isInLoop() bool { return c.loop != nil }
 func (p *Parser) beginScope()      { p.depth++ }
 
 func (p *Parser) endScope() {
 	p.depth--
 	for len(p.locals) > 0 {
 		last := p.locals[len(p.locals)-1]
-		switch {
-		case last.depth <= p.depth:
+		if last.depth <= p.depth {
 			return // Shouldn't pop off any value with a depth lower than p.depth.
-		case last.isCaptured:
-			p.emitBytes(byte(OpCloseUpval)) // Hoist the local to a VUpval.
-		default:
-			p.emitBytes(byte(OpPop)) // Pop off the local on the stack.
 		}
+		p.warnIfUnused(last)
+		p.discardLocal(last)
 		p.locals = p.locals[:len(p.locals)-1]
 	}
 }
 
-func (c *Compiler) resolveLocal(name Token) (slot int, ok bool) {
+// discardLocals emits the instructions to discard the locals deeper than `depth` on the stack,
+// while keeping them in scope at compile time, e.g. before jumping out of a loop body.
+func (p *Parser) discardLocals(depth int) {
+	for i := len(p.locals) - 1; i >= 0 && p.locals[i].depth > depth; i-- {
+		p.discardLocal(p.locals[i])
+	}
+}
+
+func (p *Parser) discardLocal(local Local) {
+	switch {
+	case local.isCaptured:
+		p.emitBytes(byte(OpCloseUpval)) // Hoist the local to a VUpval.
+	default:
+		p.emitBytes(byte(OpPop)) // Pop off the local on the stack.
+	}
+}
+
+// warnIfUnused reports a warning if `local` has never been referenced.
+func (p *Parser) warnIfUnused(local Local) {
+	// Synthetic locals such as `this` have no source position and are never reported.
+	if local.isUsed || local.name.Line == 0 {
+		return
+	}
+	p.WarnAt(local.name, fmt.Sprintf("unused local variable `%v`", local.name))
+}
+
+// resolveLocal returns the slot of the local `name`, or Uninit if it's a global.
+// If `direct` is set, the reference is in this function itself rather than in a nested one,
+// so the hoisted functions whose declarations haven't been reached yet are skipped.
+func (c *Compiler) resolveLocal(name Token, direct bool) (slot int, ok bool) {
 	// Search for the latest variable declaration of the same name.
 	for i := len(c.locals) - 1; i >= 0; i-- {
-		local := c.locals[i]
+		local := &c.locals[i]
+		if direct && local.isHoisted {
+			continue
+		}
 		if name.Eq(local.name) {
+			local.isUsed = true
 			return i, local.depth != Uninit
 		}
 	}
@@ -898,7 +2003,7 @@ func (c *Compiler) resolveLocal(name Token) (slot int, ok bool) {
 }
 
 func (p *Parser) resolveLocal(name Token) (slot int) {
-	slot, ok := p.Compiler.resolveLocal(name)
+	slot, ok := p.Compiler.resolveLocal(name, true)
 	if !ok {
 		p.Error("can't read local variable in its own initializer")
 	}
@@ -910,12 +2015,17 @@ func (c *Compiler) resolveUpval(name Token) (slot int) {
 	if c.enclosing == nil {
 		return // No outer function to capture from.
 	}
-	if local, ok := c.enclosing.resolveLocal(name); ok && local != Uninit {
+	if local, ok := c.enclosing.resolveLocal(name, false); ok && local != Uninit {
+		if local == 0 && name.Eq(syntheticThis) {
+			// Optimization: `this` is never reassigned, so it can be captured by value,
+			// without having to close the upval when the method returns.
+			return c.addUpval(Upval{kind: UpvalByValue, idx: local})
+		}
 		c.enclosing.locals[local].isCaptured = true
-		return c.addUpval(Upval{isLocal: true, idx: local}) // Variable captured from local.
+		return c.addUpval(Upval{kind: UpvalFromLocal, idx: local}) // Variable captured from local.
 	}
 	if upval := c.enclosing.resolveUpval(name); upval != Uninit {
-		return c.addUpval(Upval{isLocal: false, idx: upval}) // Variable captured from an existing upval in the outer function.
+		return c.addUpval(Upval{kind: UpvalFromUpval, idx: upval}) // Variable captured from an existing upval in the outer function.
 	}
 	return // Give up resolution.
 }
@@ -959,11 +2069,11 @@ const (
 	PrecOr          // or
 	PrecAnd         // and
 	PrecEqual       // == !=
-	PrecComp        // < > <= >=
+	PrecComp        // < > <= >= in
 	PrecTerm        // + -
 	PrecFactor      // * /
 	PrecUnary       // ! -
-	PrecCall        // . ()
+	PrecCall        // . () []
 	PrecPrimary
 )
 
@@ -973,7 +2083,7 @@ func (p *Parser) sync() {
 	p.panicMode = false
 	for !p.check(TEOF) && !p.checkPrev(TSemi) {
 		switch p.curr.Type {
-		case TClass, TFun, TVar, TFor, TIf, TWhile, TPrint, TReturn:
+		case TAt, TClass, TEnum, TFun, TVar, TFor, TIf, TWhile, TWith, TPrint, TReturn, TTry, TThrow:
 			return
 		default:
 			p.advance()
@@ -981,6 +2091,10 @@ func (p *Parser) sync() {
 	}
 }
 
+// errorUnsupported reports that the previous token has a parse rule that can't handle it.
+// This is a bug in the parse rules, but it should never crash the parser.
+func (p *Parser) errorUnsupported() { p.Error("internal error: unsupported operator") }
+
 func (p *Parser) ErrorAt(tk Token, reason string) {
 	if p.panicMode {
 		return // Don't collect error when we're syncing.
@@ -993,10 +2107,15 @@ func (p *Parser) ErrorAt(tk Token, reason string) {
 		tkStr = "EOF"
 	case TIdent:
 		tkStr = fmt.Sprintf("identifier `%v`", tk)
+	case TErr:
+		// The lexeme of an error token is the error message itself.
 	default:
 		tkStr = fmt.Sprintf("`%v`", tk)
 	}
-	reason1 := fmt.Sprintf("at %s, %s", tkStr, reason)
+	reason1 := reason
+	if tkStr != "" {
+		reason1 = fmt.Sprintf("at %s, %s", tkStr, reason)
+	}
 	err := &e.CompilationError{Line: tk.Line, Reason: reason1}
 
 	if debug.DEBUG {
@@ -1007,6 +2126,25 @@ func (p *Parser) ErrorAt(tk Token, reason string) {
 	p.errors = multierror.Append(p.errors, err)
 }
 
+// WarnAt reports a non-fatal diagnostic at the given token.
+func (p *Parser) WarnAt(tk Token, reason string) {
+	p.warnings = multierror.Append(p.warnings, &e.CompilationWarning{Line: tk.Line, Reason: reason})
+	p.warnings.ErrorFormat = formatWarnings
+}
+
+// formatWarnings lists the warnings one per line,
+// without the header of multierror which would call them errors.
+func formatWarnings(warnings []error) string {
+	lines := make([]string, len(warnings))
+	for i, w := range warnings {
+		lines[i] = w.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Warnings returns the warnings collected during the last compilation, or nil if there is none.
+func (p *Parser) Warnings() error { return p.warnings.ErrorOrNil() }
+
 func (p *Parser) Error(reason string)       { p.ErrorAt(p.prev, reason) }
 func (p *Parser) ErrorAtCurr(reason string) { p.ErrorAt(p.curr, reason) }
 func (p *Parser) HadError() bool            { return p.errors != nil }
@@ -12,11 +12,12 @@ func _() {
 	_ = x[FInit-1]
 	_ = x[FMethod-2]
 	_ = x[FScript-3]
+	_ = x[FFinally-4]
 }
 
-const _FunType_name = "FFunFInitFMethodFScript"
+const _FunType_name = "FFunFInitFMethodFScriptFFinally"
 
-var _FunType_index = [...]uint8{0, 4, 9, 16, 23}
+var _FunType_index = [...]uint8{0, 4, 9, 16, 23, 31}
 
 func (i FunType) String() string {
 	if i < 0 || i >= FunType(len(_FunType_index)-1) {
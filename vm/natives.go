@@ -0,0 +1,615 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/exp/slices"
+)
+
+// natives returns the native functions to be predefined as globals in the VM.
+func (vm *VM) natives() map[string]NativeFun {
+	return map[string]NativeFun{
+		"clock": func(_ ...Value) (Value, error) {
+			return VNum(time.Now().UnixNano()) / VNum(time.Second), nil
+		},
+		// str(val) converts `val` to a string, honoring the `toString` method of instances.
+		"str": func(args ...Value) (Value, error) {
+			if err := vm.checkArity("str", 1, args); err != nil {
+				return VNil{}, err
+			}
+			switch val := args[0].(type) {
+			case *VStr:
+				return val, nil
+			default:
+				str, ok, err := vm.toString(val)
+				switch {
+				case err != nil:
+					return VNil{}, err
+				case ok:
+					return str, nil
+				default:
+					res := NewVStr(fmt.Sprintf("%s", val))
+					return res, vm.alloc(sizeOfStr(res))
+				}
+			}
+		},
+		// toBool(val) converts `val` to a boolean according to the truthiness rule of the VM.
+		"toBool": func(args ...Value) (Value, error) {
+			if err := vm.checkArity("toBool", 1, args); err != nil {
+				return VNil{}, err
+			}
+			return vm.truthy(args[0]), nil
+		},
+		// StringBuilder() returns a new empty string builder `sb`,
+		// where `sb.append(val, ...)` appends the values converted like `str` does, and returns `sb`,
+		// and `sb.toString()` returns the string built so far.
+		"StringBuilder": func(args ...Value) (Value, error) {
+			if err := vm.checkArity("StringBuilder", 0, args); err != nil {
+				return VNil{}, err
+			}
+			return &VStrBuilder{}, vm.alloc(sizeOfValue)
+		},
+		// map(key1, val1, key2, val2, ...) returns a new map with the given entries.
+		"map": func(args ...Value) (Value, error) {
+			if len(args)%2 != 0 {
+				return VNil{}, vm.MkErrorf("map: expected an even number of arguments but got %d", len(args))
+			}
+			if err := vm.alloc(sizeOfMap(len(args) / 2)); err != nil {
+				return VNil{}, err
+			}
+			res := NewVMap()
+			for i := 0; i < len(args); i += 2 {
+				res.Set(args[i], args[i+1])
+			}
+			return res, nil
+		},
+		// len(val) returns the number of elements of a list, the number of entries of a map,
+		// or the number of characters of a string.
+		// Characters are Unicode code points, so `len("é")` is 1. See `byteLen` for the UTF-8 length.
+		"len": func(args ...Value) (Value, error) {
+			if err := vm.checkArity("len", 1, args); err != nil {
+				return VNil{}, err
+			}
+			switch val := args[0].(type) {
+			case *VList:
+				return VNum(len(val.elems)), nil
+			case *VMap:
+				return VNum(val.Len()), nil
+			case *VStr:
+				return VNum(utf8.RuneCountInString(val.Inner())), nil
+			default:
+				return VNil{}, vm.MkError("len: argument must be a list, a map or a string")
+			}
+		},
+		// byteLen(s) returns the length of the string `s` in bytes when encoded in UTF-8,
+		// which is greater than `len(s)` if `s` contains non-ASCII characters, e.g. `byteLen("é")` is 2.
+		"byteLen": func(args ...Value) (Value, error) {
+			if err := vm.checkArity("byteLen", 1, args); err != nil {
+				return VNil{}, err
+			}
+			s, ok := args[0].(*VStr)
+			if !ok {
+				return VNil{}, vm.MkError("byteLen: argument must be a string")
+			}
+			return VNum(len(s.Inner())), nil
+		},
+		// split(s, sep) returns the list of substrings of `s` separated by `sep`.
+		// An empty `sep` splits `s` into characters.
+		"split": func(args ...Value) (Value, error) {
+			strs, err := vm.strArgs("split", 2, args)
+			if err != nil {
+				return VNil{}, err
+			}
+			parts := strings.Split(strs[0], strs[1])
+			if err := vm.alloc(sizeOfList(len(parts)) + len(strs[0])); err != nil {
+				return VNil{}, err
+			}
+			res := make([]Value, len(parts))
+			for i, part := range parts {
+				res[i] = NewVStr(part)
+			}
+			return NewVList(res...), nil
+		},
+		// join(list, sep) concatenates the strings in `list`, placing `sep` between them.
+		"join": func(args ...Value) (Value, error) {
+			if err := vm.checkArity("join", 2, args); err != nil {
+				return VNil{}, err
+			}
+			list, ok := args[0].(*VList)
+			sep, ok1 := args[1].(*VStr)
+			if !ok || !ok1 {
+				return VNil{}, vm.MkError("join: arguments must be a list and a string")
+			}
+			parts := make([]string, len(list.elems))
+			for i, elem := range list.elems {
+				part, ok := elem.(*VStr)
+				if !ok {
+					return VNil{}, vm.MkError("join: list elements must be strings")
+				}
+				parts[i] = part.Inner()
+			}
+			res := NewVStr(strings.Join(parts, sep.Inner()))
+			return res, vm.alloc(sizeOfStr(res))
+		},
+		// trim(s) returns `s` without leading and trailing whitespaces.
+		"trim": func(args ...Value) (Value, error) {
+			strs, err := vm.strArgs("trim", 1, args)
+			if err != nil {
+				return VNil{}, err
+			}
+			return NewVStr(strings.TrimSpace(strs[0])), nil
+		},
+		// replace(s, old, new) returns `s` with all the occurrences of `old` replaced by `new`.
+		"replace": func(args ...Value) (Value, error) {
+			strs, err := vm.strArgs("replace", 3, args)
+			if err != nil {
+				return VNil{}, err
+			}
+			res := NewVStr(strings.ReplaceAll(strs[0], strs[1], strs[2]))
+			return res, vm.alloc(sizeOfStr(res))
+		},
+		// startsWith(s, prefix) reports whether `s` begins with `prefix`.
+		"startsWith": func(args ...Value) (Value, error) {
+			strs, err := vm.strArgs("startsWith", 2, args)
+			if err != nil {
+				return VNil{}, err
+			}
+			return VBool(strings.HasPrefix(strs[0], strs[1])), nil
+		},
+		// endsWith(s, suffix) reports whether `s` ends with `suffix`.
+		"endsWith": func(args ...Value) (Value, error) {
+			strs, err := vm.strArgs("endsWith", 2, args)
+			if err != nil {
+				return VNil{}, err
+			}
+			return VBool(strings.HasSuffix(strs[0], strs[1])), nil
+		},
+		// contains(s, sub) reports whether `sub` is a substring of `s`.
+		"contains": func(args ...Value) (Value, error) {
+			strs, err := vm.strArgs("contains", 2, args)
+			if err != nil {
+				return VNil{}, err
+			}
+			return VBool(strings.Contains(strs[0], strs[1])), nil
+		},
+		// ord(char) returns the code point of the first character of the string `char`.
+		"ord": func(args ...Value) (Value, error) {
+			strs, err := vm.strArgs("ord", 1, args)
+			if err != nil {
+				return VNil{}, err
+			}
+			if strs[0] == "" {
+				return VNil{}, vm.MkError("ord: argument must not be empty")
+			}
+			r, _ := utf8.DecodeRuneInString(strs[0])
+			return VNum(r), nil
+		},
+		// chr(code) returns the single-character string of the code point `code`.
+		"chr": func(args ...Value) (Value, error) {
+			if err := vm.checkArity("chr", 1, args); err != nil {
+				return VNil{}, err
+			}
+			code, ok := toInt(args[0])
+			if !ok {
+				return VNil{}, vm.MkError("chr: argument must be an integer")
+			}
+			if code < 0 || code > utf8.MaxRune || !utf8.ValidRune(rune(code)) {
+				return VNil{}, vm.MkErrorf("chr: invalid code point %d", code)
+			}
+			return NewVStr(string(rune(code))), nil
+		},
+		// getenv(name) returns the value of the environment variable `name`, or nil if it is unset.
+		"getenv": func(args ...Value) (Value, error) {
+			if err := vm.checkSandbox("getenv"); err != nil {
+				return VNil{}, err
+			}
+			strs, err := vm.strArgs("getenv", 1, args)
+			if err != nil {
+				return VNil{}, err
+			}
+			val, ok := os.LookupEnv(strs[0])
+			if !ok {
+				return VNil{}, nil
+			}
+			return NewVStr(val), nil
+		},
+		// parseNumber(s) parses the string `s` as a number literal with an optional sign, e.g. `"1_000"` or `"-0xFF"`,
+		// failing with the reason if it is malformed.
+		// In integer mode, integers are parsed exactly as with literals.
+		"parseNumber": func(args ...Value) (Value, error) {
+			strs, err := vm.strArgs("parseNumber", 1, args)
+			if err != nil {
+				return VNil{}, err
+			}
+			res, err := parseSignedNumLit(strs[0], vm.parser.intMode)
+			if err != nil {
+				var numErr *strconv.NumError
+				if errors.As(err, &numErr) {
+					err = numErr.Err
+				}
+				return VNil{}, vm.MkErrorf("parseNumber: can't parse %q: %s", strs[0], err)
+			}
+			return res, nil
+		},
+		// captureStart() makes `print` write to an internal buffer until the matching `captureEnd()`.
+		// Captures can be nested, and those still pending at the end of the script are discarded.
+		"captureStart": func(args ...Value) (Value, error) {
+			if err := vm.checkArity("captureStart", 0, args); err != nil {
+				return VNil{}, err
+			}
+			vm.startCapture()
+			return VNil{}, nil
+		},
+		// captureEnd() ends the latest capture started by `captureStart()`, returning the captured output.
+		"captureEnd": func(args ...Value) (Value, error) {
+			if err := vm.checkArity("captureEnd", 0, args); err != nil {
+				return VNil{}, err
+			}
+			out, ok := vm.endCapture()
+			if !ok {
+				return VNil{}, vm.MkError("captureEnd: no capture in progress")
+			}
+			// The captured bytes have been charged by `print` already.
+			return NewVStr(out), vm.alloc(sizeOfValue)
+		},
+		// fields(obj) returns the sorted list of the names of the fields of the instance `obj`.
+		"fields": func(args ...Value) (Value, error) {
+			if err := vm.checkArity("fields", 1, args); err != nil {
+				return VNil{}, err
+			}
+			this, ok := args[0].(*VInstance)
+			if !ok {
+				return VNil{}, vm.MkError("fields: argument must be an instance")
+			}
+			names := make([]string, 0, len(this.fields))
+			for _, name := range this.FieldNames() {
+				names = append(names, name.Inner())
+			}
+			slices.Sort(names)
+			if err := vm.alloc(sizeOfList(len(names))); err != nil {
+				return VNil{}, err
+			}
+			res := make([]Value, len(names))
+			for i, name := range names {
+				res[i] = NewVStr(name)
+			}
+			return NewVList(res...), nil
+		},
+		// freeze(val) makes the list or map `val` read-only and returns it. Its elements are not frozen.
+		"freeze": func(args ...Value) (Value, error) {
+			if err := vm.checkArity("freeze", 1, args); err != nil {
+				return VNil{}, err
+			}
+			switch val := args[0].(type) {
+			case *VList:
+				val.frozen = true
+			case *VMap:
+				val.frozen = true
+			default:
+				return VNil{}, vm.MkError("freeze: argument must be a list or a map")
+			}
+			return args[0], nil
+		},
+		// clone(val) returns a deep copy of the list or map `val`, preserving shared references and cycles within it.
+		// The copies are never frozen.
+		// Instances and closures are not copied but kept as references,
+		// and the other values are immutable and returned as is.
+		"clone": func(args ...Value) (Value, error) {
+			if err := vm.checkArity("clone", 1, args); err != nil {
+				return VNil{}, err
+			}
+			return vm.clone(args[0], map[Value]Value{})
+		},
+		// range(hi), range(lo, hi) or range(lo, hi, step) returns the list of integers
+		// from `lo` (defaults to 0) up to but excluding `hi`, spaced by `step` (defaults to 1).
+		"range": func(args ...Value) (Value, error) {
+			if len(args) < 1 || len(args) > 3 {
+				return VNil{}, vm.MkErrorf("range: expected 1 to 3 arguments but got %d", len(args))
+			}
+			bounds := []int{0, 0, 1} // lo, hi, step
+			for i, arg := range args {
+				n, ok := toInt(arg)
+				if !ok {
+					return VNil{}, vm.MkError("range: arguments must be integers")
+				}
+				bounds[i] = n
+			}
+			if len(args) == 1 {
+				bounds[0], bounds[1] = 0, bounds[0]
+			}
+			lo, hi, step := bounds[0], bounds[1], bounds[2]
+			if step == 0 {
+				return VNil{}, vm.MkError("range: step must not be zero")
+			}
+			count := 0
+			switch {
+			case step > 0 && hi > lo:
+				count = rangeLen(uint(hi-lo), uint(step))
+			case step < 0 && lo > hi:
+				count = rangeLen(uint(lo-hi), uint(-step))
+			}
+			if err := vm.alloc(sizeOfList(count)); err != nil {
+				return VNil{}, err
+			}
+			if count > maxRangeLen {
+				return VNil{}, vm.MkError("range: too many elements")
+			}
+			// Integer arguments (in integer mode) give integer elements.
+			_, isInt := args[0].(VInt)
+			res := make([]Value, 0, count)
+			for k := 0; k < count; k++ {
+				// The elements are computed from `lo` so that stepping past `hi` can't overflow.
+				i := lo + k*step
+				if isInt {
+					res = append(res, VInt(i))
+				} else {
+					res = append(res, VNum(i))
+				}
+			}
+			return NewVList(res...), nil
+		},
+		// min(x, y, ...) returns the smallest argument, or the smallest element of the list `xs` in `min(xs)`.
+		"min": vm.extremum("min", VLess),
+		// max(x, y, ...) returns the largest argument, or the largest element of the list `xs` in `max(xs)`.
+		"max": vm.extremum("max", VGreater),
+		// sum(xs) returns the sum of the numbers in the list `xs`, or 0 if it's empty.
+		"sum": vm.numFold("sum", 0, VAdd),
+		// product(xs) returns the product of the numbers in the list `xs`, or 1 if it's empty.
+		"product": vm.numFold("product", 1, VMul),
+		// floorDiv(a, b) returns the quotient of `a / b` rounded down, e.g. `floorDiv(-7, 2)` is -4.
+		"floorDiv": func(args ...Value) (Value, error) {
+			quo, _, err := vm.divMod("floorDiv", args)
+			return quo, err
+		},
+		// divmod(a, b) returns the list `[floorDiv(a, b), r]`, where the remainder `r` has the sign of `b`,
+		// such that `a == b * floorDiv(a, b) + r`, e.g. `divmod(-7, 2)` is `[-4, 1]`.
+		"divmod": func(args ...Value) (Value, error) {
+			quo, rem, err := vm.divMod("divmod", args)
+			if err != nil {
+				return VNil{}, err
+			}
+			return NewVList(quo, rem), vm.alloc(sizeOfList(2))
+		},
+		// apply(fn, args) calls `fn` with the elements of the list `args` as its arguments.
+		"apply": func(args ...Value) (Value, error) {
+			if err := vm.checkArity("apply", 2, args); err != nil {
+				return VNil{}, err
+			}
+			list, ok := args[1].(*VList)
+			if !ok {
+				return VNil{}, vm.MkError("apply: second argument must be a list")
+			}
+			return vm.callValue(args[0], list.elems...)
+		},
+		// bind(fn, args...) returns the partial application of `fn` to the leading arguments `args`,
+		// e.g. `bind(add, 10)(5)` is `add(10, 5)`.
+		"bind": func(args ...Value) (Value, error) {
+			if len(args) < 1 {
+				return VNil{}, vm.MkError("bind: expected at least 1 argument but got 0")
+			}
+			res := NewVPartial(args[0], slices.Clone(args[1:])...)
+			if arity, ok := res.arity(); ok && arity < 0 {
+				return VNil{}, vm.MkErrorf("bind: expected at most %d arguments to bind but got %d",
+					arity+len(res.args), len(res.args))
+			}
+			return res, vm.alloc(sizeOfList(len(res.args)))
+		},
+		// compose(f, g) returns a function that calls `g` with its arguments, and then `f` with the result,
+		// e.g. `compose(f, g)(x)` is `f(g(x))`.
+		"compose": func(args ...Value) (Value, error) {
+			if err := vm.checkArity("compose", 2, args); err != nil {
+				return VNil{}, err
+			}
+			f, g := args[0], args[1]
+			return NewVNativeFun(func(args ...Value) (Value, error) {
+				res, err := vm.callValue(g, args...)
+				if err != nil {
+					return VNil{}, err
+				}
+				return vm.callValue(f, res)
+			}), nil
+		},
+		// call(fn, args...) calls `fn` with the remaining arguments.
+		"call": func(args ...Value) (Value, error) {
+			if len(args) < 1 {
+				return VNil{}, vm.MkError("call: expected at least 1 argument but got 0")
+			}
+			return vm.callValue(args[0], args[1:]...)
+		},
+	}
+}
+
+// extremum returns the native `name`, which reduces its arguments (or the elements of its only argument
+// if it's a list) to the first one which is not beaten by any other, where `beats(v, w)` compares 2 values.
+func (vm *VM) extremum(name string, beats func(v, w Value) (Value, bool)) NativeFun {
+	return func(args ...Value) (Value, error) {
+		if len(args) == 1 {
+			list, ok := args[0].(*VList)
+			if !ok {
+				return VNil{}, vm.MkErrorf("%s: a single argument must be a list", name)
+			}
+			if len(list.elems) == 0 {
+				return VNil{}, vm.MkErrorf("%s: list must not be empty", name)
+			}
+			args = list.elems
+		}
+		if len(args) == 0 {
+			return VNil{}, vm.MkErrorf("%s: expected at least 1 argument but got 0", name)
+		}
+		res := args[0]
+		for _, arg := range args[1:] {
+			isBetter, ok := beats(arg, res)
+			if !ok {
+				return VNil{}, vm.MkErrorf("%s: cannot compare %s and %s", name, Kind(res), Kind(arg))
+			}
+			if isBetter.(VBool) {
+				res = arg
+			}
+		}
+		return res, nil
+	}
+}
+
+// builderMethod returns the method `name` of the string builder `sb`, bound to it.
+func (vm *VM) builderMethod(sb *VStrBuilder, name VStr) (Value, error) {
+	switch name.Inner() {
+	case "append":
+		return NewVNativeFun(func(args ...Value) (Value, error) {
+			for _, arg := range args {
+				// Strings are appended as is, and the other values are converted like `str` does.
+				str, err := "", error(nil)
+				if s, ok := arg.(*VStr); ok {
+					str = s.Inner()
+				} else if str, err = vm.display(arg); err != nil {
+					return VNil{}, err
+				}
+				if err := vm.alloc(len(str)); err != nil {
+					return VNil{}, err
+				}
+				sb.buf.WriteString(str)
+			}
+			return sb, nil
+		}), nil
+	case "toString":
+		return NewVNativeFun(func(args ...Value) (Value, error) {
+			if err := vm.checkArity("toString", 0, args); err != nil {
+				return VNil{}, err
+			}
+			res := NewVStr(sb.buf.String())
+			return res, vm.alloc(sizeOfStr(res))
+		}), nil
+	default:
+		return VNil{}, vm.MkErrorf("undefined property '%s'", name.Inner())
+	}
+}
+
+// divMod checks the arguments of the division native `name`, and returns the floored quotient and the remainder.
+func (vm *VM) divMod(name string, args []Value) (quo, rem Value, err error) {
+	if err := vm.checkArity(name, 2, args); err != nil {
+		return VNil{}, VNil{}, err
+	}
+	for _, arg := range args {
+		if _, ok := toVNum(arg); !ok {
+			return VNil{}, VNil{}, vm.MkErrorf("%s: expected a number but got %s", name, Kind(arg))
+		}
+	}
+	if divisor, _ := toVNum(args[1]); divisor == 0 {
+		return VNil{}, VNil{}, vm.MkErrorf("%s: division by zero", name)
+	}
+	quo, rem = floorDivMod(args[0], args[1])
+	return quo, rem, nil
+}
+
+// numFold returns the native `name`, which combines the numbers in its list argument with `op`,
+// returning `empty` for an empty list.
+func (vm *VM) numFold(name string, empty VNum, op func(v, w Value) (Value, bool)) NativeFun {
+	return func(args ...Value) (Value, error) {
+		if err := vm.checkArity(name, 1, args); err != nil {
+			return VNil{}, err
+		}
+		list, ok := args[0].(*VList)
+		if !ok {
+			return VNil{}, vm.MkErrorf("%s: argument must be a list", name)
+		}
+		var res Value = empty
+		for i, elem := range list.elems {
+			if _, ok := toVNum(elem); !ok {
+				return VNil{}, vm.MkErrorf("%s: expected a number but got %s", name, Kind(elem))
+			}
+			if i == 0 {
+				// Start from the first element, so that a list of VInts gives a VInt.
+				res = elem
+				continue
+			}
+			res, _ = op(res, elem)
+		}
+		return res, nil
+	}
+}
+
+// clone deep-copies `val`, where `copies` maps the aggregates already copied to their copies.
+func (vm *VM) clone(val Value, copies map[Value]Value) (Value, error) {
+	if res, ok := copies[val]; ok {
+		return res, nil
+	}
+	switch val := val.(type) {
+	case *VList:
+		if err := vm.alloc(sizeOfList(len(val.elems))); err != nil {
+			return VNil{}, err
+		}
+		res := NewVList(make([]Value, len(val.elems))...)
+		copies[val] = res
+		for i, elem := range val.elems {
+			elem, err := vm.clone(elem, copies)
+			if err != nil {
+				return VNil{}, err
+			}
+			res.elems[i] = elem
+		}
+		return res, nil
+	case *VMap:
+		if err := vm.alloc(sizeOfMap(val.Len())); err != nil {
+			return VNil{}, err
+		}
+		res := NewVMap()
+		copies[val] = res
+		// Keys are kept as is, since they are hashed by identity if they are aggregates.
+		for i, key := range val.keys {
+			elem, err := vm.clone(val.vals[i], copies)
+			if err != nil {
+				return VNil{}, err
+			}
+			res.Set(key, elem)
+		}
+		return res, nil
+	}
+	return val, nil
+}
+
+// maxRangeLen is the maximum length of a list created by `range`,
+// beyond which an error is returned instead of attempting to allocate it.
+const maxRangeLen = 1 << 28
+
+// rangeLen returns the number of steps of `step` needed to cover the distance `dist`,
+// which are both unsigned so that a range as wide as the whole int domain doesn't overflow.
+// The result is capped at math.MaxInt.
+func rangeLen(dist, step uint) int {
+	n := dist / step
+	if dist%step != 0 {
+		n++
+	}
+	if n > math.MaxInt {
+		return math.MaxInt
+	}
+	return int(n)
+}
+
+func (vm *VM) checkArity(name string, arity int, args []Value) error {
+	if len(args) != arity {
+		return vm.MkErrorf("%s: expected %d arguments but got %d", name, arity, len(args))
+	}
+	return nil
+}
+
+// strArgs checks that `args` are exactly `arity` strings, and returns their contents.
+func (vm *VM) strArgs(name string, arity int, args []Value) ([]string, error) {
+	if err := vm.checkArity(name, arity, args); err != nil {
+		return nil, err
+	}
+	res := make([]string, arity)
+	for i, arg := range args {
+		str, ok := arg.(*VStr)
+		if !ok {
+			return nil, vm.MkErrorf("%s: arguments must be strings", name)
+		}
+		res[i] = str.Inner()
+	}
+	return res, nil
+}
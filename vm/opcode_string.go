@@ -10,46 +10,73 @@ func _() {
 	var x [1]struct{}
 	_ = x[OpReturn-0]
 	_ = x[OpConst-1]
-	_ = x[OpNil-2]
-	_ = x[OpTrue-3]
-	_ = x[OpFalse-4]
-	_ = x[OpPop-5]
-	_ = x[OpGetLocal-6]
-	_ = x[OpSetLocal-7]
-	_ = x[OpGetGlobal-8]
-	_ = x[OpDefGlobal-9]
-	_ = x[OpSetGlobal-10]
-	_ = x[OpGetUpval-11]
-	_ = x[OpSetUpval-12]
-	_ = x[OpGetProp-13]
-	_ = x[OpSetProp-14]
-	_ = x[OpGetSuper-15]
-	_ = x[OpEqual-16]
-	_ = x[OpGreater-17]
-	_ = x[OpLess-18]
-	_ = x[OpNot-19]
-	_ = x[OpNeg-20]
-	_ = x[OpAdd-21]
-	_ = x[OpSub-22]
-	_ = x[OpMul-23]
-	_ = x[OpDiv-24]
-	_ = x[OpPrint-25]
-	_ = x[OpJump-26]
-	_ = x[OpJumpUnless-27]
-	_ = x[OpLoop-28]
-	_ = x[OpCall-29]
-	_ = x[OpInvoke-30]
-	_ = x[OpSuperInvoke-31]
-	_ = x[OpClos-32]
-	_ = x[OpCloseUpval-33]
-	_ = x[OpClass-34]
-	_ = x[OpInherit-35]
-	_ = x[OpMethod-36]
+	_ = x[OpConstImm-2]
+	_ = x[OpNil-3]
+	_ = x[OpTrue-4]
+	_ = x[OpFalse-5]
+	_ = x[OpPop-6]
+	_ = x[OpDup-7]
+	_ = x[OpDup2-8]
+	_ = x[OpGetLocal-9]
+	_ = x[OpSetLocal-10]
+	_ = x[OpGetGlobal-11]
+	_ = x[OpDefGlobal-12]
+	_ = x[OpSetGlobal-13]
+	_ = x[OpGetUpval-14]
+	_ = x[OpSetUpval-15]
+	_ = x[OpArgs-16]
+	_ = x[OpGetProp-17]
+	_ = x[OpSetProp-18]
+	_ = x[OpGetSuper-19]
+	_ = x[OpList-20]
+	_ = x[OpListSpread-21]
+	_ = x[OpSpread-22]
+	_ = x[OpGetIndex-23]
+	_ = x[OpSetIndex-24]
+	_ = x[OpEqual-25]
+	_ = x[OpIsNil-26]
+	_ = x[OpIsTrue-27]
+	_ = x[OpIsFalse-28]
+	_ = x[OpGreater-29]
+	_ = x[OpLess-30]
+	_ = x[OpIn-31]
+	_ = x[OpNot-32]
+	_ = x[OpNeg-33]
+	_ = x[OpAdd-34]
+	_ = x[OpAddConst-35]
+	_ = x[OpConcat-36]
+	_ = x[OpSub-37]
+	_ = x[OpMul-38]
+	_ = x[OpDiv-39]
+	_ = x[OpPrint-40]
+	_ = x[OpPrintN-41]
+	_ = x[OpJump-42]
+	_ = x[OpJumpUnless-43]
+	_ = x[OpLoop-44]
+	_ = x[OpIter-45]
+	_ = x[OpNext-46]
+	_ = x[OpTry-47]
+	_ = x[OpTryFinally-48]
+	_ = x[OpEndTry-49]
+	_ = x[OpThrow-50]
+	_ = x[OpGetCleanup-51]
+	_ = x[OpCall-52]
+	_ = x[OpCallSpread-53]
+	_ = x[OpCallNamed-54]
+	_ = x[OpInvoke-55]
+	_ = x[OpSuperInvoke-56]
+	_ = x[OpClos-57]
+	_ = x[OpCloseUpval-58]
+	_ = x[OpClass-59]
+	_ = x[OpInherit-60]
+	_ = x[OpMethod-61]
+	_ = x[OpDecorate-62]
+	_ = x[OpField-63]
 }
 
-const _OpCode_name = "OpReturnOpConstOpNilOpTrueOpFalseOpPopOpGetLocalOpSetLocalOpGetGlobalOpDefGlobalOpSetGlobalOpGetUpvalOpSetUpvalOpGetPropOpSetPropOpGetSuperOpEqualOpGreaterOpLessOpNotOpNegOpAddOpSubOpMulOpDivOpPrintOpJumpOpJumpUnlessOpLoopOpCallOpInvokeOpSuperInvokeOpClosOpCloseUpvalOpClassOpInheritOpMethod"
+const _OpCode_name = "OpReturnOpConstOpConstImmOpNilOpTrueOpFalseOpPopOpDupOpDup2OpGetLocalOpSetLocalOpGetGlobalOpDefGlobalOpSetGlobalOpGetUpvalOpSetUpvalOpArgsOpGetPropOpSetPropOpGetSuperOpListOpListSpreadOpSpreadOpGetIndexOpSetIndexOpEqualOpIsNilOpIsTrueOpIsFalseOpGreaterOpLessOpInOpNotOpNegOpAddOpAddConstOpConcatOpSubOpMulOpDivOpPrintOpPrintNOpJumpOpJumpUnlessOpLoopOpIterOpNextOpTryOpTryFinallyOpEndTryOpThrowOpGetCleanupOpCallOpCallSpreadOpCallNamedOpInvokeOpSuperInvokeOpClosOpCloseUpvalOpClassOpInheritOpMethodOpDecorateOpField"
 
-var _OpCode_index = [...]uint16{0, 8, 15, 20, 26, 33, 38, 48, 58, 69, 80, 91, 101, 111, 120, 129, 139, 146, 155, 161, 166, 171, 176, 181, 186, 191, 198, 204, 216, 222, 228, 236, 249, 255, 267, 274, 283, 291}
+var _OpCode_index = [...]uint16{0, 8, 15, 25, 30, 36, 43, 48, 53, 59, 69, 79, 90, 101, 112, 122, 132, 138, 147, 156, 166, 172, 184, 192, 202, 212, 219, 226, 234, 243, 252, 258, 262, 267, 272, 277, 287, 295, 300, 305, 310, 317, 325, 331, 343, 349, 355, 361, 366, 378, 386, 393, 405, 411, 423, 434, 442, 455, 461, 473, 480, 489, 497, 507, 514}
 
 func (i OpCode) String() string {
 	if i >= OpCode(len(_OpCode_index)-1) {
@@ -1,6 +1,12 @@
 package vm
 
 import (
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
 	e "github.com/rami3l/golox/errors"
 	"golang.org/x/exp/slices"
 )
@@ -14,6 +20,17 @@ func NewScanner(src string) *Scanner {
 	return &Scanner{src: []rune(src), line: 1}
 }
 
+// Reset makes the Scanner start over with `src`, reusing its rune buffer where possible,
+// so that tooling can rescan after each edit without allocating a new buffer every time.
+// Tokens previously returned by the Scanner must not be used after a Reset, since they share the buffer.
+func (s *Scanner) Reset(src string) {
+	s.src = s.src[:0]
+	for _, r := range src {
+		s.src = append(s.src, r)
+	}
+	s.start, s.curr, s.line = 0, 0, 1
+}
+
 func (s *Scanner) ScanToken() Token {
 	s.skipWhitespace()
 	s.start = s.curr
@@ -24,16 +41,36 @@ func (s *Scanner) ScanToken() Token {
 	c := s.advance()
 	switch {
 	case isDigit(c): // Number literal.
-		// Consume the integral part.
-		for isDigit(s.peek()) {
-			s.advance()
+		// Consume the digits of a hexadecimal or binary literal, e.g. `0xFF` or `0b1010`.
+		if c == '0' {
+			for _, base := range []int{16, 2} {
+				if prefix := numPrefixes[base]; (s.peek() == prefix || s.peek() == unicode.ToUpper(prefix)) &&
+					isDigitOf(s.peekNext(), base) {
+					s.advance()
+					s.digits(base)
+					return s.makeToken(TNum)
+				}
+			}
 		}
 
+		// Consume the integral part.
+		s.digits(10)
+
 		// Consume the fractional part if it exists.
 		if s.peek() == '.' && isDigit(s.peekNext()) {
 			s.advance()
-			for isDigit(s.peek()) {
-				s.advance()
+			s.digits(10)
+		}
+
+		// Consume the exponent if it exists, e.g. `e3` or `E-3`.
+		if p := s.peek(); p == 'e' || p == 'E' {
+			sign := 0
+			if p := s.peekNext(); p == '+' || p == '-' {
+				sign = 1
+			}
+			if isDigit(s.peekAt(1 + sign)) {
+				s.curr += 1 + sign
+				s.digits(10)
 			}
 		}
 
@@ -55,19 +92,43 @@ func (s *Scanner) ScanToken() Token {
 		return s.makeToken(TLBrace)
 	case '}':
 		return s.makeToken(TRBrace)
+	case '[':
+		return s.makeToken(TLBracket)
+	case ']':
+		return s.makeToken(TRBracket)
 	case ';':
 		return s.makeToken(TSemi)
 	case ',':
 		return s.makeToken(TComma)
+	case ':':
+		return s.makeToken(TColon)
 	case '.':
+		if s.peek() == '.' && s.peekNext() == '.' {
+			s.curr += 2
+			return s.makeToken(TDotDotDot)
+		}
 		return s.makeToken(TDot)
+	case '@':
+		return s.makeToken(TAt)
 	case '-':
+		if s.match('=') {
+			return s.makeToken(TMinusEqual)
+		}
 		return s.makeToken(TMinus)
 	case '+':
+		if s.match('=') {
+			return s.makeToken(TPlusEqual)
+		}
 		return s.makeToken(TPlus)
 	case '/':
+		if s.match('=') {
+			return s.makeToken(TSlashEqual)
+		}
 		return s.makeToken(TSlash)
 	case '*':
+		if s.match('=') {
+			return s.makeToken(TStarEqual)
+		}
 		return s.makeToken(TStar)
 
 	case '!':
@@ -95,21 +156,40 @@ func (s *Scanner) ScanToken() Token {
 		return s.makeToken(TGreater)
 
 	case '"': // String literal.
+		startLine := s.line
 		for {
 			switch s.peek() {
-			case '\n':
-				s.line++
 			case '"':
 				// Consume the closing quote.
 				s.advance()
 				return s.makeToken(TStr)
 			default:
 				if s.isAtEnd() {
-					return s.errorToken("unterminated string")
+					// Point at the opening quote instead of the EOF.
+					res := s.errorToken("unterminated string")
+					res.Line = startLine
+					return res
+				}
+				if s.advance() == '\n' || s.isLoneCR() {
+					s.line++
 				}
-				s.advance()
 			}
 		}
+
+	case '`': // Escaped identifier, which can be a keyword, e.g. `print`.
+		for p := s.peek(); p != '`'; p = s.peek() {
+			if p == '\n' || p == '\r' || s.isAtEnd() {
+				return s.errorToken("unterminated escaped identifier")
+			}
+			s.advance()
+		}
+		s.advance() // Consume the closing backtick.
+		res := s.makeToken(TIdent)
+		// Strip the backticks, so that `foo` and foo are the same identifier.
+		if res.Runes = res.Runes[1 : len(res.Runes)-1]; len(res.Runes) == 0 {
+			return s.errorToken("empty escaped identifier")
+		}
+		return res
 	}
 
 	return s.errorToken("unexpected character")
@@ -121,9 +201,15 @@ func (s *Scanner) skipWhitespace() {
 		switch s.peek() {
 		case '\n':
 			s.line++
-			fallthrough
+			s.advance()
+
+		case '\r':
+			s.advance()
+			if s.isLoneCR() {
+				s.line++
+			}
 
-		case ' ', '\r', '\t':
+		case ' ', '\t':
 			s.advance()
 
 		case '/': // Skip comments.
@@ -131,7 +217,7 @@ func (s *Scanner) skipWhitespace() {
 				return
 			}
 			// Skip until the end of the line.
-			for s.peek() != '\n' && !s.isAtEnd() {
+			for p := s.peek(); p != '\n' && p != '\r' && !s.isAtEnd(); p = s.peek() {
 				s.advance()
 			}
 
@@ -154,11 +240,28 @@ func (s *Scanner) peek() (res rune) {
 	return s.src[s.curr]
 }
 
-func (s *Scanner) peekNext() (res rune) {
-	if s.isAtEnd() || s.curr+1 >= len(s.src) {
+func (s *Scanner) peekNext() (res rune) { return s.peekAt(1) }
+
+// peekAt returns the rune `offset` runes after the current one, or 0 if it's beyond the end.
+func (s *Scanner) peekAt(offset int) (res rune) {
+	if s.curr+offset >= len(s.src) {
 		return
 	}
-	return s.src[s.curr+1]
+	return s.src[s.curr+offset]
+}
+
+// digits consumes the digits of the given base, which can be separated by single underscores, e.g. `1_000`.
+func (s *Scanner) digits(base int) {
+	for {
+		switch p := s.peek(); {
+		case isDigitOf(p, base):
+			s.advance()
+		case p == '_' && isDigitOf(s.peekNext(), base):
+			s.curr += 2
+		default:
+			return
+		}
+	}
 }
 
 func (s *Scanner) match(expected rune) bool {
@@ -192,6 +295,8 @@ func (s *Scanner) identType() TokenType {
 	case 'c':
 		if s.curr-s.start > 1 {
 			switch s.src[s.start+1] {
+			case 'a':
+				return checkKeyword(2, "tch", TCatch)
 			case 'l':
 				return checkKeyword(2, "ass", TClass)
 			case 'o':
@@ -199,12 +304,21 @@ func (s *Scanner) identType() TokenType {
 			}
 		}
 	case 'e':
-		return checkKeyword(1, "lse", TElse)
+		if s.curr-s.start > 1 {
+			switch s.src[s.start+1] {
+			case 'l':
+				return checkKeyword(2, "se", TElse)
+			case 'n':
+				return checkKeyword(2, "um", TEnum)
+			}
+		}
 	case 'f':
 		if s.curr-s.start > 1 {
 			switch s.src[s.start+1] {
 			case 'a':
 				return checkKeyword(2, "lse", TFalse)
+			case 'i':
+				return checkKeyword(2, "nally", TFinally)
 			case 'o':
 				return checkKeyword(2, "r", TFor)
 			case 'u':
@@ -212,7 +326,14 @@ func (s *Scanner) identType() TokenType {
 			}
 		}
 	case 'i':
-		return checkKeyword(1, "f", TIf)
+		if s.curr-s.start > 1 {
+			switch s.src[s.start+1] {
+			case 'f':
+				return checkKeyword(2, "", TIf)
+			case 'n':
+				return checkKeyword(2, "", TIn)
+			}
+		}
 	case 'n':
 		return checkKeyword(1, "il", TNil)
 	case 'o':
@@ -227,15 +348,36 @@ func (s *Scanner) identType() TokenType {
 		if s.curr-s.start > 1 {
 			switch s.src[s.start+1] {
 			case 'h':
-				return checkKeyword(2, "is", TThis)
+				if s.curr-s.start > 2 {
+					switch s.src[s.start+2] {
+					case 'i':
+						return checkKeyword(3, "s", TThis)
+					case 'r':
+						return checkKeyword(3, "ow", TThrow)
+					}
+				}
 			case 'r':
-				return checkKeyword(2, "ue", TTrue)
+				if s.curr-s.start > 2 {
+					switch s.src[s.start+2] {
+					case 'u':
+						return checkKeyword(3, "e", TTrue)
+					case 'y':
+						return checkKeyword(3, "", TTry)
+					}
+				}
 			}
 		}
 	case 'v':
 		return checkKeyword(1, "ar", TVar)
 	case 'w':
-		return checkKeyword(1, "hile", TWhile)
+		if s.curr-s.start > 1 {
+			switch s.src[s.start+1] {
+			case 'h':
+				return checkKeyword(2, "ile", TWhile)
+			case 'i':
+				return checkKeyword(2, "th", TWith)
+			}
+		}
 	}
 	return TIdent
 }
@@ -256,9 +398,74 @@ func (s *Scanner) errorToken(reason string) (res Token) {
 
 func (s *Scanner) isAtEnd() bool { return s.curr >= len(s.src) }
 
+// isLoneCR reports whether the last consumed rune is a '\r' that is not followed by a '\n',
+// i.e. a line break in the old Mac style.
+// A '\r' followed by a '\n' is a Windows-style line break, which is only counted at the '\n'.
+func (s *Scanner) isLoneCR() bool { return s.src[s.curr-1] == '\r' && s.peek() != '\n' }
+
 func isAlpha(c rune) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' }
 func isDigit(c rune) bool { return c >= '0' && c <= '9' }
 
+// isDigitOf reports whether `c` is a digit of the given base, which is 2, 10 or 16.
+func isDigitOf(c rune, base int) bool {
+	switch base {
+	case 2:
+		return c == '0' || c == '1'
+	case 16:
+		return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+	default:
+		return isDigit(c)
+	}
+}
+
+// numPrefixes maps the non-decimal bases to the letters in their literal prefixes, e.g. `0x`.
+var numPrefixes = map[int]rune{16: 'x', 2: 'b'}
+
+// parseNumLit parses a number literal accepted by the Scanner,
+// such as `42`, `1_000`, `1.5e-3`, `0xFF` or `0b1010`.
+// In integer mode, the literals without a fraction or an exponent give VInts if they fit in one.
+func parseNumLit(lit string, intMode bool) (Value, error) {
+	lit = strings.ReplaceAll(lit, "_", "")
+	for base, prefix := range numPrefixes {
+		if len(lit) > 2 && lit[0] == '0' && unicode.ToLower(rune(lit[1])) == prefix {
+			n, ok := new(big.Int).SetString(lit[2:], base)
+			if !ok {
+				return VNum(0), &strconv.NumError{Func: "ParseInt", Num: lit, Err: strconv.ErrSyntax}
+			}
+			if intMode && n.IsInt64() {
+				return VInt(n.Int64()), nil
+			}
+			res, _ := new(big.Float).SetInt(n).Float64()
+			return VNum(res), nil
+		}
+	}
+	if intMode && !strings.ContainsAny(lit, ".eE") {
+		if res, err := strconv.ParseInt(lit, 10, 64); err == nil {
+			return VInt(res), nil
+		}
+		// Fall back to VNum for overflowing literals.
+	}
+	res, err := strconv.ParseFloat(lit, 64)
+	return VNum(res), err
+}
+
+// parseSignedNumLit is like parseNumLit, except that `s` is checked to be exactly one number literal
+// accepted by the Scanner, optionally preceded by a sign, e.g. `-0xFF` or `+1_000`.
+func parseSignedNumLit(s string, intMode bool) (Value, error) {
+	lit, neg := s, false
+	if s != "" && (s[0] == '+' || s[0] == '-') {
+		lit, neg = s[1:], s[0] == '-'
+	}
+	if tk := NewScanner(lit).ScanToken(); tk.Type != TNum || len(tk.Runes) != utf8.RuneCountInString(lit) {
+		return VNum(0), &strconv.NumError{Func: "ParseFloat", Num: s, Err: strconv.ErrSyntax}
+	}
+	res, err := parseNumLit(lit, intMode)
+	if neg {
+		res, _ = VNeg(res)
+	}
+	return res, err
+}
+
 type Token struct {
 	// The corresponding lexeme of this token, or the error message if Type is TErr.
 	Runes []rune
@@ -286,8 +493,13 @@ const (
 	TRParen
 	TLBrace
 	TRBrace
+	TLBracket
+	TRBracket
 	TComma
+	TColon
 	TDot
+	TDotDotDot
+	TAt
 	TMinus
 	TPlus
 	TSemi
@@ -301,27 +513,38 @@ const (
 	TGreaterEqual
 	TLess
 	TLessEqual
+	TMinusEqual
+	TPlusEqual
+	TSlashEqual
+	TStarEqual
 	TIdent
 	TStr
 	TNum
 	TAnd
 	TBreak
+	TCatch
 	TClass
 	TContinue
 	TElse
+	TEnum
 	TFalse
+	TFinally
 	TFor
 	TFun
 	TIf
+	TIn
 	TNil
 	TOr
 	TPrint
 	TReturn
 	TSuper
 	TThis
+	TThrow
 	TTrue
+	TTry
 	TVar
 	TWhile
+	TWith
 	TErr
 	TEOF
 )
@@ -12,49 +12,65 @@ func _() {
 	_ = x[TRParen-1]
 	_ = x[TLBrace-2]
 	_ = x[TRBrace-3]
-	_ = x[TComma-4]
-	_ = x[TDot-5]
-	_ = x[TMinus-6]
-	_ = x[TPlus-7]
-	_ = x[TSemi-8]
-	_ = x[TSlash-9]
-	_ = x[TStar-10]
-	_ = x[TBang-11]
-	_ = x[TBangEqual-12]
-	_ = x[TEqual-13]
-	_ = x[TEqualEqual-14]
-	_ = x[TGreater-15]
-	_ = x[TGreaterEqual-16]
-	_ = x[TLess-17]
-	_ = x[TLessEqual-18]
-	_ = x[TIdent-19]
-	_ = x[TStr-20]
-	_ = x[TNum-21]
-	_ = x[TAnd-22]
-	_ = x[TBreak-23]
-	_ = x[TClass-24]
-	_ = x[TContinue-25]
-	_ = x[TElse-26]
-	_ = x[TFalse-27]
-	_ = x[TFor-28]
-	_ = x[TFun-29]
-	_ = x[TIf-30]
-	_ = x[TNil-31]
-	_ = x[TOr-32]
-	_ = x[TPrint-33]
-	_ = x[TReturn-34]
-	_ = x[TSuper-35]
-	_ = x[TThis-36]
-	_ = x[TTrue-37]
-	_ = x[TVar-38]
-	_ = x[TWhile-39]
-	_ = x[TErr-40]
-	_ = x[TEOF-41]
+	_ = x[TLBracket-4]
+	_ = x[TRBracket-5]
+	_ = x[TComma-6]
+	_ = x[TColon-7]
+	_ = x[TDot-8]
+	_ = x[TDotDotDot-9]
+	_ = x[TAt-10]
+	_ = x[TMinus-11]
+	_ = x[TPlus-12]
+	_ = x[TSemi-13]
+	_ = x[TSlash-14]
+	_ = x[TStar-15]
+	_ = x[TBang-16]
+	_ = x[TBangEqual-17]
+	_ = x[TEqual-18]
+	_ = x[TEqualEqual-19]
+	_ = x[TGreater-20]
+	_ = x[TGreaterEqual-21]
+	_ = x[TLess-22]
+	_ = x[TLessEqual-23]
+	_ = x[TMinusEqual-24]
+	_ = x[TPlusEqual-25]
+	_ = x[TSlashEqual-26]
+	_ = x[TStarEqual-27]
+	_ = x[TIdent-28]
+	_ = x[TStr-29]
+	_ = x[TNum-30]
+	_ = x[TAnd-31]
+	_ = x[TBreak-32]
+	_ = x[TCatch-33]
+	_ = x[TClass-34]
+	_ = x[TContinue-35]
+	_ = x[TElse-36]
+	_ = x[TEnum-37]
+	_ = x[TFalse-38]
+	_ = x[TFinally-39]
+	_ = x[TFor-40]
+	_ = x[TFun-41]
+	_ = x[TIf-42]
+	_ = x[TIn-43]
+	_ = x[TNil-44]
+	_ = x[TOr-45]
+	_ = x[TPrint-46]
+	_ = x[TReturn-47]
+	_ = x[TSuper-48]
+	_ = x[TThis-49]
+	_ = x[TThrow-50]
+	_ = x[TTrue-51]
+	_ = x[TTry-52]
+	_ = x[TVar-53]
+	_ = x[TWhile-54]
+	_ = x[TWith-55]
+	_ = x[TErr-56]
+	_ = x[TEOF-57]
 }
 
-const _TokenType_name = "TLParenTRParenTLBraceTRBraceTCommaTDotTMinusTPlusTSemiTSlashTStarTBangTBangEqualTEqualTEqualEqualTGreaterTGreaterEqualTLessTLessEqualTIdentTStrTNumTAndTBreakTClassTContinueTElseTFalseTForTFunTIfTNilTOrTPrintTReturnTSuperTThisTTrueTVarTWhileTErrTEOF"
+const _TokenType_name = "TLParenTRParenTLBraceTRBraceTLBracketTRBracketTCommaTColonTDotTDotDotDotTAtTMinusTPlusTSemiTSlashTStarTBangTBangEqualTEqualTEqualEqualTGreaterTGreaterEqualTLessTLessEqualTMinusEqualTPlusEqualTSlashEqualTStarEqualTIdentTStrTNumTAndTBreakTCatchTClassTContinueTElseTEnumTFalseTFinallyTForTFunTIfTInTNilTOrTPrintTReturnTSuperTThisTThrowTTrueTTryTVarTWhileTWithTErrTEOF"
 
-var _TokenType_index = [...]uint8{0, 7, 14, 21, 28, 34, 38, 44, 49, 54, 60, 65, 70, 80, 86, 97, 105, 118, 123, 133, 139, 143, 147, 151, 157, 163, 172, 177, 183, 187, 191, 194, 198, 201, 207, 214, 220, 225, 230, 234, 240, 244, 248}
+var _TokenType_index = [...]uint16{0, 7, 14, 21, 28, 37, 46, 52, 58, 62, 72, 75, 81, 86, 91, 97, 102, 107, 117, 123, 134, 142, 155, 160, 170, 181, 191, 202, 212, 218, 222, 226, 230, 236, 242, 248, 257, 262, 267, 273, 281, 285, 289, 292, 295, 299, 302, 308, 315, 321, 326, 332, 337, 341, 345, 351, 356, 360, 364}
 
 func (i TokenType) String() string {
 	if i < 0 || i >= TokenType(len(_TokenType_index)-1) {
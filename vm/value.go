@@ -2,9 +2,12 @@ package vm
 
 import (
 	"fmt"
+	"math"
+	"strings"
 
 	"github.com/josharian/intern"
 	"github.com/rami3l/golox/utils"
+	"golang.org/x/exp/slices"
 )
 
 type Value interface{ isValue() }
@@ -21,11 +24,31 @@ type VNil struct{}
 func (_ VNil) isValue()       {}
 func (v VNil) String() string { return "nil" }
 
+// VDone is the sentinel returned by an iterator's `__next__` method when it is exhausted.
+type VDone struct{}
+
+func (_ VDone) isValue()       {}
+func (v VDone) String() string { return "done" }
+
+// VGlobals is the `globalThis` view over the global variables of the VM,
+// where `globalThis["name"]` reads or defines the global `name`.
+type VGlobals struct{}
+
+func (_ VGlobals) isValue()       {}
+func (v VGlobals) String() string { return "<globals>" }
+
 type VNum float64
 
 func (_ VNum) isValue()       {}
 func (v VNum) String() string { return fmt.Sprintf("%g", v) }
 
+// VInt is an exact integer, which is only produced by integer literals in integer mode
+// and by integer arithmetic on them. It is promoted to VNum when mixed with VNums or divided.
+type VInt int64
+
+func (_ VInt) isValue()       {}
+func (v VInt) String() string { return fmt.Sprintf("%d", v) }
+
 type VObj interface {
 	Value
 	isObj()
@@ -44,7 +67,10 @@ type VFun struct {
 	name       *VStr
 	chunk      *Chunk
 	arity      int
+	params     []*VStr // The parameter names, used for matching named arguments.
 	upvalCount int
+	// Whether the function refers to `arguments`, in which case it also accepts extra arguments.
+	usesArgs bool
 }
 
 func NewVFun() *VFun { return &VFun{chunk: NewChunk()} }
@@ -56,27 +82,32 @@ func (v *VFun) Name() string {
 	return v.name.Inner()
 }
 
+// Chunk returns the bytecode of the function.
+func (v *VFun) Chunk() *Chunk { return v.chunk }
+
 func (_ *VFun) isValue()      {}
 func (_ *VFun) isObj()        {}
 func (v VFun) String() string { return fmt.Sprintf("<fun %s>", v.Name()) }
 
 type VUpval struct {
+	// The hoisted value if it is closed.
+	// If it is still open, val should be nil, since the value lives in the stack.
 	val *Value
-	// The index at which val can be found in the stack if it is still open.
+	// The index at which the value can be found in the stack if it is still open.
 	// If it is closed, idx should be nil.
 	idx *int
 	// The next pointer of an intrusive linked list of open VUpvals, required for escape analysis.
 	next *VUpval
 }
 
-func NewVUpval(val *Value, idx int) *VUpval { return &VUpval{val: val, idx: utils.Box(idx)} }
+func NewVUpval(idx int) *VUpval { return &VUpval{idx: utils.Box(idx)} }
 
 func (_ *VUpval) isValue() {}
 func (_ *VUpval) isObj()   {}
 
 func (v VUpval) String() string {
 	if v.val == nil {
-		return "upvalue(nil)"
+		return fmt.Sprintf("upvalue(open@%d)", *v.idx)
 	}
 	return fmt.Sprintf("upvalue(%s)", *v.val)
 }
@@ -107,25 +138,214 @@ func (v VNativeFun) String() string { return "<native fun>" }
 type VClass struct {
 	name    *VStr
 	methods map[VStr]Value
+	// The slot indices of the fields known to be set by `init`,
+	// which are stored in VInstance.slots instead of VInstance.fields.
+	fieldIdxs map[VStr]int
 }
 
-func NewVClass(name *VStr) *VClass { return &VClass{name: name, methods: map[VStr]Value{}} }
+func NewVClass(name *VStr) *VClass {
+	return &VClass{name: name, methods: map[VStr]Value{}, fieldIdxs: map[VStr]int{}}
+}
 
 func (_ *VClass) isValue()      {}
 func (_ *VClass) isObj()        {}
 func (v VClass) String() string { return fmt.Sprintf("<class %s>", v.name.Inner()) }
 
+// VAbstract is the placeholder of an abstract method, which fails when called unless overridden.
+type VAbstract struct{ name *VStr }
+
+func (_ *VAbstract) isValue()      {}
+func (_ *VAbstract) isObj()        {}
+func (v VAbstract) String() string { return fmt.Sprintf("<abstract fun %s>", v.name.Inner()) }
+
 type VInstance struct {
 	*VClass
+	// The values of the fields in VClass.fieldIdxs, where nil means that the field is not set yet.
+	slots []Value
+	// The other fields, which is only allocated when needed.
 	fields map[VStr]Value
+	// The decorated methods bound to this instance, which are only allocated when needed.
+	decorated map[*VDecorated]Value
 }
 
 func NewVInstance(class *VClass) *VInstance {
-	return &VInstance{VClass: class, fields: map[VStr]Value{}}
+	res := &VInstance{VClass: class}
+	if len(class.fieldIdxs) > 0 {
+		res.slots = make([]Value, len(class.fieldIdxs))
+	}
+	return res
+}
+
+// Field returns the value of the field `name`, if it is set.
+func (v *VInstance) Field(name VStr) (res Value, ok bool) {
+	if idx, ok := v.fieldIdxs[name]; ok && idx < len(v.slots) {
+		res = v.slots[idx]
+		return res, res != nil
+	}
+	res, ok = v.fields[name]
+	return
+}
+
+// SetField sets the field `name` to `val`.
+func (v *VInstance) SetField(name VStr, val Value) {
+	if idx, ok := v.fieldIdxs[name]; ok && idx < len(v.slots) {
+		v.slots[idx] = val
+		return
+	}
+	if v.fields == nil {
+		v.fields = map[VStr]Value{}
+	}
+	v.fields[name] = val
+}
+
+// FieldNames returns the names of the fields that are set, in no particular order.
+func (v *VInstance) FieldNames() []VStr {
+	res := make([]VStr, 0, len(v.slots)+len(v.fields))
+	for name, idx := range v.fieldIdxs {
+		if idx < len(v.slots) && v.slots[idx] != nil {
+			res = append(res, name)
+		}
+	}
+	for name := range v.fields {
+		res = append(res, name)
+	}
+	return res
 }
 
 func (v VInstance) String() string { return fmt.Sprintf("<instanceof %s>", v.VClass.name.Inner()) }
 
+// VList is a mutable, growable sequence of values.
+type VList struct {
+	elems  []Value
+	frozen bool // Whether the list has been made read-only by `freeze`.
+}
+
+func NewVList(elems ...Value) *VList { return &VList{elems: elems} }
+
+// Elems returns the underlying elements of the list.
+func (v *VList) Elems() []Value { return v.elems }
+
+func (_ *VList) isValue() {}
+func (_ *VList) isObj()   {}
+
+func (v VList) String() string {
+	res := make([]string, len(v.elems))
+	for i, elem := range v.elems {
+		res[i] = fmt.Sprintf("%s", elem)
+	}
+	return "[" + strings.Join(res, ", ") + "]"
+}
+
+// VMap is a mutable hash map from values to values, which keeps its entries in insertion order.
+//
+// The keys are hashed consistently with VEq: strings and numbers by content, and everything else by identity.
+// In particular, two distinct instances are always distinct keys, even if they have the same fields.
+type VMap struct {
+	keys, vals []Value
+	idxs       map[any]int // The indices in keys and vals of each key, by its hashKey.
+	frozen     bool        // Whether the map has been made read-only by `freeze`.
+}
+
+func NewVMap() *VMap { return &VMap{idxs: map[any]int{}} }
+
+// hashKey returns the Go map key identifying the VMap key `key`.
+func hashKey(key Value) any {
+	switch key := key.(type) {
+	case *VStr:
+		return key.Inner()
+	case VInt:
+		// VEq compares VInts and VNums by value, so they should share the same hash key.
+		if n := VNum(key); VInt(n) == key {
+			return n
+		}
+	}
+	// The other values are either immutable scalars, or pointers compared by address.
+	return key
+}
+
+// Get returns the value associated with `key`, if any.
+func (v *VMap) Get(key Value) (val Value, ok bool) {
+	idx, ok := v.idxs[hashKey(key)]
+	if !ok {
+		return VNil{}, false
+	}
+	return v.vals[idx], true
+}
+
+// Set associates `val` with `key`, reporting whether `key` is new to the map.
+func (v *VMap) Set(key, val Value) (isNew bool) {
+	hash := hashKey(key)
+	if idx, ok := v.idxs[hash]; ok {
+		v.vals[idx] = val
+		return false
+	}
+	v.idxs[hash] = len(v.keys)
+	v.keys, v.vals = append(v.keys, key), append(v.vals, val)
+	return true
+}
+
+// Len returns the number of entries in the map.
+func (v *VMap) Len() int { return len(v.keys) }
+
+// Keys returns the keys of the map in insertion order.
+func (v *VMap) Keys() []Value { return v.keys }
+
+func (_ *VMap) isValue() {}
+func (_ *VMap) isObj()   {}
+
+func (v VMap) String() string {
+	res := make([]string, len(v.keys))
+	for i, key := range v.keys {
+		res[i] = fmt.Sprintf("%s: %s", key, v.vals[i])
+	}
+	return "{" + strings.Join(res, ", ") + "}"
+}
+
+// VListIter is the iterator used by `for (x in list)`.
+type VListIter struct {
+	*VList
+	idx int
+}
+
+func (_ *VListIter) isValue()      {}
+func (_ *VListIter) isObj()        {}
+func (v VListIter) String() string { return "<list iterator>" }
+
+// next returns the next element of the list, or VDone if the list is exhausted.
+func (v *VListIter) next() Value {
+	if v.idx >= len(v.elems) {
+		return VDone{}
+	}
+	v.idx++
+	return v.elems[v.idx-1]
+}
+
+// VStrBuilder is the mutable string buffer created by `StringBuilder()`,
+// which appends strings in amortized constant time, unlike `s = s + piece`.
+type VStrBuilder struct{ buf strings.Builder }
+
+func (_ *VStrBuilder) isValue()       {}
+func (_ *VStrBuilder) isObj()         {}
+func (v *VStrBuilder) String() string { return "<string builder>" }
+
+// VConcat is the string being built by a chain of OpConcats, which is never visible to Lox code.
+type VConcat struct{ buf strings.Builder }
+
+func (_ *VConcat) isValue()       {}
+func (v *VConcat) String() string { return "<concat>" }
+
+// VSpread is the list being spread by `...` in a call or a list literal, which is never visible to Lox code.
+type VSpread struct{ elems []Value }
+
+func (_ *VSpread) isValue()      {}
+func (v VSpread) String() string { return "<spread>" }
+
+// VErr is an error being propagated through a finally block, which is never visible to Lox code.
+type VErr struct{ err error }
+
+func (_ *VErr) isValue()      {}
+func (v VErr) String() string { return fmt.Sprintf("<error %s>", v.err) }
+
 type VBoundMethod struct {
 	*VClos
 	this Value
@@ -135,83 +355,257 @@ func NewVBoundMethod(this Value, clos *VClos) *VBoundMethod {
 	return &VBoundMethod{VClos: clos, this: this}
 }
 
+// VDecorated is a method declared with decorators.
+// Since a method needs `this`, the decorators are applied to the method bound to each instance,
+// the first time it's accessed on that instance.
+type VDecorated struct {
+	method     *VClos
+	decorators []Value // The decorators from the outermost to the innermost.
+}
+
+func NewVDecorated(method *VClos, decorators []Value) *VDecorated {
+	return &VDecorated{method: method, decorators: decorators}
+}
+
+func (_ *VDecorated) isValue()      {}
+func (_ *VDecorated) isObj()        {}
+func (v VDecorated) String() string { return v.method.String() }
+
+func (v VBoundMethod) String() string {
+	if this, ok := v.this.(*VInstance); ok {
+		return fmt.Sprintf("<bound %s of %s>", v.Name(), this.VClass.name.Inner())
+	}
+	return fmt.Sprintf("<bound %s of %s>", v.Name(), v.this)
+}
+
+// VPartial is the partial application of `callee` to the leading arguments `args`,
+// which are prepended to the arguments of each call.
+type VPartial struct {
+	callee Value
+	args   []Value
+}
+
+func NewVPartial(callee Value, args ...Value) *VPartial {
+	return &VPartial{callee: callee, args: args}
+}
+
+func (_ *VPartial) isValue()      {}
+func (_ *VPartial) isObj()        {}
+func (v VPartial) String() string { return fmt.Sprintf("<partial %s>", v.callee) }
+
+// arity returns the number of arguments expected by the partial application,
+// or false if the callee accepts any number of arguments, e.g. a native function.
+func (v *VPartial) arity() (res int, ok bool) {
+	switch callee := v.callee.(type) {
+	case *VClos:
+		if callee.usesArgs {
+			return 0, false
+		}
+		res = callee.arity
+	case *VBoundMethod:
+		if callee.usesArgs {
+			return 0, false
+		}
+		res = callee.arity
+	case *VPartial:
+		if res, ok = callee.arity(); !ok {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+	return res - len(v.args), true
+}
+
 /* Value operations */
 
-func VAdd(v, w Value) (res Value, ok bool) {
-	res = NewValue()
+// Kind returns the name of the kind of `v` used in error messages, e.g. "number" or "instance".
+func Kind(v Value) string {
+	switch v.(type) {
+	case VNil:
+		return "nil"
+	case VBool:
+		return "boolean"
+	case VNum, VInt:
+		return "number"
+	case *VStr:
+		return "string"
+	case *VFun, *VClos, *VNativeFun, *VBoundMethod, *VPartial, *VAbstract, *VDecorated:
+		return "function"
+	case *VClass:
+		return "class"
+	case *VInstance:
+		return "instance"
+	case *VList:
+		return "list"
+	case *VMap:
+		return "map"
+	case *VListIter:
+		return "iterator"
+	case *VStrBuilder:
+		return "string builder"
+	case VDone:
+		return "done"
+	case VGlobals:
+		return "globals"
+	default:
+		return "value"
+	}
+}
+
+// The approximate sizes of values in bytes, used for enforcing the VM's memory limit.
+const sizeOfValue = 16 // The size of an interface value.
+
+func sizeOfStr(v *VStr) int { return sizeOfValue + len(v.Inner()) }
+func sizeOfList(n int) int  { return sizeOfValue + 24 + sizeOfN(n, sizeOfValue) }
+func sizeOfMap(n int) int   { return sizeOfValue + 56 + sizeOfN(n, sizeOfEntry) }
+
+// sizeOfN returns the size of `n` elements of the given `size`,
+// saturating well below math.MaxInt instead of overflowing, so that it's never within the memory limit.
+func sizeOfN(n, size int) int {
+	if n > math.MaxInt/2/size {
+		return math.MaxInt / 2
+	}
+	return n * size
+}
+
+const sizeOfEntry = 3 * sizeOfValue // The key, the value, and the hash key.
+
+// toInt converts an integral numeric value to an int.
+func toInt(v Value) (res int, ok bool) {
+	n, ok := toVNum(v)
+	if !ok || n != VNum(int(n)) {
+		return 0, false
+	}
+	return int(n), true
+}
+
+// toVNum converts a numeric value to a VNum, promoting VInts to floats.
+func toVNum(v Value) (res VNum, ok bool) {
 	switch v := v.(type) {
 	case VNum:
-		switch w := w.(type) {
-		case VNum:
-			return v + w, true
-		}
-	case *VStr:
-		switch w := w.(type) {
-		case *VStr:
-			return NewVStr(v.Inner() + w.Inner()), true
-		}
+		return v, true
+	case VInt:
+		return VNum(v), true
 	}
 	return
 }
 
-func VSub(v, w Value) (res Value, ok bool) {
+// numBinOp applies `intOp` if both operands are VInts, or `numOp` if they are numbers in general.
+func numBinOp(v, w Value, intOp func(v, w VInt) Value, numOp func(v, w VNum) Value) (res Value, ok bool) {
 	res = NewValue()
-	switch v := v.(type) {
-	case VNum:
-		switch w := w.(type) {
-		case VNum:
-			return v - w, true
+	if v, ok := v.(VInt); ok {
+		if w, ok := w.(VInt); ok && intOp != nil {
+			return intOp(v, w), true
+		}
+	}
+	if v, ok := toVNum(v); ok {
+		if w, ok := toVNum(w); ok {
+			return numOp(v, w), true
 		}
 	}
 	return
 }
 
-func VMul(v, w Value) (res Value, ok bool) {
-	res = NewValue()
+// The arithmetic on VInts falls back to VNums on overflow, just like overflowing integer literals do.
+
+func addInt(v, w VInt) Value {
+	if res := v + w; (res > v) == (w > 0) {
+		return res
+	}
+	return VNum(v) + VNum(w)
+}
+
+func subInt(v, w VInt) Value {
+	if res := v - w; (res < v) == (w > 0) {
+		return res
+	}
+	return VNum(v) - VNum(w)
+}
+
+func mulInt(v, w VInt) Value {
+	if w == 0 {
+		return VInt(0)
+	}
+	if res := v * w; res/w == v && !(v == math.MinInt64 && w == -1) {
+		return res
+	}
+	return VNum(v) * VNum(w)
+}
+
+func VAdd(v, w Value) (res Value, ok bool) {
 	switch v := v.(type) {
-	case VNum:
+	case *VStr:
 		switch w := w.(type) {
-		case VNum:
-			return v * w, true
+		case *VStr:
+			return NewVStr(v.Inner() + w.Inner()), true
 		}
 	}
-	return
+	return numBinOp(v, w, addInt, func(v, w VNum) Value { return v + w })
+}
+
+func VSub(v, w Value) (res Value, ok bool) {
+	return numBinOp(v, w, subInt, func(v, w VNum) Value { return v - w })
+}
+
+func VMul(v, w Value) (res Value, ok bool) {
+	return numBinOp(v, w, mulInt, func(v, w VNum) Value { return v * w })
 }
 
+// VDiv always performs a floating point division, even for VInts.
 func VDiv(v, w Value) (res Value, ok bool) {
-	res = NewValue()
-	switch v := v.(type) {
-	case VNum:
-		switch w := w.(type) {
-		case VNum:
-			return v / w, true
+	return numBinOp(v, w, nil, func(v, w VNum) Value { return v / w })
+}
+
+// floorDivMod returns the floored quotient and the remainder of the division of 2 numbers,
+// where the remainder has the sign of the divisor (like in Python), e.g. -7 and 2 give -4 and 1.
+// Both results are VInts if both operands are VInts. The divisor must not be zero.
+func floorDivMod(v, w Value) (quo, rem Value) {
+	if v, ok := v.(VInt); ok {
+		if w, ok := w.(VInt); ok {
+			if v == math.MinInt64 && w == -1 {
+				return -VNum(v), VInt(0) // The quotient overflows.
+			}
+			quo, rem := v/w, v%w
+			if rem != 0 && (rem < 0) != (w < 0) {
+				quo, rem = quo-1, rem+w
+			}
+			return quo, rem
 		}
 	}
-	return
+	x, _ := toVNum(v)
+	y, _ := toVNum(w)
+	m := VNum(math.Mod(float64(x), float64(y)))
+	if m != 0 && (m < 0) != (y < 0) {
+		m += y
+	}
+	return VNum(math.Floor(float64(x / y))), m
 }
 
+// VGreater compares numbers by value, and strings lexicographically by their UTF-8 bytes.
 func VGreater(v, w Value) (res Value, ok bool) {
-	res = NewValue()
-	switch v := v.(type) {
-	case VNum:
-		switch w := w.(type) {
-		case VNum:
-			return VBool(v > w), true
+	if v, ok := v.(*VStr); ok {
+		if w, ok := w.(*VStr); ok {
+			return VBool(v.Inner() > w.Inner()), true
 		}
 	}
-	return
+	return numBinOp(v, w,
+		func(v, w VInt) Value { return VBool(v > w) },
+		func(v, w VNum) Value { return VBool(v > w) },
+	)
 }
 
+// VLess compares numbers by value, and strings lexicographically by their UTF-8 bytes.
 func VLess(v, w Value) (res Value, ok bool) {
-	res = NewValue()
-	switch v := v.(type) {
-	case VNum:
-		switch w := w.(type) {
-		case VNum:
-			return VBool(v < w), true
+	if v, ok := v.(*VStr); ok {
+		if w, ok := w.(*VStr); ok {
+			return VBool(v.Inner() < w.Inner()), true
 		}
 	}
-	return
+	return numBinOp(v, w,
+		func(v, w VInt) Value { return VBool(v < w) },
+		func(v, w VNum) Value { return VBool(v < w) },
+	)
 }
 
 func VNeg(v Value) (res Value, ok bool) {
@@ -219,10 +613,17 @@ func VNeg(v Value) (res Value, ok bool) {
 	switch v := v.(type) {
 	case VNum:
 		return -v, true
+	case VInt:
+		if v == math.MinInt64 {
+			return -VNum(v), true // The negation overflows.
+		}
+		return -v, true
 	}
 	return
 }
 
+// VTruthy is the default truthiness rule, where only `false` and `nil` are falsey,
+// so `0`, `""` and `[]` are all truthy.
 func VTruthy(v Value) VBool {
 	switch v := v.(type) {
 	case VBool:
@@ -234,4 +635,158 @@ func VTruthy(v Value) VBool {
 	}
 }
 
-func VEq(v, w Value) VBool { return v == w }
+// VTruthyExt is the extended truthiness rule, where zero, the empty string,
+// the empty list and the empty map are also falsey, in addition to `false` and `nil`.
+func VTruthyExt(v Value) VBool {
+	switch v := v.(type) {
+	case VNum:
+		return v != 0
+	case VInt:
+		return v != 0
+	case *VStr:
+		return v.Inner() != ""
+	case *VList:
+		return len(v.elems) != 0
+	case *VMap:
+		return v.Len() != 0
+	default:
+		return VTruthy(v)
+	}
+}
+
+// VEq reports whether `v == w` without overloading.
+// Strings are compared by content, since NewVStr allocates a new *VStr each time
+// and a string built at runtime, e.g. by `"foo" + "bar"`, is never identical to a literal.
+// Numbers are compared by value, everything else by identity.
+func VEq(v, w Value) VBool {
+	if v, ok := v.(*VStr); ok {
+		if w, ok := w.(*VStr); ok {
+			return v.Inner() == w.Inner()
+		}
+	}
+	if _, ok := v.(VInt); ok {
+		if eq, ok := numBinOp(v, w,
+			func(v, w VInt) Value { return VBool(v == w) },
+			func(v, w VNum) Value { return VBool(v == w) },
+		); ok {
+			return eq.(VBool)
+		}
+	}
+	if _, ok := w.(VInt); ok {
+		return VEq(w, v)
+	}
+	return v == w
+}
+
+/* Host interop */
+
+// Nil returns the Lox `nil`.
+func Nil() Value { return VNil{} }
+
+// Bool converts a Go bool to a Lox boolean.
+func Bool(b bool) Value { return VBool(b) }
+
+// Number converts a Go float64 to a Lox number.
+func Number(n float64) Value { return VNum(n) }
+
+// Str converts a Go string to a Lox string.
+func Str(s string) Value { return NewVStr(s) }
+
+// List creates a Lox list holding the given elements, without copying them.
+func List(elems []Value) Value { return NewVList(elems...) }
+
+// Map creates a Lox map holding the given entries.
+// Since Go maps are unordered, the insertion order of the entries is unspecified.
+func Map(entries map[Value]Value) Value {
+	res := NewVMap()
+	for key, val := range entries {
+		res.Set(key, val)
+	}
+	return res
+}
+
+// IsNil reports whether `v` is the Lox `nil`.
+func IsNil(v Value) bool { return v == VNil{} }
+
+// AsBool converts a Lox boolean to a Go bool.
+func AsBool(v Value) (res bool, ok bool) {
+	b, ok := v.(VBool)
+	return bool(b), ok
+}
+
+// AsNumber converts a Lox number, including an exact integer, to a Go float64.
+func AsNumber(v Value) (res float64, ok bool) {
+	n, ok := toVNum(v)
+	return float64(n), ok
+}
+
+// AsStr converts a Lox string to a Go string.
+func AsStr(v Value) (res string, ok bool) {
+	s, ok := v.(*VStr)
+	if !ok {
+		return "", false
+	}
+	return s.Inner(), true
+}
+
+// AsList returns the elements of a Lox list, which are shared with the list.
+func AsList(v Value) (res []Value, ok bool) {
+	l, ok := v.(*VList)
+	if !ok {
+		return nil, false
+	}
+	return l.elems, true
+}
+
+// AsMap copies the entries of a Lox map to a Go map.
+func AsMap(v Value) (res map[Value]Value, ok bool) {
+	m, ok := v.(*VMap)
+	if !ok {
+		return nil, false
+	}
+	res = make(map[Value]Value, m.Len())
+	for i, key := range m.keys {
+		res[key] = m.vals[i]
+	}
+	return res, true
+}
+
+// Walk traverses `v` depth-first, calling `visit` on each value reached, starting from `v` itself.
+// Unless `visit` returns false, it then recurses into the elements of a list, the keys and values of a map,
+// or the fields of an instance in the order of their names.
+// Each list, map and instance is visited at most once, so that cyclic values are walked in finite time.
+func Walk(v Value, visit func(Value) bool) {
+	seen := map[Value]bool{}
+	var walk func(v Value)
+	walk = func(v Value) {
+		switch v.(type) {
+		case *VList, *VMap, *VInstance:
+			if seen[v] {
+				return
+			}
+			seen[v] = true
+		}
+		if !visit(v) {
+			return
+		}
+		switch v := v.(type) {
+		case *VList:
+			for _, elem := range v.elems {
+				walk(elem)
+			}
+		case *VMap:
+			for i, key := range v.keys {
+				walk(key)
+				walk(v.vals[i])
+			}
+		case *VInstance:
+			names := v.FieldNames()
+			slices.SortFunc(names, func(a, b VStr) bool { return a.Inner() < b.Inner() })
+			for _, name := range names {
+				field, _ := v.Field(name)
+				walk(field)
+			}
+		}
+	}
+	walk(v)
+}
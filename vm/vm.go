@@ -1,10 +1,14 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
 	"io"
-	"time"
+	"math"
+	"os"
+	"strings"
 
+	"github.com/MakeNowJust/heredoc/v2"
 	"github.com/chzyer/readline"
 	"github.com/rami3l/golox/debug"
 	e "github.com/rami3l/golox/errors"
@@ -16,24 +20,358 @@ import (
 
 type VM struct {
 	globals    map[VStr]Value
-	openUpvals *VUpval // The head of a linked list of open VUpvals for escape analysis.
+	parser     *Parser   // The Parser reused across calls to Interpret.
+	stdout     io.Writer // The destination of `print`.
+	captures   []Capture // The stack of output captures started by `captureStart`.
+	openUpvals *VUpval   // The head of a linked list of open VUpvals for escape analysis.
 	stack      []Value
 	frames     []CallFrame // The call stack.
+	handlers   []Handler   // The stack of installed exception handlers.
+	fuel       int         // The number of instructions left to execute, or Uninit if unlimited.
+	mem        int         // The approximate number of bytes left to allocate, or Uninit if unlimited.
+	sandbox    bool        // Whether the natives accessing the host environment are disabled.
+	extFalsy   bool        // Whether the extended truthiness rule VTruthyExt is used instead of VTruthy.
+	stats      *Stats      // The statistics of the execution so far, or nil if they are not collected.
+	profile    []int       // The execution count of each opcode, or nil if profiling is disabled.
+	program    *VFun       // The top-level function last loaded by Load, or nil if there is none.
+
+	breakpoints map[int]struct{}                // The source lines to pause at.
+	watches     map[VStr][]func(old, new Value) // The callbacks to call when a global changes.
+	// The call stack depth and the line of the last executed instruction,
+	// used to pause only once when entering a line with a breakpoint.
+	lastDepth, lastLine int
 }
 
-func NewVM() *VM {
+// NewVM creates a VM configured by the given options, e.g. `NewVM(WithFuel(1000), WithSandbox())`.
+func NewVM(opts ...Option) *VM {
 	// * Note: This deviates from the original implementation because no manual GC is required.
-	return &VM{globals: map[VStr]Value{
-		// Native functions.
-		*NewVStr("clock"): NewVNativeFun(func(_ ...Value) (Value, error) {
-			return VNum(time.Now().UnixNano()) / VNum(time.Second), nil
-		}),
-	}}
+	vm := &VM{
+		globals:     map[VStr]Value{},
+		parser:      NewParser(),
+		stdout:      os.Stdout,
+		fuel:        Uninit,
+		mem:         Uninit,
+		breakpoints: map[int]struct{}{},
+		watches:     map[VStr][]func(old, new Value){},
+	}
+	vm.defPredefs()
+	for _, opt := range opts {
+		opt(vm)
+	}
+	return vm
+}
+
+// Option is a configuration of a VM applied by NewVM,
+// which is equivalent to calling the corresponding setter right after the creation.
+type Option func(vm *VM)
+
+// WithStdout redirects the output of `print` to the given writer. See SetStdout.
+func WithStdout(w io.Writer) Option { return func(vm *VM) { vm.SetStdout(w) } }
+
+// WithFuel caps the total number of instructions executed by the VM. See SetFuel.
+func WithFuel(fuel int) Option { return func(vm *VM) { vm.SetFuel(fuel) } }
+
+// WithMemLimit caps the approximate number of bytes allocated at runtime by the VM. See SetMemLimit.
+func WithMemLimit(limit int) Option { return func(vm *VM) { vm.SetMemLimit(limit) } }
+
+// WithSandbox disables the natives accessing the host environment. See SetSandbox.
+func WithSandbox() Option { return func(vm *VM) { vm.SetSandbox(true) } }
+
+// WithExtendedFalsiness makes zero and the empty strings, lists and maps falsey. See SetExtendedFalsiness.
+func WithExtendedFalsiness() Option { return func(vm *VM) { vm.SetExtendedFalsiness(true) } }
+
+// WithIntMode makes integer literals evaluate to exact integers. See SetIntMode.
+func WithIntMode() Option { return func(vm *VM) { vm.SetIntMode(true) } }
+
+// WithImplicitReturn makes the final expression statement of a function body its return value.
+// See SetImplicitReturn.
+func WithImplicitReturn() Option { return func(vm *VM) { vm.SetImplicitReturn(true) } }
+
+// WithStrictNatives makes redefining a native function a compilation error. See SetStrictNatives.
+func WithStrictNatives() Option { return func(vm *VM) { vm.SetStrictNatives(true) } }
+
+// WithWarnShadow makes the compiler warn about locals shadowing other variables. See SetWarnShadow.
+func WithWarnShadow() Option { return func(vm *VM) { vm.SetWarnShadow(true) } }
+
+// WithMaxNesting caps how deeply expressions can be nested in the sources. See SetMaxNesting.
+func WithMaxNesting(max int) Option { return func(vm *VM) { vm.SetMaxNesting(max) } }
+
+// WithStats makes the VM collect the statistics of the execution. See SetStats.
+func WithStats() Option { return func(vm *VM) { vm.SetStats(true) } }
+
+// WithProfiling makes the VM count the executions of each opcode. See SetProfiling.
+func WithProfiling() Option { return func(vm *VM) { vm.SetProfiling(true) } }
+
+// defPredefs defines the predefined globals, including the native functions.
+func (vm *VM) defPredefs() {
+	natives := vm.natives()
+	names := make([]string, 0, len(natives))
+	for name, fun := range natives {
+		vm.globals[*NewVStr(name)] = NewVNativeFun(fun)
+		names = append(names, name)
+	}
+	vm.parser.SetNatives(names...)
+	vm.globals[*NewVStr("done")] = VDone{}
+	vm.globals[*NewVStr("globalThis")] = VGlobals{}
+}
+
+// readOnlyGlobals are the predefined globals which can be neither redefined nor assigned to,
+// since the VM relies on their values, e.g. an exhausted iterator returns `done`.
+var readOnlyGlobals = map[string]struct{}{"done": {}, "globalThis": {}}
+
+// Reset clears the execution state and all the globals defined by the user,
+// while keeping the configuration of the VM.
+func (vm *VM) Reset() {
+	vm.Recover()
+	vm.globals = map[VStr]Value{}
+	vm.parser.ResetGlobals()
+	if vm.stats != nil {
+		vm.stats = &Stats{}
+	}
+	vm.defPredefs()
+}
+
+// Stats is the statistics of the execution of a VM, for casual profiling.
+type Stats struct {
+	Insts     int // The number of instructions executed.
+	PeakStack int // The maximum height of the value stack.
+}
+
+// SetStats sets whether the VM should collect the statistics of the execution,
+// clearing the previous ones. It's off by default, costing only a nil check per instruction.
+func (vm *VM) SetStats(on bool) {
+	vm.stats = nil
+	if on {
+		vm.stats = &Stats{}
+	}
+}
+
+// Stats returns the statistics of the execution since they were enabled or the VM was last reset,
+// which are all zeros if they are not collected.
+func (vm *VM) Stats() Stats {
+	if vm.stats == nil {
+		return Stats{}
+	}
+	return *vm.stats
+}
+
+// SetProfiling sets whether the VM should count the executions of each opcode,
+// clearing the previous counts. It's off by default, costing only a nil check per instruction.
+func (vm *VM) SetProfiling(on bool) {
+	vm.profile = nil
+	if on {
+		vm.profile = make([]int, math.MaxUint8+1)
+	}
+}
+
+// ProfileDump returns the histogram of the opcodes executed since profiling was enabled,
+// one opcode per line, from the most frequent to the least.
+func (vm *VM) ProfileDump() string {
+	ops := []OpCode{}
+	for op, count := range vm.profile {
+		if count > 0 {
+			ops = append(ops, OpCode(op))
+		}
+	}
+	slices.SortStableFunc(ops, func(a, b OpCode) bool { return vm.profile[a] > vm.profile[b] })
+	var res strings.Builder
+	for _, op := range ops {
+		fmt.Fprintf(&res, "%-16s %d\n", op, vm.profile[op])
+	}
+	return res.String()
+}
+
+// SetIntMode sets whether integer literals should be evaluated as exact integers instead of floats.
+// In integer mode, arithmetic on integers stays exact, except for `/` which always gives a float.
+func (vm *VM) SetIntMode(on bool) { vm.parser.SetIntMode(on) }
+
+// SetImplicitReturn sets whether a function whose body ends with an expression statement
+// should return the value of that expression instead of nil. See Parser.SetImplicitReturn.
+func (vm *VM) SetImplicitReturn(on bool) { vm.parser.SetImplicitReturn(on) }
+
+// SetStrictNatives sets whether redefining a native function such as `clock` with a global declaration
+// is a compilation error, instead of a warning reported by Warnings. See Parser.SetStrictNatives.
+func (vm *VM) SetStrictNatives(on bool) { vm.parser.SetStrictNatives(on) }
+
+// SetWarnShadow sets whether a local variable shadowing a global or a local of an enclosing scope
+// is reported as a warning by Warnings. See Parser.SetWarnShadow.
+func (vm *VM) SetWarnShadow(on bool) { vm.parser.SetWarnShadow(on) }
+
+// Warnings returns the warnings reported by the compilation of the last source, or nil if there is none.
+func (vm *VM) Warnings() error { return vm.parser.Warnings() }
+
+// SetMaxNesting caps how deeply expressions can be nested in the sources, DefaultMaxNesting by default.
+// A zero or negative `max` means unlimited. See Parser.SetMaxNesting.
+func (vm *VM) SetMaxNesting(max int) { vm.parser.SetMaxNesting(max) }
+
+// SetFuel caps the total number of instructions executed by the VM from now on,
+// after which a runtime error is returned. A zero or negative `fuel` means unlimited.
+func (vm *VM) SetFuel(fuel int) {
+	if fuel <= 0 {
+		fuel = Uninit
+	}
+	vm.fuel = fuel
+}
+
+// SetMemLimit caps the approximate number of bytes allocated at runtime by the VM from now on
+// for strings and lists, after which a runtime error is returned.
+// A zero or negative `limit` means unlimited.
+// This is a soft cap: the allocated bytes are accumulated, and never given back when the values get freed.
+func (vm *VM) SetMemLimit(limit int) {
+	if limit <= 0 {
+		limit = Uninit
+	}
+	vm.mem = limit
+}
+
+// alloc accounts for a runtime allocation of `size` bytes,
+// failing if the memory limit would be exceeded.
+// A negative `size`, which can only come from an overflow, never fits in the limit.
+func (vm *VM) alloc(size int) error {
+	if vm.mem == Uninit {
+		return nil
+	}
+	if size < 0 || size > vm.mem {
+		return &LimitExceeded{vm.MkError("memory limit exceeded")}
+	}
+	vm.mem -= size
+	return nil
+}
+
+// SetSandbox sets whether the natives accessing the host environment, e.g. `getenv`, are disabled.
+// In sandbox mode, calling such a native returns a runtime error.
+func (vm *VM) SetSandbox(on bool) { vm.sandbox = on }
+
+// SetExtendedFalsiness sets whether zero, the empty string, the empty list and the empty map are falsey,
+// in addition to `false` and `nil` which are always falsey. See VTruthy and VTruthyExt.
+func (vm *VM) SetExtendedFalsiness(on bool) { vm.extFalsy = on }
+
+// truthy converts `v` to a boolean according to the active truthiness rule,
+// which is used by the conditions, `!`, `and`, `or` and `toBool`.
+func (vm *VM) truthy(v Value) VBool {
+	if vm.extFalsy {
+		return VTruthyExt(v)
+	}
+	return VTruthy(v)
+}
+
+// checkSandbox fails if the native `name` accesses the host environment while in sandbox mode.
+func (vm *VM) checkSandbox(name string) error {
+	if vm.sandbox {
+		return vm.MkErrorf("%s: access to the host environment is disabled", name)
+	}
+	return nil
+}
+
+// SetStdout redirects the output of `print` to the given writer.
+func (vm *VM) SetStdout(w io.Writer) { vm.stdout = w }
+
+// Capture is an output capture started by `captureStart`.
+type Capture struct {
+	prev io.Writer // The destination of `print` before the capture, to be restored on `captureEnd`.
+	buf  *strings.Builder
+}
+
+// startCapture redirects the output of `print` to a new buffer until endCapture is called.
+func (vm *VM) startCapture() {
+	capture := Capture{prev: vm.stdout, buf: &strings.Builder{}}
+	vm.captures = append(vm.captures, capture)
+	vm.stdout = capture.buf
+}
+
+// endCapture ends the latest output capture, returning the captured output.
+func (vm *VM) endCapture() (res string, ok bool) {
+	if len(vm.captures) == 0 {
+		return "", false
+	}
+	capture := vm.captures[len(vm.captures)-1]
+	vm.captures = vm.captures[:len(vm.captures)-1]
+	vm.stdout = capture.prev
+	return capture.buf.String(), true
+}
+
+// abandonCaptures ends all the pending output captures, discarding their output.
+// It is called at the end of each top-level run, so that an unmatched `captureStart` can't swallow the output for good.
+func (vm *VM) abandonCaptures() {
+	if len(vm.captures) > 0 {
+		vm.stdout = vm.captures[0].prev
+		vm.captures = nil
+	}
+}
+
+// println writes `str` followed by a newline to the output of `print`,
+// charging the memory limit for it if it goes to a capture buffer.
+func (vm *VM) println(str string) error {
+	if len(vm.captures) > 0 {
+		if err := vm.alloc(len(str) + 1); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(vm.stdout, str)
+	return nil
+}
+
+// SetBreakpoint makes the execution pause before running the given source line,
+// returning an *e.BreakpointHit error.
+// This only applies to InterpretNoRecover and Continue: after pausing, the execution can be resumed with Step or Continue.
+// The other entry points such as Interpret ignore the breakpoints.
+func (vm *VM) SetBreakpoint(line int) { vm.breakpoints[line] = struct{}{} }
+
+// ClearBreakpoint removes the breakpoint at the given source line.
+func (vm *VM) ClearBreakpoint(line int) { delete(vm.breakpoints, line) }
+
+// Watch registers `cb` to be called whenever the global variable `name` is defined or assigned.
+// `old` is nil if the global was previously undefined.
+func (vm *VM) Watch(name string, cb func(old, new Value)) {
+	key := *NewVStr(name)
+	vm.watches[key] = append(vm.watches[key], cb)
+}
+
+// GetGlobal returns the value of the global variable `name`, if it is defined.
+func (vm *VM) GetGlobal(name string) (val Value, ok bool) {
+	val, ok = vm.globals[*NewVStr(name)]
+	return
+}
+
+// SetGlobal defines or assigns the global variable `name`, notifying the watchers of `name`.
+// This allows the host to inject inputs before running a script.
+func (vm *VM) SetGlobal(name string, val Value) { vm.setGlobal(*NewVStr(name), val) }
+
+// Globals returns a snapshot of all the global variables, including the predefined ones.
+func (vm *VM) Globals() map[string]Value {
+	res := make(map[string]Value, len(vm.globals))
+	for name, val := range vm.globals {
+		res[name.Inner()] = val
+	}
+	return res
+}
+
+// globalName returns the name of the global variable indexed by `key` in `globalThis[key]`.
+func (vm *VM) globalName(key Value) (VStr, error) {
+	name, ok := key.(*VStr)
+	if !ok {
+		return VStr{}, vm.MkError("globalThis can only be indexed by strings")
+	}
+	return *name, nil
+}
+
+// setGlobal sets the global variable `name` to `val`, notifying the watchers of `name`.
+func (vm *VM) setGlobal(name VStr, val Value) {
+	old := vm.globals[name]
+	vm.globals[name] = val
+	for _, cb := range vm.watches[name] {
+		cb(old, val)
+	}
 }
 
 func (vm *VM) Recover() {
 	vm.stack = []Value{}
 	vm.frames = []CallFrame{}
+	vm.handlers = []Handler{}
+	// The open VUpvals refer to the discarded stack, so they must not be reused.
+	vm.openUpvals = nil
+	vm.lastDepth, vm.lastLine = 0, 0
+	vm.abandonCaptures()
 }
 
 func (vm *VM) frame() *CallFrame {
@@ -78,13 +416,40 @@ func (vm *VM) ip() *int {
 type CallFrame struct {
 	clos *VClos
 	ip   int
+	// instIP is the offset of the instruction being executed,
+	// as opposed to ip which might have already advanced past its operands.
+	instIP int
 	// base is the leftmost index of slots.
 	// Slots conceptually represent a top-justified slice view of the stack,
 	// in which `fun` and all of `fun`'s variables live.
 	// Thus, base is also the index at which `fun` is found in the stack.
 	base int
+	// args is the list of all the arguments passed if the function uses `arguments`, or nil otherwise.
+	args *VList
+}
+
+// Handler is an exception handler installed by a try block.
+type Handler struct {
+	frames  int  // The number of call frames when the handler was installed.
+	height  int  // The height of the stack when the handler was installed.
+	catchIP int  // The IP of the catch block in the frame that installed the handler.
+	finally bool // Whether the handler runs a finally block, which rethrows the original error afterwards.
 }
 
+// Thrown is the error of a value thrown with `throw` that has not been caught.
+type Thrown struct {
+	*e.RuntimeError
+	Val Value
+}
+
+func (t *Thrown) Unwrap() error { return t.RuntimeError }
+
+// LimitExceeded is the error of exceeding a limit set by the host, such as the fuel or the memory limit.
+// Unlike other runtime errors, it can't be caught by Lox code, which could otherwise keep running past the limit.
+type LimitExceeded struct{ *e.RuntimeError }
+
+func (l *LimitExceeded) Unwrap() error { return l.RuntimeError }
+
 func (vm *VM) peek(distance int) Value { return vm.stack[len(vm.stack)-1-distance] }
 
 func (vm *VM) push(val Value) (last *Value) {
@@ -120,312 +485,925 @@ func (vm *VM) REPL() error {
 			return err
 		}
 
-		val, err := vm.Interpret(line, true)
+		if strings.HasPrefix(line, ":") {
+			quit, err := vm.MetaCommand(line, os.Stdout)
+			if err != nil {
+				logrus.Errorln(err)
+			}
+			if quit {
+				return nil
+			}
+			continue
+		}
+
+		val, hasVal, err := vm.EvalLine(line)
+		if warnings := vm.Warnings(); warnings != nil {
+			logrus.Warnln(warnings)
+		}
 		if err != nil {
 			logrus.Errorln(err)
 			logrus.Errorln(vm.callTrace())
+			continue
+		}
+		if hasVal {
+			fmt.Printf("<< %s\n", val)
 		}
-		fmt.Printf("<< %s\n", val)
 	}
 }
 
-func (vm *VM) Interpret(src string, isREPL bool) (res Value, err error) {
-	defer func() {
-		if err != nil {
-			vm.Recover()
+// MetaCommand runs a REPL meta-command, i.e. a line starting with ':', writing its output to `out`.
+// It reports whether the REPL should quit.
+func (vm *VM) MetaCommand(line string, out io.Writer) (quit bool, err error) {
+	switch cmd := strings.TrimSpace(line); cmd {
+	case ":help":
+		fmt.Fprintln(out, heredoc.Doc(`
+			:help     show this message
+			:globals  list the defined globals
+			:reset    reset the VM, clearing all user-defined globals
+			:quit     quit the REPL
+		`))
+	case ":globals":
+		names := make([]string, 0, len(vm.globals))
+		for name := range vm.globals {
+			names = append(names, name.Inner())
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			fmt.Fprintf(out, "%s = %s\n", name, vm.globals[*NewVStr(name)])
 		}
-	}()
+	case ":reset":
+		vm.Reset()
+	case ":quit":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown meta-command '%s', try ':help'", cmd)
+	}
+	return false, nil
+}
 
-	parser := NewParser()
-	fun, err := parser.Compile(src, isREPL)
-	clos := NewVClos(fun)
+// EvalLine interprets a line of REPL input.
+// `hasVal` reports whether the line is an expression producing `val`,
+// as opposed to statements, which produce no value but still give nil as `val`.
+// The value of a successful evaluation is bound to the global `_` for later reuse.
+func (vm *VM) EvalLine(line string) (val Value, hasVal bool, err error) {
+	if val, err = vm.Interpret(line, true); err != nil {
+		return val, false, err
+	}
+	if hasVal = vm.parser.isExpr; hasVal {
+		vm.globals[*NewVStr("_")] = val
+	}
+	return val, hasVal, nil
+}
+
+// Interpret compiles and runs `src`, bringing the VM back to a clean state on error.
+// In REPL mode, `src` may be a single expression whose value is returned.
+// Otherwise, and for statements, the result is nil, which EvalLine tells apart from an expression evaluating to nil.
+func (vm *VM) Interpret(src string, isREPL bool) (res Value, err error) {
+	defer vm.recoverFrom(&res, &err)
+	if err = vm.Load(src, isREPL); err != nil {
+		return VNil{}, err
+	}
+	return vm.run()
+}
+
+// recoverFrom brings the VM back to a clean state if the execution ending with `*res` and `*err` has failed.
+// It must be deferred directly by the entry point.
+func (vm *VM) recoverFrom(res *Value, err *error) {
+	// Don't let an unexpected panic kill the whole session.
+	if r := recover(); r != nil {
+		*res, *err = VNil{}, vm.MkErrorf("internal error: %s", panicReason(r))
+	}
+	if *err != nil {
+		vm.Recover()
+	}
+}
+
+// Compile compiles the Lox script `src` into a top-level function without running it,
+// so that it can be run any number of times with RunFunction.
+func (vm *VM) Compile(src string) (*VFun, error) { return vm.parser.Compile(src, false) }
+
+// RunFunction runs `fun`, a top-level function previously returned by Compile, to completion.
+// Each run starts afresh with the current globals, which makes it cheap to run the same program on different inputs.
+func (vm *VM) RunFunction(fun *VFun) (res Value, err error) {
+	defer vm.recoverFrom(&res, &err)
+	if err = vm.load(fun); err != nil {
+		return VNil{}, err
+	}
+	return vm.run()
+}
+
+// RunFile reads the Lox script at `path` and interprets it as a whole.
+// The returned error, if any, is prefixed with `path`.
+func (vm *VM) RunFile(path string) error {
+	src, err := os.ReadFile(path)
 	if err != nil {
+		return err // The error already mentions the path.
+	}
+	if _, err := vm.Interpret(string(src), false); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// InterpretNoRecover is like Interpret, except that on error it leaves the stack and the call frames intact,
+// so that they can be inspected post mortem, e.g. with CallStack.
+// The caller must call Recover before reusing the VM after an error.
+// Unlike Interpret, it pauses at the breakpoints.
+func (vm *VM) InterpretNoRecover(src string, isREPL bool) (res Value, err error) {
+	if err = vm.Load(src, isREPL); err != nil {
 		return VNil{}, err
 	}
+	return vm.runBreakable()
+}
+
+// Load compiles `src` and sets up the call frame for the top-level code without running it,
+// so that it can be executed instruction by instruction with Step.
+func (vm *VM) Load(src string, isREPL bool) error {
+	fun, err := vm.parser.Compile(src, isREPL)
+	if err != nil {
+		return err
+	}
+	return vm.load(fun)
+}
+
+// load sets up the call frame for the top-level function `fun`.
+func (vm *VM) load(fun *VFun) error {
+	vm.program = fun
+	clos := NewVClos(fun)
 	// Push the current function to slack slot 0.
 	vm.push(clos)
 	// Set up the call frame for the top-level code.
-	if err = vm.call(clos, 0); err != nil {
-		return
+	return vm.call(clos, 0)
+}
+
+// Disassemble returns the disassembly of the last loaded program, which remains available after it has run,
+// followed by those of the functions defined in it, recursively.
+// It returns an empty string if no program has been loaded.
+func (vm *VM) Disassemble() string {
+	if vm.program == nil {
+		return ""
 	}
-	return vm.run()
+	var res strings.Builder
+	var disassemble func(fun *VFun, name string)
+	disassemble = func(fun *VFun, name string) {
+		res.WriteString(fun.chunk.Disassemble(name))
+		for _, const_ := range fun.chunk.consts {
+			if nested, ok := const_.(*VFun); ok {
+				disassemble(nested, nested.Name())
+			}
+		}
+	}
+	disassemble(vm.program, "<script>")
+	return res.String()
 }
 
-func (vm *VM) run() (Value, error) {
+// Step executes exactly one instruction of the loaded program,
+// reporting whether the program has run to completion.
+// Like InterpretNoRecover, the caller must call Recover before reusing the VM after an error.
+func (vm *VM) Step() (done bool, err error) {
 	if vm.chunk() == nil {
-		return nil, vm.MkError("chunk uninitialized")
+		return true, nil
+	}
+	_, done, err = vm.step(0)
+	return
+}
+
+// IP returns the offset of the next instruction to be executed in the current frame,
+// or Uninit if there is no such frame.
+func (vm *VM) IP() int {
+	if ip := vm.ip(); ip != nil {
+		return *ip
 	}
+	return Uninit
+}
 
-	readByte := func() (res byte) {
-		res = vm.chunk().code[*vm.ip()]
-		*vm.ip()++
-		return
+// CurrentFrame returns the position of the innermost call frame if there is one.
+func (vm *VM) CurrentFrame() (res FrameInfo, ok bool) {
+	if stack := vm.CallStack(); len(stack) != 0 {
+		return stack[0], true
 	}
+	return
+}
 
-	readShort := func() (res uint16) {
-		res = uint16(readByte()) << 8
-		res |= uint16(readByte())
-		return
+// Stack returns a snapshot of the value stack, from the bottom to the top.
+func (vm *VM) Stack() []Value { return slices.Clone(vm.stack) }
+
+// StackSnapshot is the same as Stack, for asserting the stack discipline of the VM in white-box tests,
+// e.g. when paused by the debugger in the middle of a program.
+func (vm *VM) StackSnapshot() []Value { return vm.Stack() }
+
+func (vm *VM) run() (Value, error) { return vm.runUntil(0) }
+
+// Continue resumes the execution of the loaded program after a pause,
+// running until completion or the next breakpoint.
+func (vm *VM) Continue() (Value, error) {
+	if vm.chunk() == nil {
+		return VNil{}, nil
 	}
+	// Step over the instruction we have paused at first.
+	if res, done, err := vm.step(0); err != nil || done {
+		return res, err
+	}
+	return vm.runBreakable()
+}
 
-	readConst := func() (res Value) {
-		res = vm.chunk().consts[readByte()]
-		if debug.DEBUG {
-			logrus.Debugf("          readConst %11s", res)
-		}
+// atBreakpoint checks if the next instruction enters a line with a breakpoint.
+func (vm *VM) atBreakpoint() (line int, ok bool) {
+	if len(vm.breakpoints) == 0 {
 		return
 	}
+	line = vm.chunk().lines[*vm.ip()]
+	if _, ok = vm.breakpoints[line]; !ok {
+		return
+	}
+	// Continuing on the same line is not entering it.
+	return line, line != vm.lastLine || len(vm.frames) != vm.lastDepth
+}
 
-	readStr := func() *VStr { return readConst().(*VStr) }
+// runBreakable is like run, except that it pauses at the breakpoints.
+func (vm *VM) runBreakable() (Value, error) {
+	if vm.chunk() == nil {
+		return nil, vm.MkError("chunk uninitialized")
+	}
+	for {
+		if line, ok := vm.atBreakpoint(); ok {
+			return VNil{}, &e.BreakpointHit{Line: line}
+		}
+		if res, done, err := vm.step(0); err != nil || done {
+			return res, err
+		}
+	}
+}
 
+// runUntil runs the VM until the call stack shrinks back to the given depth,
+// returning the result of the last returning function.
+// A depth of 0 means running the top-level function to completion.
+func (vm *VM) runUntil(depth int) (Value, error) {
+	if vm.chunk() == nil {
+		return nil, vm.MkError("chunk uninitialized")
+	}
 	for {
-		if debug.DEBUG {
-			logrus.Debugln(vm.stackTrace())
-		}
-		oldIP := *vm.ip()
-		if debug.DEBUG {
-			instDump, _ := vm.chunk().DisassembleInst(oldIP)
-			logrus.Debugln(instDump)
-		}
-		switch inst := OpCode(readByte()); inst {
-		case OpReturn:
-			res := vm.pop()
-			frame := vm.frames[len(vm.frames)-1]
-			// Close every remaining open upval owned by the returning function.
-			vm.closeUpvals(frame.base)
-			if vm.frames = vm.frames[:len(vm.frames)-1]; len(vm.frames) == 0 {
-				// Special case for the top-most function.
-				switch len := len(vm.stack); len {
-				case 1:
-					vm.pop() // Pop off the top-most function.
-					return res, nil
-				case 2:
-					res = vm.pop()
-					vm.pop() // Pop off the top-most function.
-					return res, nil
-				default:
-					return VNil{}, vm.MkErrorf("unexpected number of values in the stack: '%v'", vm.stack)
-				}
+		if res, done, err := vm.step(depth); err != nil || done {
+			return res, err
+		}
+	}
+}
+
+// step executes exactly one instruction like stepOnce,
+// but if it fails, the error is caught by the innermost exception handler installed above the given depth if there is one.
+func (vm *VM) step(depth int) (Value, bool, error) {
+	res, done, err := vm.stepOnce(depth)
+	if err != nil && vm.catch(err, depth) {
+		return VNil{}, false, nil
+	}
+	return res, done, err
+}
+
+// catch tries to catch `err` with the innermost exception handler installed above the given depth.
+// If it succeeds, the stack is unwound to where the handler was installed,
+// and the thrown value (or the reason of a runtime error) is pushed for the catch block.
+func (vm *VM) catch(err error, depth int) (ok bool) {
+	var val Value
+	var thrown *Thrown
+	var rtErr *e.RuntimeError
+	switch {
+	case errors.As(err, new(*e.BreakpointHit)), errors.As(err, new(*LimitExceeded)):
+		return false
+	case len(vm.handlers) != 0 && vm.handlers[len(vm.handlers)-1].finally:
+		val = &VErr{err}
+	case errors.As(err, &thrown):
+		val = thrown.Val
+	case errors.As(err, &rtErr):
+		val = NewVStr(rtErr.Reason)
+	default:
+		return false
+	}
+	if len(vm.handlers) == 0 {
+		return false
+	}
+	handler := vm.handlers[len(vm.handlers)-1]
+	if handler.frames <= depth {
+		return false // The handler is out of reach, e.g. when the error happens in a nested call made by the host.
+	}
+	vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	vm.frames = vm.frames[:handler.frames]
+	vm.closeUpvals(handler.height)
+	vm.stack = append(vm.stack[:handler.height], val)
+	*vm.ip() = handler.catchIP
+	return true
+}
+
+func (vm *VM) readByte() (res byte) {
+	res = vm.chunk().code[*vm.ip()]
+	*vm.ip()++
+	return
+}
+
+func (vm *VM) readShort() (res uint16) {
+	res = uint16(vm.readByte()) << 8
+	res |= uint16(vm.readByte())
+	return
+}
+
+func (vm *VM) readConst() (res Value) {
+	res = vm.chunk().consts[vm.readByte()]
+	if debug.DEBUG {
+		logrus.Debugf("          readConst %11s", res)
+	}
+	return
+}
+
+// readStr reads a string constant, which is guaranteed by the compiler.
+func (vm *VM) readStr() (res *VStr) {
+	res = vm.chunk().strs[vm.readByte()]
+	if debug.DEBUG {
+		logrus.Debugf("          readStr %13s", res)
+	}
+	return
+}
+
+// readFun reads a function constant, which is guaranteed by the compiler.
+func (vm *VM) readFun() (res *VFun) {
+	res = vm.chunk().funs[vm.readByte()]
+	if debug.DEBUG {
+		logrus.Debugf("          readFun %13s", res)
+	}
+	return
+}
+
+// stepOnce executes exactly one instruction.
+// It reports whether the call stack has shrunk back to the given depth,
+// in which case the result of the last returning function is also returned.
+func (vm *VM) stepOnce(depth int) (Value, bool, error) {
+	if debug.DEBUG {
+		logrus.Debugln(vm.stackTrace())
+	}
+	oldIP := *vm.ip()
+	vm.frame().instIP = oldIP
+	vm.lastDepth, vm.lastLine = len(vm.frames), vm.chunk().lines[oldIP]
+	if vm.fuel != Uninit {
+		if vm.fuel == 0 {
+			return VNil{}, false, &LimitExceeded{vm.MkError("instruction limit exceeded")}
+		}
+		vm.fuel--
+	}
+	if vm.stats != nil {
+		vm.stats.Insts++
+		if len(vm.stack) > vm.stats.PeakStack {
+			vm.stats.PeakStack = len(vm.stack)
+		}
+	}
+	if debug.DEBUG {
+		instDump, _ := vm.chunk().DisassembleInst(oldIP)
+		logrus.Debugln(instDump)
+	}
+	inst := OpCode(vm.readByte())
+	if vm.profile != nil {
+		vm.profile[inst]++
+	}
+	switch inst {
+	case OpReturn:
+		res := vm.pop()
+		frame := vm.frames[len(vm.frames)-1]
+		// Close every remaining open upval owned by the returning function.
+		vm.closeUpvals(frame.base)
+		vm.frames = vm.frames[:len(vm.frames)-1]
+		// Uninstall the exception handlers left by the returning function, e.g. when returning from a try block.
+		for len(vm.handlers) > 0 && vm.handlers[len(vm.handlers)-1].frames > len(vm.frames) {
+			vm.handlers = vm.handlers[:len(vm.handlers)-1]
+		}
+		if len(vm.frames) == 0 {
+			// Special case for the top-most function.
+			vm.abandonCaptures()
+			switch len := len(vm.stack); len {
+			case 1:
+				vm.pop() // Pop off the top-most function.
+				return res, true, nil
+			case 2:
+				res = vm.pop()
+				vm.pop() // Pop off the top-most function.
+				return res, true, nil
+			default:
+				return VNil{}, false, vm.MkErrorf("unexpected number of values in the stack: '%v'", vm.stack)
 			}
-			// Chop off the frame slots from the current stack,
-			// and put the return value back to the stack top.
-			vm.stack = append(vm.stack[:frame.base], res)
-		case OpConst:
-			vm.push(readConst())
-		case OpNil:
-			vm.push(VNil{})
-		case OpTrue:
-			vm.push(VBool(true))
-		case OpFalse:
-			vm.push(VBool(false))
-		case OpPop:
-			vm.pop()
-		case OpGetLocal:
-			slot := int(readByte())
-			vm.push(*vm.slotAt(slot))
-		case OpSetLocal:
-			slot := int(readByte())
-			*vm.slotAt(slot) = vm.peek(0)
-			// Don't pop, since the set operation has the RHS as its return value.
-		case OpGetGlobal:
-			name := *readStr()
-			val, ok := vm.globals[name]
-			if !ok {
-				return VNil{}, vm.MkErrorf("undefined variable '%s'", name.Inner())
+		}
+		// Chop off the frame slots from the current stack,
+		// and put the return value back to the stack top.
+		vm.stack = append(vm.stack[:frame.base], res)
+		if len(vm.frames) == depth {
+			// We've returned from a nested call made by the host, e.g. `callValue`.
+			return vm.pop(), true, nil
+		}
+	case OpConst:
+		vm.push(vm.readConst())
+	case OpConstImm:
+		vm.push(VNum(vm.readByte()))
+	case OpNil:
+		vm.push(VNil{})
+	case OpTrue:
+		vm.push(VBool(true))
+	case OpFalse:
+		vm.push(VBool(false))
+	case OpPop:
+		vm.pop()
+	case OpDup:
+		vm.push(vm.peek(0))
+	case OpDup2:
+		vm.stack = append(vm.stack, vm.peek(1), vm.peek(0))
+	case OpGetLocal:
+		slot := int(vm.readByte())
+		vm.push(*vm.slotAt(slot))
+	case OpSetLocal:
+		slot := int(vm.readByte())
+		*vm.slotAt(slot) = vm.peek(0)
+		// Don't pop, since the set operation has the RHS as its return value.
+	case OpGetGlobal:
+		name := *vm.readStr()
+		val, ok := vm.globals[name]
+		if !ok {
+			return VNil{}, false, vm.MkErrorf("undefined variable '%s'", name.Inner())
+		}
+		vm.push(val)
+	case OpDefGlobal:
+		name := *vm.readStr()
+		vm.setGlobal(name, vm.pop())
+	case OpSetGlobal:
+		name := *vm.readStr()
+		if _, ok := vm.globals[name]; !ok {
+			return VNil{}, false, vm.MkErrorf("undefined variable '%s'", name.Inner())
+		}
+		vm.setGlobal(name, vm.peek(0))
+		// Don't pop, since the set operation has the RHS as its return value.
+	case OpGetUpval:
+		slot := int(vm.readByte())
+		vm.push(*vm.upvalRef(vm.frame().clos.upvals[slot]))
+	case OpSetUpval:
+		slot := int(vm.readByte())
+		*vm.upvalRef(vm.frame().clos.upvals[slot]) = vm.peek(0)
+		// Don't pop, since the set operation has the RHS as its return value.
+	case OpArgs:
+		// The list is a copy of the arguments made by the call,
+		// so assigning to a parameter doesn't change it, and vice versa.
+		vm.push(vm.frame().args)
+	case OpGetProp:
+		if sb, ok := vm.peek(0).(*VStrBuilder); ok {
+			method, err := vm.builderMethod(sb, *vm.readStr())
+			if err != nil {
+				return VNil{}, false, err
 			}
-			vm.push(val)
-		case OpDefGlobal:
-			name := *readStr()
-			vm.globals[name] = vm.pop()
-		case OpSetGlobal:
-			name := *readStr()
-			if _, ok := vm.globals[name]; !ok {
-				return VNil{}, vm.MkErrorf("undefined variable '%s'", name.Inner())
+			vm.stack[len(vm.stack)-1] = method // Replace the builder with the bound method.
+			break
+		}
+		this, ok := vm.peek(0).(*VInstance)
+		if !ok {
+			return VNil{}, false, vm.MkError("only instances have properties")
+		}
+		res, err := vm.getProp(this, *vm.readStr())
+		if err != nil {
+			return VNil{}, false, err
+		}
+		vm.stack[len(vm.stack)-1] = res // Replace the instance with the result.
+	case OpSetProp:
+		this, ok := vm.peek(1).(*VInstance)
+		if !ok {
+			return VNil{}, false, vm.MkError("only instances have fields")
+		}
+		name := *vm.readStr()
+		this.SetField(name, vm.peek(0)) // The RHS.
+		// Pop off the instance, keep the RHS as its return value.
+		vm.stack = slices.Delete(vm.stack, len(vm.stack)-2, len(vm.stack)-1)
+	case OpGetSuper:
+		name := *vm.readStr()
+		super := vm.pop().(*VClass)
+		bound, err := vm.bindMethod(super, name)
+		if err != nil {
+			return VNil{}, false, err
+		}
+		vm.stack[len(vm.stack)-1] = bound // Replace the instance with the result.
+	case OpList:
+		if err := vm.collectList(int(vm.readByte())); err != nil {
+			return VNil{}, false, err
+		}
+	case OpListSpread:
+		if err := vm.collectList(vm.expandSpreads(int(vm.readByte()))); err != nil {
+			return VNil{}, false, err
+		}
+	case OpSpread:
+		list, ok := vm.peek(0).(*VList)
+		if !ok {
+			return VNil{}, false, vm.MkError("only lists can be spread")
+		}
+		vm.stack[len(vm.stack)-1] = &VSpread{elems: list.elems}
+	case OpGetIndex:
+		if list, ok := vm.peek(1).(*VList); ok {
+			idx, err := vm.listIndex(list, vm.pop())
+			if err != nil {
+				return VNil{}, false, err
 			}
-			vm.globals[name] = vm.peek(0)
-			// Don't pop, since the set operation has the RHS as its return value.
-		case OpGetUpval:
-			slot := int(readByte())
-			vm.push(*vm.frame().clos.upvals[slot].val)
-		case OpSetUpval:
-			slot := int(readByte())
-			upval := vm.frame().clos.upvals[slot]
-			upval.val = utils.Box(vm.peek(0))
-			upval.idx = utils.Box(len(vm.stack) - 1)
-			// Don't pop, since the set operation has the RHS as its return value.
-		case OpGetProp:
-			this, ok := vm.peek(0).(*VInstance)
-			if !ok {
-				return VNil{}, vm.MkError("only instances have properties")
+			vm.stack[len(vm.stack)-1] = list.elems[idx] // Replace the list with the element.
+			break
+		}
+		if map_, ok := vm.peek(1).(*VMap); ok {
+			// A missing key gives nil.
+			res, _ := map_.Get(vm.pop())
+			vm.stack[len(vm.stack)-1] = res // Replace the map with the value.
+			break
+		}
+		if _, ok := vm.peek(1).(VGlobals); ok {
+			name, err := vm.globalName(vm.pop())
+			if err != nil {
+				return VNil{}, false, err
 			}
-			name := *readStr()
-			res, ok := this.fields[name]
+			res, ok := vm.globals[name]
 			if !ok {
-				// Fall back to method resolution.
-				bound, err := vm.bindMethod(this.VClass, name)
-				if err != nil {
-					return VNil{}, err
-				}
-				res = bound
+				return VNil{}, false, vm.MkErrorf("undefined variable '%s'", name.Inner())
 			}
-			vm.stack[len(vm.stack)-1] = res // Replace the instance with the result.
-		case OpSetProp:
-			this, ok := vm.peek(1).(*VInstance)
+			vm.stack[len(vm.stack)-1] = res // Replace the view with the value.
+			break
+		}
+		this, ok := vm.peek(1).(*VInstance)
+		if !ok {
+			return VNil{}, false, vm.MkError("only lists, maps and instances with an '__index__' method can be indexed")
+		}
+		magic := *NewVStr("__index__")
+		// Without the overload, `this[name]` gets the property whose name is the string `name`, just like `this.name`.
+		if this.methods[magic] == nil {
+			name, ok := vm.peek(0).(*VStr)
 			if !ok {
-				return VNil{}, vm.MkError("only instances have fields")
+				return VNil{}, false, vm.MkError("instances without an '__index__' method can only be indexed by strings")
 			}
-			name := *readStr()
-			this.fields[name] = vm.peek(0) // The RHS.
-			// Pop off the instance, keep the RHS as its return value.
-			vm.stack = slices.Delete(vm.stack, len(vm.stack)-2, len(vm.stack)-1)
-		case OpGetSuper:
-			name := *readStr()
-			super := vm.pop().(*VClass)
-			bound, err := vm.bindMethod(super, name)
+			vm.pop()
+			res, err := vm.getProp(this, *name)
 			if err != nil {
-				return VNil{}, err
+				return VNil{}, false, err
 			}
-			vm.stack[len(vm.stack)-1] = bound // Replace the instance with the result.
-		case OpEqual:
-			rhs := vm.pop()
-			vm.push(VEq(vm.pop(), rhs))
-		case OpGreater:
-			rhs := vm.pop()
-			res, ok := VGreater(vm.pop(), rhs)
-			if !ok {
-				return VNil{}, vm.MkError("operands must be numbers")
+			vm.stack[len(vm.stack)-1] = res // Replace the instance with the result.
+			break
+		}
+		// Overload: `this[key]` is `this.__index__(key)`.
+		if err := vm.invokeFromClass(this.VClass, magic, 1); err != nil {
+			return VNil{}, false, err
+		}
+	case OpSetIndex:
+		if list, ok := vm.peek(2).(*VList); ok {
+			if list.frozen {
+				return VNil{}, false, vm.MkError("can't modify a frozen list")
 			}
-			vm.push(res)
-		case OpLess:
-			rhs := vm.pop()
-			res, ok := VLess(vm.pop(), rhs)
-			if !ok {
-				return VNil{}, vm.MkError("operands must be numbers")
+			idx, err := vm.listIndex(list, vm.peek(1))
+			if err != nil {
+				return VNil{}, false, err
 			}
-			vm.push(res)
-		case OpNot:
-			vm.push(!VTruthy(vm.pop()))
-		case OpNeg:
-			res, ok := VNeg(vm.pop())
-			if !ok {
-				return VNil{}, vm.MkError("operand must be a number")
+			list.elems[idx] = vm.peek(0)
+			// Pop off the list and the key, keep the RHS as its return value.
+			vm.stack = slices.Delete(vm.stack, len(vm.stack)-3, len(vm.stack)-1)
+			break
+		}
+		if map_, ok := vm.peek(2).(*VMap); ok {
+			if map_.frozen {
+				return VNil{}, false, vm.MkError("can't modify a frozen map")
 			}
-			vm.push(res)
-		case OpAdd:
-			rhs := vm.pop()
-			res, ok := VAdd(vm.pop(), rhs)
-			if !ok {
-				return VNil{}, vm.MkError("operands must be all numbers or all strings")
+			if isNew := map_.Set(vm.peek(1), vm.peek(0)); isNew {
+				if err := vm.alloc(sizeOfEntry); err != nil {
+					return VNil{}, false, err
+				}
 			}
-			vm.push(res)
-		case OpSub:
-			rhs := vm.pop()
-			res, ok := VSub(vm.pop(), rhs)
-			if !ok {
-				return VNil{}, vm.MkError("operands must be numbers")
+			// Pop off the map and the key, keep the RHS as its return value.
+			vm.stack = slices.Delete(vm.stack, len(vm.stack)-3, len(vm.stack)-1)
+			break
+		}
+		if _, ok := vm.peek(2).(VGlobals); ok {
+			// Unlike assigning to a global variable, this defines the global if it's undefined.
+			name, err := vm.globalName(vm.peek(1))
+			if err != nil {
+				return VNil{}, false, err
 			}
-			vm.push(res)
-		case OpMul:
-			rhs := vm.pop()
-			res, ok := VMul(vm.pop(), rhs)
-			if !ok {
-				return VNil{}, vm.MkError("operands must be numbers")
+			if _, ok := readOnlyGlobals[name.Inner()]; ok {
+				return VNil{}, false, vm.MkErrorf("can't assign to `%s`", name.Inner())
 			}
-			vm.push(res)
-		case OpDiv:
-			rhs := vm.pop()
-			res, ok := VDiv(vm.pop(), rhs)
+			vm.setGlobal(name, vm.peek(0))
+			// Pop off the view and the key, keep the RHS as its return value.
+			vm.stack = slices.Delete(vm.stack, len(vm.stack)-3, len(vm.stack)-1)
+			break
+		}
+		this, ok := vm.peek(2).(*VInstance)
+		if !ok {
+			return VNil{}, false, vm.MkError("only lists, maps and instances with a '__setindex__' method can be indexed")
+		}
+		val, key := vm.pop(), vm.pop()
+		vm.pop() // Pop off the instance.
+		magic := *NewVStr("__setindex__")
+		// Without the overload, `this[name] = val` sets the field whose name is the string `name`, just like `this.name = val`.
+		if this.methods[magic] == nil {
+			name, ok := key.(*VStr)
 			if !ok {
-				return VNil{}, vm.MkError("operands must be numbers")
+				return VNil{}, false, vm.MkError("instances without a '__setindex__' method can only be indexed by strings")
 			}
-			vm.push(res)
-		case OpPrint:
-			fmt.Printf("%s\n", vm.pop())
-		case OpJump:
-			offset := readShort()
-			*vm.ip() += int(offset)
-		case OpJumpUnless:
-			offset := readShort()
-			if !VTruthy(vm.peek(0)) {
-				*vm.ip() += int(offset)
-			}
-		case OpLoop:
-			offset := readShort()
-			*vm.ip() -= int(offset)
-		case OpCall:
-			argCount := int(readByte())
-			callee := vm.peek(argCount)
-			if err := vm.call(callee, argCount); err != nil {
-				return VNil{}, err
-			}
-		case OpInvoke:
-			name := *readStr()
-			argCount := int(readByte())
-			this, ok := vm.peek(argCount).(*VInstance)
-			if !ok {
-				return VNil{}, vm.MkError("only instances have methods")
+			this.SetField(*name, val)
+			vm.push(val)
+			break
+		}
+		// Overload: `this[key] = val` is `this.__setindex__(key, val)`,
+		// but the assignment expression always evaluates to `val`.
+		if _, err := vm.invokeMethod(this, magic, key, val); err != nil {
+			return VNil{}, false, err
+		}
+		vm.push(val)
+	case OpEqual:
+		if err := vm.equal(); err != nil {
+			return VNil{}, false, err
+		}
+	case OpIsNil, OpIsTrue, OpIsFalse:
+		var lit Value = VNil{}
+		switch inst {
+		case OpIsTrue:
+			lit = VBool(true)
+		case OpIsFalse:
+			lit = VBool(false)
+		}
+		if _, ok := vm.peek(0).(*VInstance); ok && inst != OpIsNil {
+			// Fall back to the general case, which might be overloaded by `__eq__`.
+			vm.push(lit)
+			if err := vm.binaryOp("__eq__", eqOp, ""); err != nil {
+				return VNil{}, false, err
 			}
-			// What if `method` in `this.method()` is not a method but a regular closure?
-			if field, ok := this.fields[name]; ok {
-				base := len(vm.stack) - argCount - 1
-				vm.stack[base] = field
-				if err := vm.call(field, argCount); err != nil {
-					return VNil{}, err
-				}
-				break
+			break
+		}
+		vm.stack[len(vm.stack)-1] = VEq(vm.peek(0), lit)
+	case OpGreater:
+		if err := vm.compare("__gt__", VGreater); err != nil {
+			return VNil{}, false, err
+		}
+	case OpLess:
+		if err := vm.compare("__lt__", VLess); err != nil {
+			return VNil{}, false, err
+		}
+	case OpIn:
+		container, x := vm.pop(), vm.pop()
+		res, err := vm.contains(container, x)
+		if err != nil {
+			return VNil{}, false, err
+		}
+		vm.push(VBool(res))
+	case OpNot:
+		vm.push(!vm.truthy(vm.pop()))
+	case OpNeg:
+		res, ok := VNeg(vm.pop())
+		if !ok {
+			return VNil{}, false, vm.MkError("operand must be a number")
+		}
+		vm.push(res)
+	case OpAdd:
+		if err := vm.add(); err != nil {
+			return VNil{}, false, err
+		}
+	case OpAddConst:
+		local, n := *vm.slotAt(int(vm.readByte())), VNum(vm.readByte())
+		if local, ok := local.(VNum); ok {
+			vm.push(local + n)
+			break
+		}
+		// Fall back to the general case, e.g. for VInts or an overloaded `__add__`.
+		vm.push(local)
+		vm.push(n)
+		if err := vm.add(); err != nil {
+			return VNil{}, false, err
+		}
+	case OpConcat:
+		if err := vm.concat(vm.readByte() != 0); err != nil {
+			return VNil{}, false, err
+		}
+	case OpSub:
+		if err := vm.binaryOp("__sub__", VSub, "operands must be numbers"); err != nil {
+			return VNil{}, false, err
+		}
+	case OpMul:
+		if err := vm.binaryOp("__mul__", VMul, "operands must be numbers"); err != nil {
+			return VNil{}, false, err
+		}
+	case OpDiv:
+		if err := vm.binaryOp("__div__", VDiv, "operands must be numbers"); err != nil {
+			return VNil{}, false, err
+		}
+	case OpPrint:
+		str, err := vm.display(vm.pop())
+		if err != nil {
+			return VNil{}, false, err
+		}
+		if err := vm.println(str); err != nil {
+			return VNil{}, false, err
+		}
+	case OpPrintN:
+		n := int(vm.readByte())
+		vals := slices.Clone(vm.stack[len(vm.stack)-n:])
+		vm.stack = vm.stack[:len(vm.stack)-n]
+		strs := make([]string, n)
+		for i, val := range vals {
+			str, err := vm.display(val)
+			if err != nil {
+				return VNil{}, false, err
 			}
-			if err := vm.invokeFromClass(this.VClass, name, argCount); err != nil {
-				return VNil{}, err
+			strs[i] = str
+		}
+		if err := vm.println(strings.Join(strs, " ")); err != nil {
+			return VNil{}, false, err
+		}
+	case OpJump:
+		offset := vm.readShort()
+		*vm.ip() += int(offset)
+	case OpJumpUnless:
+		offset := vm.readShort()
+		if !vm.truthy(vm.peek(0)) {
+			*vm.ip() += int(offset)
+		}
+	case OpLoop:
+		offset := vm.readShort()
+		*vm.ip() -= int(offset)
+	case OpIter:
+		if list, ok := vm.peek(0).(*VList); ok {
+			vm.stack[len(vm.stack)-1] = &VListIter{VList: list}
+			break
+		}
+		this, ok := vm.peek(0).(*VInstance)
+		if !ok {
+			return VNil{}, false, vm.MkError("only lists and instances with an '__iter__' method can be iterated")
+		}
+		iter, err := vm.invokeMethod(this, *NewVStr("__iter__"))
+		if err != nil {
+			return VNil{}, false, err
+		}
+		vm.stack[len(vm.stack)-1] = iter // Replace the iterable with the iterator.
+	case OpNext:
+		offset := vm.readShort()
+		var next Value
+		switch iter := vm.peek(0).(type) {
+		case *VListIter:
+			next = iter.next()
+		case *VInstance:
+			var err error
+			if next, err = vm.invokeMethod(iter, *NewVStr("__next__")); err != nil {
+				return VNil{}, false, err
 			}
-		case OpSuperInvoke:
-			method := *readStr()
-			argCount := int(readByte())
-			super := vm.pop().(*VClass)
-			if err := vm.invokeFromClass(super, method, argCount); err != nil {
-				return VNil{}, err
+		default:
+			return VNil{}, false, vm.MkError("only instances with a '__next__' method can be iterators")
+		}
+		if next == (VDone{}) {
+			vm.pop()
+			*vm.ip() += int(offset)
+			break
+		}
+		vm.stack[len(vm.stack)-1] = next // Replace the iterator with the next value.
+	case OpTry, OpTryFinally:
+		offset := vm.readShort()
+		vm.handlers = append(vm.handlers, Handler{
+			frames:  len(vm.frames),
+			height:  len(vm.stack),
+			catchIP: *vm.ip() + int(offset),
+			finally: inst == OpTryFinally,
+		})
+	case OpEndTry:
+		vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	case OpThrow:
+		val := vm.pop()
+		if val, ok := val.(*VErr); ok {
+			return VNil{}, false, val.err // Rethrow the original error after a finally block.
+		}
+		str, err := vm.display(val)
+		if err != nil {
+			return VNil{}, false, err
+		}
+		return VNil{}, false, &Thrown{RuntimeError: vm.MkErrorf("uncaught exception: %s", str), Val: val}
+	case OpGetCleanup:
+		this, ok := vm.peek(0).(*VInstance)
+		if !ok {
+			return VNil{}, false, vm.MkError("only instances can be resources of 'with'")
+		}
+		name := *NewVStr("__exit__")
+		if _, ok := this.methods[name]; !ok {
+			name = *NewVStr("close")
+		}
+		if _, ok := this.methods[name]; !ok {
+			return VNil{}, false, vm.MkError("a resource of 'with' must have a 'close' or '__exit__' method")
+		}
+		bound, err := vm.bindMethod(this.VClass, name)
+		if err != nil {
+			return VNil{}, false, err
+		}
+		vm.stack[len(vm.stack)-1] = bound // Replace the resource with the cleanup.
+	case OpCall:
+		argCount := int(vm.readByte())
+		callee := vm.peek(argCount)
+		if err := vm.call(callee, argCount); err != nil {
+			return VNil{}, false, err
+		}
+	case OpCallNamed:
+		names := vm.readConst().(*VList).elems
+		argCount, err := vm.arrangeNamedArgs(int(vm.readByte()), names)
+		if err != nil {
+			return VNil{}, false, err
+		}
+		if err := vm.call(vm.peek(argCount), argCount); err != nil {
+			return VNil{}, false, err
+		}
+	case OpCallSpread:
+		argCount := vm.expandSpreads(int(vm.readByte()))
+		callee := vm.peek(argCount)
+		if err := vm.call(callee, argCount); err != nil {
+			return VNil{}, false, err
+		}
+	case OpInvoke:
+		name := *vm.readStr()
+		argCount := int(vm.readByte())
+		if sb, ok := vm.peek(argCount).(*VStrBuilder); ok {
+			method, err := vm.builderMethod(sb, name)
+			if err != nil {
+				return VNil{}, false, err
 			}
-		case OpClos:
-			fun := readConst().(*VFun)
-			clos := NewVClos(fun)
-			upvals := clos.upvals
-			vm.push(clos)
-			for i := range upvals { // ! Here we use the index only.
-				isLocal := utils.IntToBool(readByte())
-				idx := int(readByte())
-				if isLocal {
-					upvals[i] = vm.captureUpval(vm.slotIdxAt(idx))
-				} else {
-					upvals[i] = vm.frame().clos.upvals[idx]
-				}
+			vm.stack[len(vm.stack)-argCount-1] = method
+			if err := vm.call(method, argCount); err != nil {
+				return VNil{}, false, err
 			}
-		case OpCloseUpval:
-			vm.closeUpvals(len(vm.stack) - 1) // Hoist the upval.
-			vm.pop()                          // Pop the hoisted upval off the stack.
-		case OpClass:
-			vm.push(NewVClass(readStr()))
-		case OpInherit:
-			super, ok := vm.peek(1).(*VClass)
-			if !ok {
-				return VNil{}, vm.MkError("superclass must be a class")
+			break
+		}
+		this, ok := vm.peek(argCount).(*VInstance)
+		if !ok {
+			return VNil{}, false, vm.MkError("only instances have methods")
+		}
+		// What if `method` in `this.method()` is not a method but a regular closure?
+		if field, ok := this.Field(name); ok {
+			base := len(vm.stack) - argCount - 1
+			vm.stack[base] = field
+			if err := vm.call(field, argCount); err != nil {
+				return VNil{}, false, err
 			}
-			class := vm.peek(0).(*VClass)
-			// Optimization: Copy-down inheritance.
-			// When `class` inherits from `super`, all `super`'s methods are copied over to `class`.
-			// This is doable since Lox has "closed" classes, i.e. once a class declaration is finished executing, the set of methods for that class can never change.
-			maps.Copy(class.methods, super.methods)
-			vm.pop() // Pop the subclass.
-		case OpMethod:
-			name := *readStr()
-			method := vm.pop()
-			class := vm.peek(0).(*VClass)
-			class.methods[name] = method
-		default:
-			return VNil{}, &e.RuntimeError{
-				Line:   vm.chunk().lines[oldIP],
-				Reason: fmt.Sprintf("unknown instruction '%d'", inst),
+			break
+		}
+		if err := vm.invokeFromClass(this.VClass, name, argCount); err != nil {
+			return VNil{}, false, err
+		}
+	case OpSuperInvoke:
+		method := *vm.readStr()
+		argCount := int(vm.readByte())
+		super := vm.pop().(*VClass)
+		if err := vm.invokeFromClass(super, method, argCount); err != nil {
+			return VNil{}, false, err
+		}
+	case OpClos:
+		clos := NewVClos(vm.readFun())
+		upvals := clos.upvals
+		vm.push(clos)
+		for i := range upvals { // ! Here we use the index only.
+			kind, idx := UpvalKind(vm.readByte()), int(vm.readByte())
+			switch kind {
+			case UpvalFromLocal:
+				upvals[i] = vm.captureUpval(vm.slotIdxAt(idx))
+			case UpvalByValue:
+				// The VUpval is closed from the beginning.
+				upvals[i] = &VUpval{val: utils.Box(vm.stack[vm.slotIdxAt(idx)])}
+			default:
+				upvals[i] = vm.frame().clos.upvals[idx]
 			}
 		}
+	case OpCloseUpval:
+		vm.closeUpvals(len(vm.stack) - 1) // Hoist the upval.
+		vm.pop()                          // Pop the hoisted upval off the stack.
+	case OpClass:
+		vm.push(NewVClass(vm.readStr()))
+	case OpInherit:
+		super, ok := vm.peek(1).(*VClass)
+		if !ok {
+			return VNil{}, false, vm.MkError("superclass must be a class")
+		}
+		class := vm.peek(0).(*VClass)
+		// Optimization: Copy-down inheritance.
+		// When `class` inherits from `super`, all `super`'s methods are copied over to `class`.
+		// This is doable since Lox has "closed" classes, i.e. once a class declaration is finished executing, the set of methods for that class can never change.
+		maps.Copy(class.methods, super.methods)
+		// The same goes for the fields, which are usually set by `super.init()`.
+		maps.Copy(class.fieldIdxs, super.fieldIdxs)
+		vm.pop() // Pop the subclass.
+	case OpMethod:
+		name := *vm.readStr()
+		method := vm.pop()
+		class := vm.peek(0).(*VClass)
+		class.methods[name] = method
+	case OpDecorate:
+		n := int(vm.readByte())
+		method := vm.pop().(*VClos)
+		decorators := slices.Clone(vm.stack[len(vm.stack)-n:])
+		vm.stack = append(vm.stack[:len(vm.stack)-n], NewVDecorated(method, decorators))
+	case OpField:
+		name := *vm.readStr()
+		class := vm.peek(0).(*VClass)
+		if _, ok := class.fieldIdxs[name]; !ok {
+			class.fieldIdxs[name] = len(class.fieldIdxs)
+		}
+	default:
+		return VNil{}, false, &e.RuntimeError{
+			Line:   vm.chunk().lines[oldIP],
+			Reason: fmt.Sprintf("unknown instruction '%d'", inst),
+		}
 	}
+	return VNil{}, false, nil
 }
 
 func (vm *VM) call(callee Value, argCount int) error {
@@ -450,8 +1428,19 @@ func (vm *VM) call(callee Value, argCount int) error {
 		return vm.callClos(callee.VClos, argCount)
 	case *VClos:
 		return vm.callClos(callee, argCount)
+	case *VAbstract:
+		return vm.MkErrorf("abstract method '%s' is not implemented", callee.name.Inner())
+	case *VPartial:
+		// Report the mismatch in terms of the partial application rather than the callee.
+		if arity, ok := callee.arity(); ok && argCount != arity {
+			return vm.MkErrorf("expected %d arguments but got %d", arity, argCount)
+		}
+		// Replace the partial application with its callee, and insert the leading arguments after it.
+		vm.stack[base] = callee.callee
+		vm.stack = slices.Insert(vm.stack, base+1, callee.args...)
+		return vm.call(callee.callee, argCount+len(callee.args))
 	case *VNativeFun:
-		res, err := (*callee)(vm.stack[base:]...)
+		res, err := (*callee)(vm.stack[base+1:]...)
 		if err != nil {
 			return err
 		}
@@ -465,12 +1454,24 @@ func (vm *VM) call(callee Value, argCount int) error {
 
 func (vm *VM) callClos(clos *VClos, argCount int) error {
 	base := len(vm.stack) - argCount - 1
-	if argCount != clos.arity {
+	var args *VList
+	switch {
+	case clos.usesArgs && argCount < clos.arity:
+		return vm.MkErrorf("expected at least %d arguments but got %d",
+			clos.arity, argCount)
+	case clos.usesArgs:
+		// Keep a copy of all the arguments, and drop the extra ones from the slots.
+		if err := vm.alloc(sizeOfList(argCount)); err != nil {
+			return err
+		}
+		args = NewVList(slices.Clone(vm.stack[base+1:])...)
+		vm.stack = vm.stack[:base+1+clos.arity]
+	case argCount != clos.arity:
 		return vm.MkErrorf("expected %d arguments but got %d",
 			clos.arity, argCount)
 	}
 	// * NOTE: We could also add a stack overflow check here.
-	vm.frames = append(vm.frames, CallFrame{clos: clos, base: base})
+	vm.frames = append(vm.frames, CallFrame{clos: clos, base: base, args: args})
 	return nil
 }
 
@@ -481,9 +1482,321 @@ func (vm *VM) invokeFromClass(class *VClass, methodName VStr, argCount int) erro
 	if !ok {
 		return vm.MkErrorf("undefined property '%s'", methodName.Inner())
 	}
+	if decorated, ok := method.(*VDecorated); ok {
+		bound, err := vm.bindDecorated(vm.peek(argCount), decorated)
+		if err != nil {
+			return err
+		}
+		// Call the decorated method in place of `this`, just like OpGetProp + OpCall would do.
+		vm.stack[len(vm.stack)-argCount-1], method = bound, bound
+	}
 	return vm.call(method, argCount)
 }
 
+// concat is like add in a chain of `+`, except that the strings are appended to a VConcat,
+// which is converted back to a string if this is the `last` `+` of the chain.
+// ( lhs rhs -- lhsAddRhs )
+func (vm *VM) concat(last bool) error {
+	lhsSlot := len(vm.stack) - 2
+	if rhs, ok := vm.peek(0).(*VStr); ok {
+		var buf *VConcat
+		switch lhs := vm.stack[lhsSlot].(type) {
+		case *VConcat:
+			buf = lhs
+		case *VStr:
+			if err := vm.alloc(sizeOfValue + len(lhs.Inner())); err != nil {
+				return err
+			}
+			buf = &VConcat{}
+			buf.buf.WriteString(lhs.Inner())
+		}
+		if buf != nil {
+			if err := vm.alloc(len(rhs.Inner())); err != nil {
+				return err
+			}
+			buf.buf.WriteString(rhs.Inner())
+			vm.pop()
+			vm.stack[lhsSlot] = buf
+			if last {
+				vm.stack[lhsSlot] = NewVStr(buf.buf.String())
+			}
+			return nil
+		}
+	}
+	// Otherwise, the operands are added as usual, e.g. with an overloaded `__add__`.
+	if buf, ok := vm.stack[lhsSlot].(*VConcat); ok {
+		vm.stack[lhsSlot] = NewVStr(buf.buf.String())
+	}
+	return vm.add()
+}
+
+// add adds the 2 values at the stack top.
+// ( lhs rhs -- res )
+func (vm *VM) add() error {
+	if err := vm.binaryOp("__add__", VAdd, "operands must be all numbers or all strings"); err != nil {
+		return err
+	}
+	if str, ok := vm.peek(0).(*VStr); ok {
+		return vm.alloc(sizeOfStr(str))
+	}
+	return nil
+}
+
+func eqOp(v, w Value) (Value, bool) { return VEq(v, w), true }
+
+// equal is like binaryOp for `==`, except that comparing with `nil` is never overloaded,
+// so that `inst == nil` always tells whether `inst` is nil.
+// ( lhs rhs -- res )
+func (vm *VM) equal() error {
+	if _, ok := vm.peek(0).(VNil); ok {
+		rhs := vm.pop()
+		vm.push(VEq(vm.pop(), rhs))
+		return nil
+	}
+	return vm.binaryOp("__eq__", eqOp, "")
+}
+
+// binaryOp applies `op` to the 2 values at the stack top,
+// unless the LHS is an instance whose class overloads the operator with the `magic` method,
+// in which case `lhs.magic(rhs)` is invoked instead.
+// ( lhs rhs -- res )
+func (vm *VM) binaryOp(magic string, op func(v, w Value) (Value, bool), reason string) error {
+	if ok, err := vm.overload(magic); ok {
+		return err
+	}
+	rhs := vm.pop()
+	res, ok := op(vm.pop(), rhs)
+	if !ok {
+		return vm.MkError(reason)
+	}
+	vm.push(res)
+	return nil
+}
+
+// compare is like binaryOp for the ordering `op`,
+// except that the error names the kinds of the operands, e.g. "cannot compare nil and number".
+// ( lhs rhs -- res )
+func (vm *VM) compare(magic string, op func(v, w Value) (Value, bool)) error {
+	if ok, err := vm.overload(magic); ok {
+		return err
+	}
+	rhs := vm.pop()
+	lhs := vm.pop()
+	res, ok := op(lhs, rhs)
+	if !ok {
+		return vm.MkErrorf("cannot compare %s and %s", Kind(lhs), Kind(rhs))
+	}
+	vm.push(res)
+	return nil
+}
+
+// overload invokes `lhs.magic(rhs)` if the LHS is an instance whose class has the `magic` method,
+// reporting whether it did so.
+// ( lhs rhs -- res ) or ( lhs rhs -- lhs rhs )
+func (vm *VM) overload(magic string) (ok bool, err error) {
+	this, ok := vm.peek(1).(*VInstance)
+	if !ok {
+		return false, nil
+	}
+	name := *NewVStr(magic)
+	if _, ok := this.methods[name]; !ok {
+		return false, nil
+	}
+	return true, vm.invokeFromClass(this.VClass, name, 1)
+}
+
+// collectList collects the `n` values at the stack top into a new list.
+// ( elems...[n] -- list )
+func (vm *VM) collectList(n int) error {
+	if err := vm.alloc(sizeOfList(n)); err != nil {
+		return err
+	}
+	elems := slices.Clone(vm.stack[len(vm.stack)-n:])
+	vm.stack = append(vm.stack[:len(vm.stack)-n], NewVList(elems...))
+	return nil
+}
+
+// expandSpreads replaces the VSpreads among the `n` values at the stack top with their elements,
+// returning the resulting number of values.
+// ( vals...[n] -- expanded...[res] )
+func (vm *VM) expandSpreads(n int) (res int) {
+	vals := slices.Clone(vm.stack[len(vm.stack)-n:])
+	vm.stack = vm.stack[:len(vm.stack)-n]
+	for _, val := range vals {
+		if spread, ok := val.(*VSpread); ok {
+			vm.stack = append(vm.stack, spread.elems...)
+			res += len(spread.elems)
+			continue
+		}
+		vm.push(val)
+		res++
+	}
+	return
+}
+
+// arrangeNamedArgs moves the trailing named arguments among the `argCount` arguments at the stack top
+// to the positions of the parameters with the same `names`, returning the resulting number of arguments.
+// ( callee args...[argCount] -- callee args...[res] )
+func (vm *VM) arrangeNamedArgs(argCount int, names []Value) (res int, err error) {
+	var clos *VClos
+	switch callee := vm.peek(argCount).(type) {
+	case *VClos:
+		clos = callee
+	case *VBoundMethod:
+		clos = callee.VClos
+	case *VClass:
+		clos, _ = callee.methods[*NewVStr("init")].(*VClos)
+	}
+	if clos == nil {
+		return 0, vm.MkError("named arguments can only be passed to Lox functions")
+	}
+	if argCount > clos.arity {
+		return 0, vm.MkErrorf("expected %d arguments but got %d", clos.arity, argCount)
+	}
+	args := make([]Value, clos.arity)
+	posCount := argCount - len(names)
+	copy(args, vm.stack[len(vm.stack)-argCount:][:posCount])
+	named := vm.stack[len(vm.stack)-len(names):]
+	for i, name := range names {
+		name := name.(*VStr)
+		idx := slices.IndexFunc(clos.params, func(param *VStr) bool { return param.Inner() == name.Inner() })
+		switch {
+		case idx == -1:
+			return 0, vm.MkErrorf("unknown parameter '%s'", name.Inner())
+		case args[idx] != nil:
+			return 0, vm.MkErrorf("parameter '%s' already has an argument", name.Inner())
+		}
+		args[idx] = named[i]
+	}
+	for i, arg := range args {
+		if arg == nil {
+			return 0, vm.MkErrorf("missing argument for parameter '%s'", clos.params[i].Inner())
+		}
+	}
+	vm.stack = append(vm.stack[:len(vm.stack)-argCount], args...)
+	return clos.arity, nil
+}
+
+// contains reports whether `x` is an element of the list, a key of the map, or a substring of the string `container`.
+func (vm *VM) contains(container, x Value) (bool, error) {
+	switch container := container.(type) {
+	case *VList:
+		return slices.IndexFunc(container.elems, func(elem Value) bool { return bool(VEq(elem, x)) }) != -1, nil
+	case *VMap:
+		_, ok := container.Get(x)
+		return ok, nil
+	case *VStr:
+		sub, ok := x.(*VStr)
+		if !ok {
+			return false, vm.MkError("the left operand of 'in' must be a string when the right one is a string")
+		}
+		return strings.Contains(container.Inner(), sub.Inner()), nil
+	default:
+		return false, vm.MkError("the right operand of 'in' must be a list, a map or a string")
+	}
+}
+
+// listIndex checks that `key` is an integer within the bounds of `list` and converts it to an index.
+func (vm *VM) listIndex(list *VList, key Value) (int, error) {
+	idx, ok := toInt(key)
+	if !ok {
+		return 0, vm.MkError("list index must be an integer")
+	}
+	if idx < 0 || idx >= len(list.elems) {
+		return 0, vm.MkErrorf("list index %d out of range for length %d", idx, len(list.elems))
+	}
+	return idx, nil
+}
+
+// invokeMethod calls the `this.methodName` method with the given arguments,
+// running it to completion and returning its result.
+func (vm *VM) invokeMethod(this *VInstance, methodName VStr, args ...Value) (Value, error) {
+	method, ok := this.methods[methodName]
+	if !ok {
+		return VNil{}, vm.MkErrorf("undefined property '%s'", methodName.Inner())
+	}
+	switch method := method.(type) {
+	case *VClos:
+		return vm.callValue(NewVBoundMethod(this, method), args...)
+	case *VDecorated:
+		bound, err := vm.bindDecorated(this, method)
+		if err != nil {
+			return VNil{}, err
+		}
+		return vm.callValue(bound, args...)
+	case *VAbstract:
+		return vm.callValue(method, args...)
+	}
+	return VNil{}, vm.MkErrorf("property '%s' is not a method", methodName.Inner())
+}
+
+// toString calls `this.toString()` if `val` is an instance whose class defines such a method.
+func (vm *VM) toString(val Value) (res *VStr, ok bool, err error) {
+	this, ok := val.(*VInstance)
+	if !ok {
+		return nil, false, nil
+	}
+	name := *NewVStr("toString")
+	if _, ok := this.methods[name]; !ok {
+		return nil, false, nil
+	}
+	str, err := vm.invokeMethod(this, name)
+	if err != nil {
+		return nil, false, err
+	}
+	if res, ok = str.(*VStr); !ok {
+		return nil, false, vm.MkError("'toString' must return a string")
+	}
+	return res, true, nil
+}
+
+// display returns the string representation of `val` used by `print`,
+// which honors the `toString` method of instances.
+func (vm *VM) display(val Value) (string, error) {
+	str, ok, err := vm.toString(val)
+	switch {
+	case err != nil:
+		return "", err
+	case ok:
+		return str.Inner(), nil
+	default:
+		return fmt.Sprintf("%s", val), nil
+	}
+}
+
+// callValue calls `callee` with the given arguments,
+// running it to completion and returning its result.
+// This allows the VM to call back into Lox code while executing an instruction.
+func (vm *VM) callValue(callee Value, args ...Value) (Value, error) {
+	depth := len(vm.frames)
+	vm.push(callee)
+	for _, arg := range args {
+		vm.push(arg)
+	}
+	if err := vm.call(callee, len(args)); err != nil {
+		return VNil{}, err
+	}
+	if len(vm.frames) == depth {
+		// The call has already been completed without pushing a new frame,
+		// e.g. when calling a native function.
+		return vm.pop(), nil
+	}
+	return vm.runUntil(depth)
+}
+
+// getProp returns the property `this.name`.
+// Fields shadow methods. Thanks to copy-down inheritance (see OpInherit),
+// `this.methods` already contains the inherited methods not overridden by the class itself,
+// so no superclass walk is needed.
+// ( this -- this )
+func (vm *VM) getProp(this *VInstance, name VStr) (Value, error) {
+	if res, ok := this.Field(name); ok {
+		return res, nil
+	}
+	// Fall back to method resolution.
+	return vm.bindMethod(this.VClass, name)
+}
+
 // bindMethod tries to create a VBoundMethod for `this.name` that binds `this`.
 // ( this -- this )
 func (vm *VM) bindMethod(class *VClass, name VStr) (bound Value, err error) {
@@ -491,13 +1804,53 @@ func (vm *VM) bindMethod(class *VClass, name VStr) (bound Value, err error) {
 	if !ok {
 		return VNil{}, vm.MkErrorf("undefined property '%s'", name.Inner())
 	}
-	return NewVBoundMethod(vm.peek(0), method.(*VClos)), nil
+	switch method := method.(type) {
+	case *VClos:
+		return NewVBoundMethod(vm.peek(0), method), nil
+	case *VDecorated:
+		return vm.bindDecorated(vm.peek(0), method)
+	}
+	return method, nil // An abstract method, which fails when called anyway.
+}
+
+// bindDecorated binds the decorated method `method` to `this`,
+// and then applies the decorators from the innermost to the outermost.
+// The result is cached in `this`, so that the decorators run only once per instance.
+func (vm *VM) bindDecorated(this Value, method *VDecorated) (res Value, err error) {
+	inst, isInst := this.(*VInstance)
+	if isInst {
+		if res, ok := inst.decorated[method]; ok {
+			return res, nil
+		}
+	}
+	res = NewVBoundMethod(this, method.method)
+	for i := len(method.decorators) - 1; i >= 0; i-- {
+		if res, err = vm.callValue(method.decorators[i], res); err != nil {
+			return VNil{}, err
+		}
+	}
+	if isInst {
+		if inst.decorated == nil {
+			inst.decorated = map[*VDecorated]Value{}
+		}
+		inst.decorated[method] = res
+	}
+	return res, nil
+}
+
+// upvalRef returns a reference to the current value of `upval`,
+// i.e. the stack slot if it is still open, or the hoisted value if it is closed.
+func (vm *VM) upvalRef(upval *VUpval) *Value {
+	if upval.idx != nil {
+		return &vm.stack[*upval.idx]
+	}
+	return upval.val
 }
 
 func (vm *VM) closeUpvals(minStackIdx int) {
 	for curr := &vm.openUpvals; *curr != nil && *(*curr).idx >= minStackIdx; *curr = (*curr).next {
-		// Thanks to Go's garbage collection, there's no need to actually save the VUpval to a "closed" field.
-		// Here, we set idx to nil to indicate that the Upval is closed.
+		// Hoist the value out of the stack, and set idx to nil to indicate that the Upval is closed.
+		(*curr).val = utils.Box(vm.stack[*(*curr).idx])
 		(*curr).idx = nil
 	}
 }
@@ -512,9 +1865,9 @@ func (vm *VM) captureUpval(stackIdx int) (res *VUpval) {
 		return curr
 	}
 
-	// ! We want to hoist vm.stack[stackIdx] to heap instead of getting its address.
-	// ! So `Box` is used instead of `&`.
-	res = NewVUpval(utils.Box(vm.stack[stackIdx]), stackIdx)
+	// ! The stack might be reallocated, so the open VUpval refers to vm.stack[stackIdx] by index instead of by address.
+	// ! The value will be hoisted to the heap when the VUpval gets closed.
+	res = NewVUpval(stackIdx)
 	res.next = curr
 	if prev == nil {
 		// The iteration didn't start: vm.openUpVals had too low idx or was empty.
@@ -529,8 +1882,10 @@ func (vm *VM) captureUpval(stackIdx int) (res *VUpval) {
 
 func (vm *VM) MkError(reason string) *e.RuntimeError {
 	err := &e.RuntimeError{Reason: reason}
-	if vm.chunk() != nil {
-		err.Line = vm.chunk().lines[*vm.ip()]
+	if frame := vm.frame(); frame != nil && frame.clos != nil {
+		err.Line = frame.clos.chunk.lines[frame.instIP]
+		err.Fun = frame.clos.Name()
+		err.IP = frame.instIP
 	}
 	return err
 }
@@ -539,6 +1894,17 @@ func (vm *VM) MkErrorf(format string, a ...any) *e.RuntimeError {
 	return vm.MkError(fmt.Sprintf(format, a...))
 }
 
+// panicReason returns the message of a recovered panic.
+func panicReason(r any) string {
+	switch r := r.(type) {
+	case *logrus.Entry: // From logrus.Panicln and its friends.
+		return r.Message
+	case error:
+		return r.Error()
+	}
+	return fmt.Sprint(r)
+}
+
 func (vm *VM) stackTrace() string {
 	res := "          "
 	if len(vm.stack) == 0 {
@@ -551,18 +1917,30 @@ func (vm *VM) stackTrace() string {
 	return res
 }
 
-func (vm *VM) callTrace() (res string) {
-	res = "call trace:"
+// FrameInfo describes the position of a call frame.
+type FrameInfo struct {
+	Fun  string // The name of the called function.
+	Line int    // The line of the instruction being executed.
+	IP   int    // The bytecode offset of the instruction being executed.
+}
+
+// CallStack returns the positions of the call frames, from the innermost to the outermost.
+func (vm *VM) CallStack() (res []FrameInfo) {
 	for i := len(vm.frames) - 1; i >= 0; i-- {
 		frame := &vm.frames[i]
-		clos := frame.clos
-		res += fmt.Sprintf(
-			"\n          [L%d] in %s()",
-			// The - 1 is because the IP is already sitting on the next instruction to be executed,
-			// but we want the stack trace to point to the previous failed instruction.
-			clos.chunk.lines[frame.ip-1],
-			clos.Name(),
-		)
+		res = append(res, FrameInfo{
+			Fun:  frame.clos.Name(),
+			Line: frame.clos.chunk.lines[frame.instIP],
+			IP:   frame.instIP,
+		})
+	}
+	return
+}
+
+func (vm *VM) callTrace() (res string) {
+	res = "call trace:"
+	for _, frame := range vm.CallStack() {
+		res += fmt.Sprintf("\n          [L%d] in %s()", frame.Line, frame.Fun)
 	}
 	return
 }
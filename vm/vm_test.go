@@ -1,10 +1,17 @@
 package vm_test
 
 import (
+	"bytes"
 	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/MakeNowJust/heredoc/v2"
+	"github.com/hashicorp/go-multierror"
+	e "github.com/rami3l/golox/errors"
 	"github.com/rami3l/golox/vm"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -60,640 +67,4280 @@ func TestCalculator(t *testing.T) {
 	}...)
 }
 
-func TestVarsBlocks(t *testing.T) {
+func TestStrEq(t *testing.T) {
 	assertEval(t, "", []TestPair{
-		{"var foo = 2;", "nil"},
-		{"foo", "2"},
-		{"foo + 3 == 1 + foo * foo", "true"},
-		{"var bar;", "nil"},
-		{"bar", "nil"},
-		{"bar = foo = 2;", "nil"},
-		{"foo", "2"},
-		{"bar", "2"},
-		{"{ foo = foo + 1; var bar; var foo1 = foo; foo1 = foo1 + 1; }", "nil"},
-		{"foo", "3"},
+		{`"foo" == "foo"`, "true"},
+		{`"foo" + "bar" == "foobar"`, "true"},
+		{`"foo" != "bar"`, "true"},
+		{`"1" == 1`, "false"},
 	}...)
 }
 
-func TestVarOwnInit(t *testing.T) {
-	assertEval(t, "can't read local variable in its own initializer",
-		[]TestPair{
-			{"var foo = 2;", "nil"},
-			{"{ var foo = foo; }", ""},
-		}...,
-	)
-}
-
-func TestIfElse(t *testing.T) {
+func TestStrMultiline(t *testing.T) {
 	assertEval(t, "", []TestPair{
-		{"var foo = 2;", "nil"},
-		{"if (foo == 2) foo = foo + 1; else { foo = 42; }", "nil"},
-		{"foo", "3"},
-		{"if (foo == 2) { foo = foo + 1; } else foo = nil;", "nil"},
-		{"foo", "nil"},
-		{"if (!foo) foo = 1;", "nil"},
-		{"foo", "1"},
-		{"if (foo) foo = 2;", "nil"},
-		{"foo", "2"},
+		{"\"foo\nbar\"", "\"foo\nbar\""},
+		{"var foo = \"\n\n\";", "nil"},
+		{"foo", "\"\n\n\""},
 	}...)
 }
 
-func TestAndOr(t *testing.T) {
-	assertEval(t, "", []TestPair{
-		{`"trick" or __TREAT__`, `"trick"`},
-		{"996 or 007", "996"},
-		{`nil or "hi"`, `"hi"`},
-		{"nil and what", "nil"},
-		{`true and "then_what"`, `"then_what"`},
-		{"var B = 66;", "nil"},
-		{"2*B or !2*B", "132"},
-	}...)
+func TestStrUnterminated(t *testing.T) {
+	t.Parallel()
+	src := "var foo = 1;\nvar bar = \"baz\n\nqux\n\nquux"
+	_, err := vm.NewVM().Interpret(src, false)
+	assert.EqualError(t, err, "1 error occurred:\n\t* compilation error [L2]: unterminated string\n\n")
 }
 
-func TestIfAndOr(t *testing.T) {
+func TestStrAdjacent(t *testing.T) {
 	assertEval(t, "", []TestPair{
-		{"var foo = 2;", "nil"},
-		{
-			"if (foo != 2 and whatever) foo = foo + 42; else { foo = 3; }",
-			"nil",
-		},
-		{"foo", "3"},
-		{
-			"if (0 <= foo and foo <= 3) { foo = foo + 1; } else { foo = nil; }",
-			"nil",
-		},
-		{"foo", "4"},
-		{"if (!!!(2 + 2 != 5) or !!!!!!!!foo) foo = 1;", "nil"},
-		{"foo", "1"},
-		{"if (true or whatever) foo = 2;", "nil"},
-		{"foo", "2"},
+		{`"a" "b" "c"`, `"abc"`},
+		{`"a" "b" "c" == "abc"`, "true"},
+		{"\"foo \"\n\t\"bar\" + \"!\"", `"foo bar!"`},
+		{`"" ""`, `""`},
 	}...)
 }
 
-func TestWhile(t *testing.T) {
-	assertEval(t, "", []TestPair{
-		{"var i = 1; var product = 1;", "nil"},
-		{"while (i <= 5) { product = product * i; i = i + 1; }", "nil"},
-		{"product", "120"},
-	}...)
+func TestStrAdjacentDisassemble(t *testing.T) {
+	t.Parallel()
+	fun, err := vm.NewParser().Compile(`"a" "b" "c"`, true)
+	assert.Nil(t, err)
+	dump := fun.Chunk().Disassemble("test")
+	assert.Equal(t, 1, strings.Count(dump, "OpConst"), dump)
+	assert.Contains(t, dump, `'"abc"'`)
 }
 
-func TestWhileJump(t *testing.T) {
+func TestNumImm(t *testing.T) {
 	assertEval(t, "", []TestPair{
-		{"var i = 1; var product = 1;", "nil"},
-		{
-			heredoc.Doc(`
-				while (true) {
-					if (i == 3 or i == 5) {
-						i = i + 1;
-						continue;
-					}
-					product = product * i;
-					i = i + 1;
-					if (i > 6) { break; }
-				}
-			`),
-			"nil",
-		},
-		{"product", "48"},
+		{"0", "0"},
+		{"255 + 1", "256"},
+		{"256", "256"},
+		{"-1", "-1"},
+		{"1.5", "1.5"},
+		{"var n = 0; for (var i = 0; i < 3; i = i + 1) n = n + i;", "nil"},
+		{"n", "3"},
 	}...)
 }
 
-func TestFor(t *testing.T) {
-	assertEval(t, "", []TestPair{
-		{"var product = 1;", "nil"},
-		{
-			"for (var i = 1; i <= 5; i = i + 1) { product = product * i; }",
-			"nil",
-		},
-		{"product", "120"},
-	}...)
+func TestNumImmDisassemble(t *testing.T) {
+	t.Parallel()
+	fun, err := vm.NewParser().Compile("for (var i = 0; i < 3; i = i + 1) {}", false)
+	assert.Nil(t, err)
+	dump := fun.Chunk().Disassemble("test")
+	// The immediate in `i + 1` is folded into an OpAddConst.
+	assert.Equal(t, 2, strings.Count(dump, "OpConstImm"), dump)
+	assert.Contains(t, dump, "OpAddConst          1 + 1", dump)
+	assert.NotContains(t, dump, "OpConst ", dump)
+
+	fun, err = vm.NewParser().Compile("256 + 0.5 + 255", true)
+	assert.Nil(t, err)
+	dump = fun.Chunk().Disassemble("test")
+	assert.Equal(t, 1, strings.Count(dump, "OpConstImm"), dump)
+	assert.Equal(t, 2, strings.Count(dump, "OpConst "), dump)
 }
 
-func TestForBreak(t *testing.T) {
+func TestEqLit(t *testing.T) {
 	assertEval(t, "", []TestPair{
-		{"var i = 1; var product = 1;", "nil"},
-		{
-			"for (; ; i = i + 1) { product = product * i; if (i == 5) break; }",
-			"nil",
-		},
-		{"i", "5"},
-		{"product", "120"},
+		{"var x;", "nil"},
+		{"x == nil", "true"},
+		{"x != nil", "false"},
+		{"x == false", "false"},
+		{"1 == true", "false"},
+		{"(1 < 2) == true", "true"},
+		{"(1 < 2) != false", "true"},
+		{"x = 0;", "nil"},
+		{"x == nil", "false"},
+		{"class Nullish { __eq__(other) { return other == nil; } }", "nil"},
+		{"Nullish() == nil", "false"},
+		{"Nullish() != nil", "true"},
+		{"Nullish() == Nullish()", "false"},
+		{"var n = nil;", "nil"},
+		{"Nullish() == n", "false"},
 	}...)
 }
 
-func TestForContinue(t *testing.T) {
+func TestEqLitDisassemble(t *testing.T) {
+	t.Parallel()
+	fun, err := vm.NewParser().Compile("var x; print x == nil; print x != true; print x == false;", false)
+	assert.Nil(t, err)
+	dump := fun.Chunk().Disassemble("test")
+	for _, op := range []string{"OpIsNil", "OpIsTrue", "OpIsFalse"} {
+		assert.Contains(t, dump, op, dump)
+	}
+	assert.NotContains(t, dump, "OpEqual", dump)
+	// Only the initializer of `x` and the implicit return push a nil.
+	assert.Equal(t, 2, strings.Count(dump, "OpNil"), dump)
+}
+
+func TestConcat(t *testing.T) {
 	assertEval(t, "", []TestPair{
-		{"var i = 1; var product = 1;", "nil"},
-		{
-			"for (; ; i = i + 1) { product = product * i; if (i < 5) continue; break; }",
-			"nil",
-		},
-		{"i", "5"},
-		{"product", "120"},
+		{`var a = "a"; var b = "b";`, "nil"},
+		{`a + ", " + b + "!"`, `"a, b!"`},
+		{"a + b + a", `"aba"`},
+		{"1 + 2 + 3.5", "6.5"},
+		{"1 + 2 - 3 + 4 + 5", "9"},
 	}...)
 }
 
-func TestBareBreak(t *testing.T) {
-	assertEval(t, "expect 'break' in a loop", []TestPair{
-		{"break;", ""},
+func TestConcatMixed(t *testing.T) {
+	assertEval(t, "operands must be all numbers or all strings", []TestPair{
+		{`"a" + "b" + 1`, ""},
 	}...)
 }
 
-func TestBareContinue(t *testing.T) {
-	assertEval(t, "expect 'continue' in a loop", []TestPair{
-		{"continue;", ""},
+func TestConcatLong(t *testing.T) {
+	operands := make([]string, 600)
+	for i := range operands {
+		operands[i] = fmt.Sprintf(`x%d`, i%3)
+	}
+	assertEval(t, "", []TestPair{
+		{fmt.Sprintf("fun long(x0, x1, x2) { return %s; }", strings.Join(operands, " + ")), "nil"},
+		{`len(long("a", "b", "c"))`, "600"},
+		{`startsWith(long("a", "b", "c"), "abcabc")`, "true"},
+		{"long(1, 2, 3)", "1200"},
 	}...)
 }
 
-func TestBareReturn(t *testing.T) {
-	assertEval(t, "can't return from top-level code", []TestPair{
-		{"return true;", ""},
+func TestConcatOrder(t *testing.T) {
+	// Each `+` runs as soon as its RHS is evaluated, before the operands on its right.
+	assertEval(t, "", []TestPair{
+		{`var log = "";`, "nil"},
+		{`fun f(x) { log = log + str(x); return x; }`, "nil"},
+		{`class V { __add__(other) { log = log + "+"; return this; } }`, "nil"},
+		{`try { f("a") + f(1) + f("c"); } catch (e) {}`, "nil"},
+		{"log", `"a1"`},
+		{`log = ""; V() + f("x") + f("y");`, "nil"},
+		{"log", `"x+y+"`},
 	}...)
 }
 
-func TestFunReturnInLoop(t *testing.T) {
+func TestConcatOverload(t *testing.T) {
+	// A string returned by `__add__` in the middle of a chain is appended to as usual.
 	assertEval(t, "", []TestPair{
-		{
-			heredoc.Doc(`
-				fun fact(n) {
-					var i; var product;
-					for (i = product = 1; ; i = i + 1) {
-						product = product * i;
-						if (i >= n) { return product; }
-					}
-				}
-			`),
-			"nil",
-		},
-		{"fact(5)", "120"},
+		{`class W { __add__(other) { return "w" + other; } }`, "nil"},
+		{`W() + "a" + "b" + "c"`, `"wabc"`},
+		{`W() + (W() + "a") + "b"`, `"wwab"`},
 	}...)
 }
 
-func TestFunArity(t *testing.T) {
-	assertEval(t, "expected 2 arguments but got 1", []TestPair{
-		{"fun f(j, k) { return (1 + j) * k; }", "nil"},
-		{"f(2)", ""},
-	}...)
+func TestConcatDisassemble(t *testing.T) {
+	t.Parallel()
+	fun, err := vm.NewParser().Compile(`var s = "x"; print s + ", " + s + "!";`, false)
+	assert.Nil(t, err)
+	dump := fun.Chunk().Disassemble("test")
+	// Only the last OpConcat of the chain converts the result back to a string.
+	assert.Equal(t, 2, strings.Count(dump, "OpConcat            0"), dump)
+	assert.Equal(t, 1, strings.Count(dump, "OpConcat            1"), dump)
+	assert.NotContains(t, dump, "OpAdd", dump)
 }
 
-func TestFunRecursive(t *testing.T) {
+func TestStringBuilder(t *testing.T) {
 	assertEval(t, "", []TestPair{
-		{"fun fact(i) { if (i <= 0) { return 1; } return i * fact(i - 1); }", "nil"},
-		{"fact(5)", "120"},
+		{"var sb = StringBuilder();", "nil"},
+		{"sb", "<string builder>"},
+		{"sb.toString()", `""`},
+		{`sb.append("a").append(1, nil, true).append("b");`, "nil"},
+		{"sb.toString()", `"a1niltrueb"`},
+		{"class P { toString() { return \"<p>\"; } }", "nil"},
+		{"var append = sb.append;", "nil"},
+		{"append(P(), [1]);", "nil"},
+		{"sb.toString()", `"a1niltrueb<p>[1]"`},
+		{"for (var i = 0; i < 3; i = i + 1) sb.append(i);", "nil"},
+		{"len(sb.toString())", "19"},
 	}...)
 }
 
-func TestFunRefGlobal(t *testing.T) {
-	assertEval(t, "", []TestPair{
-		{"var a = 3; fun f() { return a; } a = 4;", "nil"},
-		{"f()", "4"},
+func TestStringBuilderUndefined(t *testing.T) {
+	assertEval(t, "undefined property 'push'", []TestPair{
+		{`StringBuilder().push("a")`, ""},
 	}...)
 }
 
-func TestFunLateInit(t *testing.T) {
+// elseIfChain returns the source of `fun classify(n)`, which returns the index of the first arm `n < 10*(i+1)`,
+// plus 1000 times the number of statements of padding run by that arm, which is `pad`.
+func elseIfChain(arms, pad int) string {
+	var src strings.Builder
+	src.WriteString("fun classify(n) {\nvar padding = 0;\n")
+	for i := 0; i < arms; i++ {
+		if i > 0 {
+			src.WriteString(" else ")
+		}
+		fmt.Fprintf(&src, "if (n < %d) {\n", 10*(i+1))
+		src.WriteString(strings.Repeat("padding = padding + 1;\n", pad))
+		fmt.Fprintf(&src, "return %d + padding * 1000;\n}", i)
+	}
+	src.WriteString(" else {\nreturn -1;\n}\n}\n")
+	return src.String()
+}
+
+func TestElseIfChain(t *testing.T) {
 	assertEval(t, "", []TestPair{
-		{"fun f() { return a; } var a = 4;", "nil"},
-		{"f()", "4"},
+		{elseIfChain(10, 0), "nil"},
+		{"classify(0)", "0"},
+		{"classify(15)", "1"},
+		{"classify(55)", "5"},
+		{"classify(99)", "9"},
+		{"classify(100)", "-1"},
 	}...)
 }
 
-func TestFunLateInitFun(t *testing.T) {
+func TestElseIfChainLongJumps(t *testing.T) {
+	// Each arm takes more than 256 bytes, so the jump offsets need both of their bytes.
 	assertEval(t, "", []TestPair{
-		{"fun f() { return four(); } fun four() { return 4; }", "nil"},
-		{"f()", "4"},
+		{elseIfChain(12, 50), "nil"},
+		{"classify(5)", "50000"},
+		{"classify(65)", "50006"},
+		{"classify(115)", "50011"},
+		{"classify(1000)", "-1"},
 	}...)
 }
 
-func TestBareBreakInClos(t *testing.T) {
-	assertEval(t, "expect 'break' in a loop", []TestPair{
-		{"for (var i = 0; i < 10; i = i + 1) { fun g() { break; } }", ""},
+func TestElseIfChainTooLong(t *testing.T) {
+	assertEval(t, "too much code to jump over", []TestPair{
+		{elseIfChain(2, 12000), ""},
 	}...)
 }
 
-func TestBareContinueInClos(t *testing.T) {
-	assertEval(t, "expect 'continue' in a loop", []TestPair{
-		{"for (var i = 0; i < 10; i = i + 1) { fun g() { continue; } }", ""},
+func TestDeepNesting(t *testing.T) {
+	assertEval(t, "expression too deeply nested", []TestPair{
+		{strings.Repeat("(", 10000) + "1" + strings.Repeat(")", 10000), ""},
 	}...)
 }
 
-func TestBareReturnInClos(t *testing.T) {
-	assertEval(t, "", []TestPair{
-		{"var i;", "nil"},
-		{"for (i = 0; i < 10; i = i + 1) { fun g() { return; } }", "nil"},
-		{"i", "10"},
+func TestDeepNestingUnary(t *testing.T) {
+	assertEval(t, "expression too deeply nested", []TestPair{
+		{"var x = " + strings.Repeat("-", 10000) + "1;", ""},
 	}...)
 }
 
-func TestClosNoEscape(t *testing.T) {
-	assertEval(t, "", []TestPair{
-		{
-			heredoc.Doc(`
-				fun outer() {
-					var x = "outside";
-					fun inner() { return x; }
-					return inner();
-				}
-			`),
-			"nil",
-		},
-		{"outer()", `"outside"`},
-	}...)
+func TestMaxNesting(t *testing.T) {
+	t.Parallel()
+	parser := vm.NewParser()
+	parser.SetMaxNesting(3)
+	_, err := parser.Compile("((1))", true)
+	assert.Nil(t, err)
+	_, err = parser.Compile("(((1)))", true)
+	var compErr *e.CompilationError
+	assert.ErrorAs(t, err, &compErr)
+	assert.ErrorContains(t, err, "at `1`, expression too deeply nested")
+
+	// The nesting is counted afresh for each compilation.
+	_, err = parser.Compile("(-1)", true)
+	assert.Nil(t, err)
+	parser.SetMaxNesting(0)
+	_, err = parser.Compile(strings.Repeat("!", 2000)+"true", true)
+	assert.Nil(t, err)
 }
 
-func TestClosEscape(t *testing.T) {
-	assertEval(t, "", []TestPair{
-		{
-			heredoc.Doc(`
-				fun outer() {
-					var x = "outside";
-					fun inner() { return x;} 
-					return inner;
-  				}
-			`),
-			"nil",
-		},
-		{"outer()()", `"outside"`},
-	}...)
+func TestMaxNestingClassExpr(t *testing.T) {
+	t.Parallel()
+	src := "var C = (((class { m() { 1; 2; } })));"
+	_, err := vm.NewVM(vm.WithMaxNesting(3)).Interpret(src, false)
+	assert.ErrorContains(t, err, "at `class`, expression too deeply nested")
+	// The method body starts afresh, instead of being nested in the class expression.
+	_, err = vm.NewVM(vm.WithMaxNesting(4)).Interpret(src, false)
+	assert.Nil(t, err)
+
+	deep := func(n int) string {
+		return "var C = " + strings.Repeat("(", n) + "class { m() { 1; 2; } }" + strings.Repeat(")", n) + ";"
+	}
+	_, err = vm.NewVM().Interpret(deep(vm.DefaultMaxNesting-1), false)
+	assert.Nil(t, err)
+	_, err = vm.NewVM().Interpret(deep(vm.DefaultMaxNesting), false)
+	assert.ErrorContains(t, err, "expression too deeply nested")
 }
 
-func TestClosCurrying(t *testing.T) {
-	assertEval(t, "", []TestPair{
-		{
-			heredoc.Doc(`
-				fun f(j) { 
-					fun g(k) { return (1 + j) * k; }
-					return g;
-				}
-			`),
-			"nil",
-		},
-		{"f(2)(3)", "9"},
-	}...)
+func TestElseIfChainDisassemble(t *testing.T) {
+	t.Parallel()
+	fun, err := vm.NewParser().Compile("var x = 3; if (x < 1) x = 1; else if (x < 2) x = 2; else if (x < 3) x = 3; else x = 4;", false)
+	assert.Nil(t, err)
+	dump := fun.Chunk().DisassembleLabeled("test")
+	// Every arm jumps straight to the end of the chain, rather than to the end of the enclosing arm.
+	jumps := regexp.MustCompile(`OpJump +(L\d+)`).FindAllStringSubmatch(dump, -1)
+	assert.Len(t, jumps, 3, dump)
+	for _, jump := range jumps {
+		assert.Equal(t, jumps[0][1], jump[1], dump)
+	}
 }
 
-func TestClosRecursive(t *testing.T) {
+func TestAddConst(t *testing.T) {
 	assertEval(t, "", []TestPair{
-		{"var res;", "nil"},
 		{
 			heredoc.Doc(`
-				{
-					fun fact(i) { if (i <= 0) { return 1; } return i * fact(i - 1); }
-					res = fact(5);
+				fun product(n) {
+					var i = 1; var product = 1;
+					while (i <= n) { product = product * i; i = i + 1; }
+					return product;
 				}
 			`),
 			"nil",
 		},
-		{"res", "120"},
+		{"product(5)", "120"},
+		{"fun inc(x) { return x + 255; }", "nil"},
+		{"inc(0.5)", "255.5"},
+		{"inc(-255)", "0"},
+		// The other operand types fall back to the general case.
+		{"class N { init(n) { this.n = n; } __add__(m) { return this.n + m; } }", "nil"},
+		{"inc(N(1))", "256"},
 	}...)
 }
 
-func TestClosCounter(t *testing.T) {
-	assertEval(t, "", []TestPair{
-		{
-			heredoc.Doc(`
-				fun make_counter() {
-					var i = 0;
-					fun count() { i = i + 1; return i; }
-					return count;
-				}
-				var counter = make_counter();
-			`),
-			"nil",
-		},
-		{"counter()", "1"},
-		{"counter()", "2"},
+func TestAddConstNonNum(t *testing.T) {
+	assertEval(t, "operands must be all numbers or all strings", []TestPair{
+		{"fun inc(x) { return x + 1; }", "nil"},
+		{`inc("a")`, ""},
 	}...)
 }
 
-func TestClosShareRef(t *testing.T) {
-	assertEval(t, "", []TestPair{
-		{
-			heredoc.Doc(`
-				var globalSet; var globalGet;
-				fun main() {
-					var a = "initial";
-					fun set() { a = "updated"; }
-					fun get() { return a; }
-					globalSet = set; globalGet = get;
-				}
-				main();
-				globalSet();
-			`),
-			"nil",
+func TestIntMode(t *testing.T) {
+	t.Parallel()
+	intVM, floatVM := vm.NewVM(), vm.NewVM()
+	intVM.SetIntMode(true)
+	for _, pair := range []struct{ input, intOutput, floatOutput string }{
+		{"10000000000000001 - 1", "10000000000000000", "1e+16"},
+		{"10000000000000001 - 1 == 10000000000000000", "true", "true"},
+		// Floats can't tell apart integers beyond 2^53.
+		{"10000000000000001 == 10000000000000000", "false", "true"},
+		{`parseNumber("10000000000000001")`, "10000000000000001", "1e+16"},
+		// Overflowing integers fall back to floats.
+		{"9223372036854775807 + 1", "9.223372036854776e+18", "9.223372036854776e+18"},
+		{"-9223372036854775807 - 2", "-9.223372036854776e+18", "-9.223372036854776e+18"},
+		{"4294967296 * 4294967296", "1.8446744073709552e+19", "1.8446744073709552e+19"},
+		{"-(-9223372036854775807 - 1)", "9.223372036854776e+18", "9.223372036854776e+18"},
+		{"floorDiv(-9223372036854775807 - 1, -1)", "9.223372036854776e+18", "9.223372036854776e+18"},
+		{"9223372036854775807 - 1 + 1", "9223372036854775807", "9.223372036854776e+18"},
+		{"2 * 3 + 1", "7", "7"},
+		{"7 / 2", "3.5", "3.5"},
+		{"6 / 2", "3", "3"},
+		{"divmod(10000000000000001, -2)", "[-5000000000000001, -1]", "[-5e+15, 0]"},
+		{"1 + 0.5", "1.5", "1.5"},
+		{"-(2 - 5)", "3", "3"},
+		{"1 == 1.0", "true", "true"},
+		{"1 < 1.5", "true", "true"},
+		{"300 > 299", "true", "true"},
+	} {
+		val, err := intVM.Interpret(pair.input, true)
+		assert.Nil(t, err)
+		assert.Equal(t, pair.intOutput, fmt.Sprintf("%s", val), pair.input)
+		val, err = floatVM.Interpret(pair.input, true)
+		assert.Nil(t, err)
+		assert.Equal(t, pair.floatOutput, fmt.Sprintf("%s", val), pair.input)
+	}
+}
+
+func TestExtendedFalsiness(t *testing.T) {
+	t.Parallel()
+	extVM, defaultVM := vm.NewVM(vm.WithExtendedFalsiness()), vm.NewVM()
+	for _, pair := range []struct{ input, extOutput, defaultOutput string }{
+		{"toBool(0)", "false", "true"},
+		{`toBool("")`, "false", "true"},
+		{"toBool([])", "false", "true"},
+		{"toBool(map())", "false", "true"},
+		{"toBool(nil)", "false", "false"},
+		{"toBool(false)", "false", "false"},
+		{"toBool(0.5)", "true", "true"},
+		{`toBool("0")`, "true", "true"},
+		{"toBool([0])", "true", "true"},
+		{"!0", "true", "false"},
+		{`"" or "default"`, `"default"`, `""`},
+		{"[] and 1", "[]", "1"},
+	} {
+		val, err := extVM.Interpret(pair.input, true)
+		assert.Nil(t, err)
+		assert.Equal(t, pair.extOutput, fmt.Sprintf("%s", val), pair.input)
+		val, err = defaultVM.Interpret(pair.input, true)
+		assert.Nil(t, err)
+		assert.Equal(t, pair.defaultOutput, fmt.Sprintf("%s", val), pair.input)
+	}
+
+	var out bytes.Buffer
+	extVM.SetStdout(&out)
+	_, err := extVM.Interpret(`var n = 3; while (n) { print n; n = n - 1; } if ("") print "unreachable";`, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "3\n2\n1\n", out.String())
+}
+
+func TestImplicitReturn(t *testing.T) {
+	t.Parallel()
+	implicitVM, defaultVM := vm.NewVM(vm.WithImplicitReturn()), vm.NewVM()
+	src := heredoc.Doc(`
+		fun double(x) { x * 2; }
+		fun early(x) { if (x) return "early"; "late"; }
+		fun notLast(x) { x; var y = 1; }
+		fun nested(x) { if (x) { x; } }
+		fun curried(x) { fun add(y) { x + y; } add; }
+		class Box {
+			init(x) { this.x = x; x; }
+			get() { this.x; }
+		}
+	`)
+	for _, vm_ := range []*vm.VM{implicitVM, defaultVM} {
+		_, err := vm_.Interpret(src, false)
+		assert.Nil(t, err)
+	}
+	for _, pair := range []struct{ input, implicitOutput, defaultOutput string }{
+		{"double(21)", "42", "nil"},
+		{"early(true)", `"early"`, `"early"`},
+		{"early(false)", `"late"`, "nil"},
+		{"notLast(1)", "nil", "nil"},
+		{"nested(1)", "nil", "nil"},
+		{"curried(1)", "<fun add>", "nil"},
+		{"Box(1).get()", "1", "nil"},
+		{"Box(1)", "<instanceof Box>", "<instanceof Box>"},
+	} {
+		val, err := implicitVM.Interpret(pair.input, true)
+		assert.Nil(t, err)
+		assert.Equal(t, pair.implicitOutput, fmt.Sprintf("%s", val), pair.input)
+		val, err = defaultVM.Interpret(pair.input, true)
+		assert.Nil(t, err, pair.input)
+		assert.Equal(t, pair.defaultOutput, fmt.Sprintf("%s", val), pair.input)
+	}
+	val, err := implicitVM.Interpret("curried(1)(2)", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "3", fmt.Sprintf("%s", val))
+}
+
+func TestNumLit(t *testing.T) {
+	t.Parallel()
+	intVM, floatVM := vm.NewVM(), vm.NewVM()
+	intVM.SetIntMode(true)
+	for _, pair := range []struct{ lit, intOutput, floatOutput string }{
+		{"42", "42", "42"},
+		{"1_000", "1000", "1000"},
+		{"1_000.000_5", "1000.0005", "1000.0005"},
+		{"1e3", "1000", "1000"},
+		{"1E3", "1000", "1000"},
+		{"1.5e-3", "0.0015", "0.0015"},
+		{"2e+2", "200", "200"},
+		{"0xFF", "255", "255"},
+		{"0XfF", "255", "255"},
+		{"0xdead_beef", "3735928559", "3.735928559e+09"},
+		{"0b1010", "10", "10"},
+		{"0B1_0000_0000", "256", "256"},
+		{"0x8000000000000000", "9.223372036854776e+18", "9.223372036854776e+18"},
+		{"010", "10", "10"},
+	} {
+		// The scanner accepts the whole literal as a single number token.
+		s := vm.NewScanner(pair.lit)
+		tk := s.ScanToken()
+		assert.Equal(t, vm.TNum, tk.Type, pair.lit)
+		assert.Equal(t, pair.lit, tk.String())
+		assert.Equal(t, vm.TEOF, s.ScanToken().Type, pair.lit)
+
+		val, err := intVM.Interpret(pair.lit, true)
+		assert.Nil(t, err)
+		assert.Equal(t, pair.intOutput, fmt.Sprintf("%s", val), pair.lit)
+		val, err = floatVM.Interpret(pair.lit, true)
+		assert.Nil(t, err)
+		assert.Equal(t, pair.floatOutput, fmt.Sprintf("%s", val), pair.lit)
+	}
+}
+
+func TestNumLitMalformed(t *testing.T) {
+	t.Parallel()
+	// Underscores and prefixes must be followed by digits, otherwise they start other tokens.
+	for _, pair := range []struct{ src, lexeme string }{
+		{"1_", "1"},
+		{"1__0", "1"},
+		{"0x", "0"},
+		{"0b2", "0"},
+		{"1e", "1"},
+		{"1e+", "1"},
+		{"1.", "1"},
+	} {
+		tk := vm.NewScanner(pair.src).ScanToken()
+		assert.Equal(t, vm.TNum, tk.Type, pair.src)
+		assert.Equal(t, pair.lexeme, tk.String(), pair.src)
+	}
+}
+
+func TestLineEndings(t *testing.T) {
+	t.Parallel()
+	for _, pair := range []struct{ src, errSubstr string }{
+		{
+			"var foo = 1;\n// comment\n\nvar = 2;",
+			"compilation error [L4]",
+		},
+		{
+			"var foo = \"multi\nline\nstring\";\nfoo = foo +\n\n1;",
+			"runtime error [L4]",
+		},
+		{
+			"var foo = 1;\n\"unterminated\n\n",
+			"compilation error [L2]",
+		},
+	} {
+		for _, newline := range []string{"\n", "\r\n", "\r"} {
+			src := strings.ReplaceAll(pair.src, "\n", newline)
+			_, err := vm.NewVM().Interpret(src, false)
+			assert.ErrorContains(t, err, pair.errSubstr, "%q", src)
+		}
+	}
+}
+
+func TestRuntimeErrorPosition(t *testing.T) {
+	t.Parallel()
+	src := heredoc.Doc(`
+		fun f(x) {
+			return (x
+				- 1) *
+				x
+				;
+		}
+		f(nil);
+	`)
+	_, err := vm.NewVM().Interpret(src, false)
+	var rtErr *e.RuntimeError
+	assert.ErrorAs(t, err, &rtErr)
+	// The failing `-` is on line 3, whereas the following instruction is on line 4.
+	assert.Equal(t, 3, rtErr.Line)
+	assert.Equal(t, "f", rtErr.Fun)
+}
+
+func TestInterpretNoRecover(t *testing.T) {
+	t.Parallel()
+	src := heredoc.Doc(`
+		fun inner() {
+			return nil + 1;
+		}
+		fun outer() {
+			return inner();
+		}
+		outer();
+	`)
+	vm_ := vm.NewVM()
+	_, err := vm_.InterpretNoRecover(src, false)
+	assert.ErrorContains(t, err, "runtime error [L2]")
+	stack := vm_.CallStack()
+	assert.Len(t, stack, 3)
+	for i, want := range []vm.FrameInfo{{Fun: "inner", Line: 2}, {Fun: "outer", Line: 5}, {Fun: "?", Line: 7}} {
+		assert.Equal(t, want.Fun, stack[i].Fun)
+		assert.Equal(t, want.Line, stack[i].Line)
+	}
+
+	vm_.Recover()
+	assert.Empty(t, vm_.CallStack())
+	val, err := vm_.Interpret("1 + 1\n", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "2", fmt.Sprintf("%s", val))
+}
+
+func TestStep(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	assert.Nil(t, vm_.Load("var a = 1 + 2;", false))
+	frame, ok := vm_.CurrentFrame()
+	assert.True(t, ok)
+	assert.Equal(t, "?", frame.Fun)
+
+	// The stack after each instruction, where the top-level function is at the bottom.
+	stacks := []string{
+		"[<fun ?> 1]",   // OpConstImm 1
+		"[<fun ?> 1 2]", // OpConstImm 2
+		"[<fun ?> 3]",   // OpAdd
+		"[<fun ?>]",     // OpDefGlobal a
+		"[<fun ?> nil]", // OpNil
+		"[]",            // OpReturn
+	}
+	for i, want := range stacks {
+		ip := vm_.IP()
+		done, err := vm_.Step()
+		assert.Nil(t, err)
+		assert.Equal(t, i == len(stacks)-1, done)
+		assert.Equal(t, want, fmt.Sprintf("%s", vm_.Stack()), "after the instruction at %d", ip)
+	}
+	_, ok = vm_.CurrentFrame()
+	assert.False(t, ok)
+	assert.Equal(t, vm.Uninit, vm_.IP())
+
+	val, err := vm_.Interpret("a\n", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "3", fmt.Sprintf("%s", val))
+}
+
+func TestVMDisassemble(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	assert.Equal(t, "", vm_.Disassemble())
+	_, err := vm_.Interpret(heredoc.Doc(`
+		fun outer(x) {
+			fun inner() { return x * 2; }
+			return inner;
+		}
+		var res = outer(21)();
+	`), false)
+	assert.Nil(t, err)
+	dump := vm_.Disassemble()
+	script, outer, inner := strings.Index(dump, "== <script> =="), strings.Index(dump, "== outer =="), strings.Index(dump, "== inner ==")
+	assert.True(t, script == 0 && script < outer && outer < inner, dump)
+	assert.Contains(t, dump[script:outer], "OpDefGlobal", dump)
+	assert.Contains(t, dump[outer:inner], "OpClos", dump)
+	assert.Contains(t, dump[inner:], "OpGetUpval", dump)
+	assert.Contains(t, dump[inner:], "OpMul", dump)
+}
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM(vm.WithStats())
+	_, err := vm_.Interpret("var a = 1 + 2;", false)
+	assert.Nil(t, err)
+	// See TestStep for the instructions executed and the stack after each of them.
+	assert.Equal(t, vm.Stats{Insts: 6, PeakStack: 3}, vm_.Stats())
+
+	vm_.Reset()
+	assert.Equal(t, vm.Stats{}, vm_.Stats())
+
+	// The statistics are not collected by default.
+	vm_ = vm.NewVM()
+	_, err = vm_.Interpret("var a = 1 + 2;", false)
+	assert.Nil(t, err)
+	assert.Equal(t, vm.Stats{}, vm_.Stats())
+}
+
+func TestProfile(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	_, err := vm_.Interpret("var a = 1;", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "", vm_.ProfileDump(), "profiling is disabled by default")
+
+	vm_.SetProfiling(true)
+	_, err = vm_.Interpret(heredoc.Doc(`
+		fun sum(n) {
+			var res = 0;
+			for (var i = 0; i < n; i = i + 1) res = res + i;
+			return res;
+		}
+		print sum(100);
+	`), false)
+	assert.Nil(t, err)
+	dump := vm_.ProfileDump()
+	lines := strings.Split(strings.TrimSpace(dump), "\n")
+	// Reading the locals `i`, `n` and `res` dominates the loop.
+	assert.Regexp(t, `^OpGetLocal +403$`, lines[0], dump)
+	assert.Regexp(t, `(?m)^OpLoop +200$`, dump)
+	assert.Regexp(t, `(?m)^OpReturn +2$`, dump)
+	assert.NotContains(t, dump, "OpInvoke", "opcodes never executed are omitted")
+}
+
+func TestBreakpoint(t *testing.T) {
+	t.Parallel()
+	src := heredoc.Doc(`
+		var sum = 0;
+		for (var i = 0; i < 3; i = i + 1) {
+			sum = sum + i;
+		}
+		sum;
+	`)
+	vm_ := vm.NewVM()
+	vm_.SetBreakpoint(3)
+	_, err := vm_.InterpretNoRecover(src, false)
+	for i := 0; i < 3; i++ {
+		var hit *e.BreakpointHit
+		assert.ErrorAs(t, err, &hit)
+		assert.Equal(t, 3, hit.Line)
+		// The top-level function and the loop variable `i`.
+		assert.Equal(t, fmt.Sprintf("[<fun ?> %d]", i), fmt.Sprintf("%s", vm_.Stack()))
+		_, err = vm_.Continue()
+	}
+	assert.Nil(t, err)
+
+	vm_.ClearBreakpoint(3)
+	val, err := vm_.Interpret("sum\n", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "3", fmt.Sprintf("%s", val))
+}
+
+func TestStackSnapshot(t *testing.T) {
+	t.Parallel()
+	src := heredoc.Doc(`
+		class Counter {}
+		{
+			var xs = [1, 2];
+			var c = Counter();
+			var i = 0;
+			c.n = 0;
+			xs[i] += 10;
+			c.n += 1;
+			i += 1;
+			// Lox has no ternary operator, so this is the idiom for it, taking either branch.
+			var sign = i > 0 and "pos" or "neg";
+			var zero = i == 0 and "zero" or nil;
+			print xs;
+		}
+	`)
+	var out bytes.Buffer
+	vm_ := vm.NewVM(vm.WithStdout(&out))
+	vm_.SetBreakpoint(14)
+	_, err := vm_.InterpretNoRecover(src, false)
+	var hit *e.BreakpointHit
+	assert.ErrorAs(t, err, &hit)
+	// The compound assignments and the conditional expressions leave nothing behind on the stack but the locals.
+	stack := vm_.StackSnapshot()
+	assert.Equal(t, `[<fun ?> [11, 2] <instanceof Counter> 1 "pos" nil]`, fmt.Sprintf("%s", stack))
+	// The snapshot is a copy, which is not affected by the rest of the execution.
+	_, err = vm_.Continue()
+	assert.Nil(t, err)
+	assert.Equal(t, "[11, 2]\n", out.String())
+	assert.Empty(t, vm_.StackSnapshot())
+	assert.Len(t, stack, 6)
+}
+
+func TestBreakpointInterpret(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	vm_.SetBreakpoint(2)
+	// Interpret runs to completion regardless of the breakpoints.
+	_, err := vm_.Interpret("var a = 1;\nvar b = 2;\n", false)
+	assert.Nil(t, err)
+	val, err := vm_.Interpret("a + b\n", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "3", fmt.Sprintf("%s", val))
+
+	_, err = vm_.InterpretNoRecover("var c = 1;\nvar d = 2;\n", false)
+	assert.ErrorContains(t, err, "hit breakpoint [L2]")
+}
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	changes := []string{}
+	vm_.Watch("a", func(old, new vm.Value) {
+		changes = append(changes, fmt.Sprintf("%v -> %v", old, new))
+	})
+	_, err := vm_.Interpret(heredoc.Doc(`
+		var a = 1;
+		var b = 2;
+		a = a + b;
+		b = 3;
+		fun f() { a = "foo"; }
+		f();
+		var a = nil;
+	`), false)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"<nil> -> 1", "1 -> 3", `3 -> "foo"`, `"foo" -> nil`}, changes)
+}
+
+func TestHostGlobals(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	vm_.SetGlobal("width", vm.VNum(3))
+	vm_.SetGlobal("unit", vm.NewVStr("cm"))
+	_, err := vm_.Interpret(`var area = width * width; var label = str(area) + unit;`, false)
+	assert.Nil(t, err)
+
+	area, ok := vm_.GetGlobal("area")
+	assert.True(t, ok)
+	assert.Equal(t, vm.VNum(9), area)
+	label, ok := vm_.GetGlobal("label")
+	assert.True(t, ok)
+	assert.Equal(t, "9cm", label.(*vm.VStr).Inner())
+	_, ok = vm_.GetGlobal("height")
+	assert.False(t, ok)
+
+	globals := vm_.Globals()
+	assert.Equal(t, vm.VNum(9), globals["area"])
+	assert.Contains(t, globals, "clock")
+	// The snapshot is not affected by later changes.
+	vm_.SetGlobal("area", vm.VNum(0))
+	assert.Equal(t, vm.VNum(9), globals["area"])
+}
+
+func TestHostValues(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	// `check(n, b, s, l, m, x)` extracts its arguments in Go, and builds them again from scratch.
+	vm_.SetGlobal("check", vm.NewVNativeFun(func(args ...vm.Value) (vm.Value, error) {
+		n, ok := vm.AsNumber(args[0])
+		assert.True(t, ok)
+		assert.Equal(t, 1.5, n)
+		b, ok := vm.AsBool(args[1])
+		assert.True(t, ok)
+		assert.True(t, b)
+		s, ok := vm.AsStr(args[2])
+		assert.True(t, ok)
+		assert.Equal(t, "hi", s)
+		l, ok := vm.AsList(args[3])
+		assert.True(t, ok)
+		assert.Len(t, l, 2)
+		m, ok := vm.AsMap(args[4])
+		assert.True(t, ok)
+		assert.Len(t, m, 1)
+		for key, val := range m {
+			k, _ := vm.AsStr(key)
+			assert.Equal(t, "k", k)
+			assert.Equal(t, vm.Number(2), val)
+		}
+		assert.True(t, vm.IsNil(args[5]))
+		_, ok = vm.AsNumber(args[2])
+		assert.False(t, ok)
+
+		return vm.List([]vm.Value{
+			vm.Number(n), vm.Bool(b), vm.Str(s), vm.List(l),
+			vm.Map(map[vm.Value]vm.Value{vm.Str("k"): vm.Number(2)}), vm.Nil(),
+		}), nil
+	}))
+	val, err := vm_.Interpret(`check(1.5, true, "hi", [1, "x"], map("k", 2), nil)`+"\n", true)
+	assert.Nil(t, err)
+	assert.Equal(t, `[1.5, true, "hi", [1, "x"], {"k": 2}, nil]`, fmt.Sprintf("%s", val))
+}
+
+func TestWalk(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	_, err := vm_.Interpret(heredoc.Doc(`
+		class Point {}
+		var inner = [1, "a"];
+		var p = Point();
+		p.inner = inner;
+		p.m = map("k", inner);
+		p.n = nil;
+		var cyclic = [0, nil];
+		cyclic[1] = cyclic;
+		var root = [p, cyclic];
+	`), false)
+	assert.Nil(t, err)
+	root, _ := vm_.GetGlobal("root")
+
+	var kinds []string
+	vm.Walk(root, func(v vm.Value) bool {
+		kinds = append(kinds, vm.Kind(v))
+		return true
+	})
+	// The second references to `inner` and `cyclic` are not visited again.
+	assert.Equal(t, []string{
+		"list", "instance", "list", "number", "string", "map", "string", "nil", "list", "number",
+	}, kinds)
+
+	count := 0
+	vm.Walk(root, func(v vm.Value) bool {
+		count++
+		_, isInstance := v.(*vm.VInstance)
+		return !isInstance
+	})
+	assert.Equal(t, 4, count)
+}
+
+func TestRunFunction(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	fun, err := vm_.Compile(`fun greet(who) { return greeting + ", " + who; } var res = greet(name);`)
+	assert.Nil(t, err)
+
+	for _, pair := range []struct{ greeting, name, res string }{
+		{"Hello", "world", "Hello, world"},
+		{"Bye", "Lox", "Bye, Lox"},
+	} {
+		vm_.SetGlobal("greeting", vm.NewVStr(pair.greeting))
+		vm_.SetGlobal("name", vm.NewVStr(pair.name))
+		_, err := vm_.RunFunction(fun)
+		assert.Nil(t, err)
+		res, _ := vm_.GetGlobal("res")
+		assert.Equal(t, pair.res, res.(*vm.VStr).Inner())
+	}
+
+	// A failed run leaves the VM ready for the next one.
+	vm_.SetGlobal("greeting", vm.VNum(42))
+	_, err = vm_.RunFunction(fun)
+	assert.ErrorContains(t, err, "operands must be all numbers or all strings")
+	vm_.SetGlobal("greeting", vm.NewVStr("Hi"))
+	_, err = vm_.RunFunction(fun)
+	assert.Nil(t, err)
+	res, _ := vm_.GetGlobal("res")
+	assert.Equal(t, "Hi, Lox", res.(*vm.VStr).Inner())
+}
+
+func TestFuel(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	// 2 instructions for the definition, then 9 instructions per iteration.
+	vm_.SetFuel(2 + 9*10)
+	_, err := vm_.Interpret("var i = 0; while (true) i = i + 1;", false)
+	assert.ErrorContains(t, err, "runtime error [L1]: instruction limit exceeded")
+
+	vm_.SetFuel(0)
+	val, err := vm_.Interpret("i\n", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "10", fmt.Sprintf("%s", val))
+}
+
+func TestOptions(t *testing.T) {
+	t.Parallel()
+	var out bytes.Buffer
+	vm_ := vm.NewVM(vm.WithStdout(&out), vm.WithFuel(2+9*10), vm.WithSandbox(), vm.WithIntMode())
+	_, err := vm_.Interpret("print 7 / 2; print 9007199254740992 + 1;", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "3.5\n9007199254740993\n", out.String())
+	_, err = vm_.Interpret(`getenv("HOME")`+"\n", true)
+	assert.ErrorContains(t, err, "getenv: access to the host environment is disabled")
+	_, err = vm_.Interpret("var i = 0; while (true) i = i + 1;", false)
+	assert.ErrorContains(t, err, "instruction limit exceeded")
+}
+
+func TestFuelUncatchable(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM(vm.WithFuel(1000))
+	_, err := vm_.Interpret(heredoc.Doc(`
+		var r;
+		var cleanups = 0;
+		try {
+			try { while (true) {} } finally { cleanups += 1; }
+		} catch (e) { r = e; }
+	`), false)
+	var limit *vm.LimitExceeded
+	assert.ErrorAs(t, err, &limit)
+	assert.ErrorContains(t, err, "instruction limit exceeded")
+	// Neither the catch block nor the finally block has run.
+	vm_.SetFuel(0)
+	val, err := vm_.Interpret("[r, cleanups]\n", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "[nil, 0]", fmt.Sprintf("%s", val))
+}
+
+func TestMemLimitUncatchable(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM(vm.WithMemLimit(10000))
+	_, err := vm_.Interpret(heredoc.Doc(`
+		var r;
+		try {
+			var s = "x";
+			while (true) s = s + s;
+		} catch (e) { r = e; }
+	`), false)
+	var limit *vm.LimitExceeded
+	assert.ErrorAs(t, err, &limit)
+	assert.ErrorContains(t, err, "memory limit exceeded")
+	val, err := vm_.Interpret("r\n", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "nil", fmt.Sprintf("%s", val))
+}
+
+func TestMemLimit(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	vm_.SetMemLimit(1 << 20)
+	val, err := vm_.Interpret("len(range(1000))\n", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "1000", fmt.Sprintf("%s", val))
+	_, err = vm_.Interpret("range(1000000000)\n", true)
+	assert.ErrorContains(t, err, "memory limit exceeded")
+	// The size of a huge list doesn't overflow into a negative one that fits in the limit.
+	for _, src := range []string{"range(6e17)", "range(9e18)", "range(-9e18, 9e18)", "range(9e18, -9e18, -1)"} {
+		_, err = vm_.Interpret(src+"\n", true)
+		var limit *vm.LimitExceeded
+		assert.ErrorAs(t, err, &limit, src)
+	}
+	_, err = vm_.Interpret(`var s = "x"; while (true) s = s + s;`, false)
+	assert.ErrorContains(t, err, "memory limit exceeded")
+	_, err = vm_.Interpret(`var xs = []; while (true) xs = [xs, xs, xs, xs];`, false)
+	assert.ErrorContains(t, err, "memory limit exceeded")
+
+	vm_.SetMemLimit(0)
+	val, err = vm_.Interpret("len(range(100000))\n", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "100000", fmt.Sprintf("%s", val))
+}
+
+func TestGetenv(t *testing.T) {
+	t.Setenv("GOLOX_TEST_GETENV", "héllo")
+	vm_ := vm.NewVM()
+	val, err := vm_.Interpret(`getenv("GOLOX_TEST_GETENV")`+"\n", true)
+	assert.Nil(t, err)
+	assert.Equal(t, `"héllo"`, fmt.Sprintf("%s", val))
+	val, err = vm_.Interpret(`getenv("GOLOX_TEST_GETENV_UNSET")`+"\n", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "nil", fmt.Sprintf("%s", val))
+
+	vm_.SetSandbox(true)
+	_, err = vm_.Interpret(`getenv("GOLOX_TEST_GETENV")`+"\n", true)
+	assert.ErrorContains(t, err, "getenv: access to the host environment is disabled")
+}
+
+func TestRunFile(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	vm_ := vm.NewVM()
+	var out bytes.Buffer
+	vm_.SetStdout(&out)
+
+	path := filepath.Join(dir, "ok.lox")
+	assert.Nil(t, os.WriteFile(path, []byte("var a = 1;\nprint a + 2;\n"), 0o644))
+	assert.Nil(t, vm_.RunFile(path))
+	assert.Equal(t, "3\n", out.String())
+
+	path = filepath.Join(dir, "bad.lox")
+	assert.Nil(t, os.WriteFile(path, []byte("print 1;\nvar = 2;\n"), 0o644))
+	err := vm_.RunFile(path)
+	assert.ErrorContains(t, err, path+": ")
+	assert.ErrorContains(t, err, "[L2]")
+	assert.ErrorContains(t, err, "expect variable name")
+
+	err = vm_.RunFile(filepath.Join(dir, "missing.lox"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestCapture(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	var out bytes.Buffer
+	vm_.SetStdout(&out)
+	val, err := vm_.Interpret(heredoc.Doc(`
+		print 0;
+		captureStart();
+		print 1, 2;
+		captureStart();
+		print 3;
+		var inner = captureEnd();
+		print 4;
+		var outer = captureEnd();
+		print 5;
+	`), false)
+	assert.Nil(t, err)
+	assert.Equal(t, "0\n5\n", out.String())
+	val, err = vm_.Interpret("inner + outer\n", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "\"3\n1 2\n4\n\"", fmt.Sprintf("%s", val))
+
+	// An error during a capture restores the original output.
+	out.Reset()
+	_, err = vm_.Interpret(`captureStart(); print 1; 1 + nil;`, false)
+	assert.ErrorContains(t, err, "operands must be")
+	_, err = vm_.Interpret(`print 2;`, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "2\n", out.String())
+
+	// So does the end of a run with an unmatched `captureStart`.
+	out.Reset()
+	_, err = vm_.Interpret(`captureStart(); captureStart(); print 1;`, false)
+	assert.Nil(t, err)
+	_, err = vm_.Interpret(`print 2;`, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "2\n", out.String())
+}
+
+func TestCaptureMemLimit(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM(vm.WithMemLimit(1000))
+	_, err := vm_.Interpret(`captureStart(); for (var i = 0; i < 1000; i += 1) print "0123456789";`, false)
+	assert.ErrorContains(t, err, "memory limit exceeded")
+}
+
+func TestCaptureEndWithoutStart(t *testing.T) {
+	assertEval(t, "captureEnd: no capture in progress", []TestPair{
+		{"captureEnd()", ""},
+	}...)
+}
+
+func TestInterpretRecoverPanic(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	var src strings.Builder
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&src, "var v%d = \"%d\";\n", i, i)
+	}
+	_, err := vm_.Interpret(src.String(), false)
+	assert.ErrorContains(t, err, "too many consts in one chunk")
+
+	val, err := vm_.Interpret("1 + 2\n", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "3", fmt.Sprintf("%s", val))
+}
+
+func TestEvalLineLastResult(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	for _, pair := range []TestPair{
+		{"1 + 1", "2"},
+		{"_ * 3", "6"},
+		{"var a = _;", "nil"},
+		{"_ + a", "12"},
+	} {
+		val, _, err := vm_.EvalLine(pair.input)
+		assert.Nil(t, err)
+		assert.Equal(t, pair.output, fmt.Sprintf("%s", val), "input: %s", pair.input)
+	}
+}
+
+func TestEvalLineHasVal(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	for _, c := range []struct {
+		input, output string
+		hasVal        bool
+	}{
+		{"var x = 1;", "nil", false},
+		{"print x;", "nil", false},
+		{"nil", "nil", true},
+		{"_ == nil", "true", true},
+		{"x", "1", true},
+	} {
+		val, hasVal, err := vm_.EvalLine(c.input)
+		assert.Nil(t, err)
+		assert.Equal(t, c.output, fmt.Sprintf("%s", val), "input: %s", c.input)
+		assert.Equal(t, c.hasVal, hasVal, "input: %s", c.input)
+	}
+}
+
+func TestMetaCommand(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	_, _, err := vm_.EvalLine("var answer = 42;")
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	quit, err := vm_.MetaCommand(":globals", &out)
+	assert.Nil(t, err)
+	assert.False(t, quit)
+	assert.Contains(t, out.String(), "answer = 42\n")
+	assert.Contains(t, out.String(), "clock = <native fun>\n")
+
+	out.Reset()
+	_, err = vm_.MetaCommand(":reset", &out)
+	assert.Nil(t, err)
+	_, err = vm_.MetaCommand(":globals", &out)
+	assert.Nil(t, err)
+	assert.NotContains(t, out.String(), "answer")
+	assert.Contains(t, out.String(), "clock = <native fun>\n")
+
+	_, err = vm_.MetaCommand(":frobnicate", &out)
+	assert.ErrorContains(t, err, "unknown meta-command ':frobnicate'")
+	quit, err = vm_.MetaCommand(":quit", &out)
+	assert.Nil(t, err)
+	assert.True(t, quit)
+}
+
+func TestVarsBlocks(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var foo = 2;", "nil"},
+		{"foo", "2"},
+		{"foo + 3 == 1 + foo * foo", "true"},
+		{"var bar;", "nil"},
+		{"bar", "nil"},
+		{"bar = foo = 2;", "nil"},
+		{"foo", "2"},
+		{"bar", "2"},
+		{"{ foo = foo + 1; var bar; var foo1 = foo; foo1 = foo1 + 1; }", "nil"},
+		{"foo", "3"},
+	}...)
+}
+
+func TestVarOwnInit(t *testing.T) {
+	assertEval(t, "can't read local variable in its own initializer",
+		[]TestPair{
+			{"var foo = 2;", "nil"},
+			{"{ var foo = foo; }", ""},
+		}...,
+	)
+}
+
+func TestVarNoInit(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		// An uninitialized global.
+		{"var g;", "nil"},
+		{"g", "nil"},
+		{
+			heredoc.Doc(`
+				fun f() {
+					var x;
+					var before = x;
+					x = 1;
+					return [before, x];
+				}
+			`),
+			"nil",
+		},
+		// An uninitialized local read later in the block.
+		{"f()", "[nil, 1]"},
+		// An uninitialized local in a nested block, which doesn't leak its value across calls.
+		{"fun nested() { var res = []; { var y; res = [y]; y = 2; } return res; }", "nil"},
+		{"nested()", "[nil]"},
+		{"nested()", "[nil]"},
+		// An uninitialized local captured by a closure before being assigned.
+		{"fun h() { var z; fun get() { return z; } var before = get(); z = 3; return [before, get()]; }", "nil"},
+		{"h()", "[nil, 3]"},
+		// Unlike a local, a global can be read in its own initializer, which reads its previous value.
+		{"var g = g;", "nil"},
+		{"g", "nil"},
+	}...)
+}
+
+func TestVarOwnInitNested(t *testing.T) {
+	// A local without initializer is still an error when read in the initializer of a shadowing local.
+	assertEval(t, "can't read local variable in its own initializer",
+		[]TestPair{
+			{"fun f() { var x; { var x = x; } }", ""},
+		}...,
+	)
+}
+
+func TestIfElse(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var foo = 2;", "nil"},
+		{"if (foo == 2) foo = foo + 1; else { foo = 42; }", "nil"},
+		{"foo", "3"},
+		{"if (foo == 2) { foo = foo + 1; } else foo = nil;", "nil"},
+		{"foo", "nil"},
+		{"if (!foo) foo = 1;", "nil"},
+		{"foo", "1"},
+		{"if (foo) foo = 2;", "nil"},
+		{"foo", "2"},
+	}...)
+}
+
+func TestAndOr(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{`"trick" or __TREAT__`, `"trick"`},
+		{"996 or 007", "996"},
+		{`nil or "hi"`, `"hi"`},
+		{"nil and what", "nil"},
+		{`true and "then_what"`, `"then_what"`},
+		{"var B = 66;", "nil"},
+		{"2*B or !2*B", "132"},
+	}...)
+}
+
+func TestAndOrObjects(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"class Foo {}", "nil"},
+		{"fun f() {}", "nil"},
+		{"Foo() and 1", "1"},
+		{"nil or Foo()", "<instanceof Foo>"},
+		{"Foo() or 1", "<instanceof Foo>"},
+		{"false and Foo()", "false"},
+		{"Foo and f", "<fun f>"},
+		{"nil or f", "<fun f>"},
+		{"f or Foo", "<fun f>"},
+		{"clock and false", "false"},
+		{"false or clock", "<native fun>"},
+		{`"" and 0`, "0"},
+		{"var foo = nil or Foo() and f;", "nil"},
+		{"foo", "<fun f>"},
+	}...)
+}
+
+func TestIfAndOr(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var foo = 2;", "nil"},
+		{
+			"if (foo != 2 and whatever) foo = foo + 42; else { foo = 3; }",
+			"nil",
+		},
+		{"foo", "3"},
+		{
+			"if (0 <= foo and foo <= 3) { foo = foo + 1; } else { foo = nil; }",
+			"nil",
+		},
+		{"foo", "4"},
+		{"if (!!!(2 + 2 != 5) or !!!!!!!!foo) foo = 1;", "nil"},
+		{"foo", "1"},
+		{"if (true or whatever) foo = 2;", "nil"},
+		{"foo", "2"},
+	}...)
+}
+
+func TestIfElseDisassembleLabeled(t *testing.T) {
+	t.Parallel()
+	fun, err := vm.NewParser().Compile("var foo; if (foo) foo = 1; else foo = 2;", false)
+	assert.Nil(t, err)
+	dump := fun.Chunk().DisassembleLabeled("test")
+	assert.Contains(t, dump, "L0:\n")
+	assert.Contains(t, dump, "L1:\n")
+	assert.Regexp(t, `OpJumpUnless +L0\n`, dump)
+	assert.Regexp(t, `OpJump +L1\n`, dump)
+	assert.NotContains(t, dump, "->")
+	// Every referenced label must be defined exactly once.
+	for _, match := range regexp.MustCompile(`OpJump\w* +(L\d+)`).FindAllStringSubmatch(dump, -1) {
+		assert.Equal(t, 1, strings.Count(dump, match[1]+":\n"), dump)
+	}
+}
+
+func TestDisassembleWithSource(t *testing.T) {
+	t.Parallel()
+	src := "var foo = 1;\nprint foo + 2;"
+	fun, err := vm.NewParser().Compile(src, false)
+	assert.Nil(t, err)
+	dump := fun.Chunk().DisassembleWithSource("test", src)
+	assert.Regexp(t, `(?s)^== test ==\n; +1: var foo = 1;\n.*OpDefGlobal.*\n; +2: print foo \+ 2;\n.*OpAdd.*OpPrint`, dump)
+	assert.Equal(t, 1, strings.Count(dump, "var foo = 1;"), dump)
+	assert.Equal(t, 1, strings.Count(dump, "print foo + 2;"), dump)
+}
+
+func TestWhile(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var i = 1; var product = 1;", "nil"},
+		{"while (i <= 5) { product = product * i; i = i + 1; }", "nil"},
+		{"product", "120"},
+	}...)
+}
+
+func TestWhileJump(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var i = 1; var product = 1;", "nil"},
+		{
+			heredoc.Doc(`
+				while (true) {
+					if (i == 3 or i == 5) {
+						i = i + 1;
+						continue;
+					}
+					product = product * i;
+					i = i + 1;
+					if (i > 6) { break; }
+				}
+			`),
+			"nil",
+		},
+		{"product", "48"},
+	}...)
+}
+
+func TestFor(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var product = 1;", "nil"},
+		{
+			"for (var i = 1; i <= 5; i = i + 1) { product = product * i; }",
+			"nil",
+		},
+		{"product", "120"},
+	}...)
+}
+
+func TestForBreak(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var i = 1; var product = 1;", "nil"},
+		{
+			"for (; ; i = i + 1) { product = product * i; if (i == 5) break; }",
+			"nil",
+		},
+		{"i", "5"},
+		{"product", "120"},
+	}...)
+}
+
+func TestForContinue(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var i = 1; var product = 1;", "nil"},
+		{
+			"for (; ; i = i + 1) { product = product * i; if (i < 5) continue; break; }",
+			"nil",
+		},
+		{"i", "5"},
+		{"product", "120"},
+	}...)
+}
+
+func TestForContinueNestedLocals(t *testing.T) {
+	// `continue` must discard the locals of the nested blocks before running the increment.
+	assertEval(t, "", []TestPair{
+		{"var incrs = 0; var fs = map();", "nil"},
+		{
+			heredoc.Doc(`
+				for (var i = 0; i < 4; incrs = incrs + 1) {
+					var j = i;
+					i = i + 1;
+					{
+						var a = "a";
+						var b = j * 10;
+						fun f() { return b; }
+						fs[j] = f;
+						if (j == 0 or j == 2) {
+							var c = a;
+							continue;
+						}
+					}
+					fs[j] = nil;
+				}
+			`),
+			"nil",
+		},
+		{"incrs", "4"},
+		{"len(fs)", "4"},
+		{"fs[0]() + fs[2]()", "20"},
+		{"fs[1] == nil and fs[3] == nil", "true"},
+	}...)
+}
+
+func TestForBreakNestedLocals(t *testing.T) {
+	// `break` must discard the locals of the loop body, so that the locals after the loop get the right slots.
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				fun f() {
+					var before = "before";
+					for (var i = 0; ; i = i + 1) {
+						var a = i;
+						{
+							var b = a * 10;
+							fun g() { return b; }
+							if (g() > 20) break;
+						}
+					}
+					var after = before + " after";
+					return after;
+				}
+			`),
+			"nil",
+		},
+		{"f()", `"before after"`},
+	}...)
+}
+
+func TestBareBreak(t *testing.T) {
+	assertEval(t, "expect 'break' in a loop", []TestPair{
+		{"break;", ""},
+	}...)
+}
+
+func TestBareContinue(t *testing.T) {
+	assertEval(t, "expect 'continue' in a loop", []TestPair{
+		{"continue;", ""},
+	}...)
+}
+
+func TestBareReturn(t *testing.T) {
+	assertEval(t, "can't return from top-level code", []TestPair{
+		{"return true;", ""},
+	}...)
+}
+
+func TestFunReturnInLoop(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				fun fact(n) {
+					var i; var product;
+					for (i = product = 1; ; i = i + 1) {
+						product = product * i;
+						if (i >= n) { return product; }
+					}
+				}
+			`),
+			"nil",
+		},
+		{"fact(5)", "120"},
+	}...)
+}
+
+func TestFunArity(t *testing.T) {
+	assertEval(t, "expected 2 arguments but got 1", []TestPair{
+		{"fun f(j, k) { return (1 + j) * k; }", "nil"},
+		{"f(2)", ""},
+	}...)
+}
+
+func TestFunRecursive(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"fun fact(i) { if (i <= 0) { return 1; } return i * fact(i - 1); }", "nil"},
+		{"fact(5)", "120"},
+	}...)
+}
+
+func TestFunRefGlobal(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var a = 3; fun f() { return a; } a = 4;", "nil"},
+		{"f()", "4"},
+	}...)
+}
+
+func TestFunLateInit(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"fun f() { return a; } var a = 4;", "nil"},
+		{"f()", "4"},
+	}...)
+}
+
+func TestFunLateInitFun(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"fun f() { return four(); } fun four() { return 4; }", "nil"},
+		{"f()", "4"},
+	}...)
+}
+
+func TestLocalMutualRecursion(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{heredoc.Doc(`
+			var res;
+			{
+				fun isEven(n) {
+					if (n == 0) return true;
+					return isOdd(n - 1);
+				}
+				fun isOdd(n) {
+					if (n == 0) return false;
+					return isEven(n - 1);
+				}
+				res = str(isEven(10)) + " " + str(isOdd(7)) + " " + str(isEven(3));
+			}
+		`), "nil"},
+		{"res", `"true true false"`},
+		{heredoc.Doc(`
+			fun outer() {
+				var x = 1;
+				fun f() { return g() + x; }
+				{ fun f() { return 100; } x = x + f(); }
+				fun g() { return 10; }
+				return f();
+			}
+		`), "nil"},
+		{"outer()", "111"},
+		{heredoc.Doc(`
+			fun nested() {
+				{{ fun a() { return b() + 1; } fun b() { return 1; } res = a(); }}
+				{}
+				{ fun d() { return e(); } fun e() { return 10; } { fun c() { return d(); } res = res + c(); } }
+				fun c() { return 100; }
+				return res + c();
+			}
+		`), "nil"},
+		{"nested()", "112"},
+	}...)
+}
+
+func TestLocalFunBeforeDecl(t *testing.T) {
+	// A hoisted function is invisible to the code of its own block before its declaration.
+	assertEval(t, "undefined variable 'f'", []TestPair{
+		{"{ f(); fun f() {} }", ""},
+	}...)
+}
+
+func TestLocalFunBeforeDeclShadowing(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{`var f = "global";`, "nil"},
+		{"var res;", "nil"},
+		{"{ res = f; fun f() {} }", "nil"},
+		{"res", `"global"`},
+		{`fun outer() { var g = "outer"; { var before = g; fun g() { return "inner"; } return before + " " + g(); } }`, "nil"},
+		{"outer()", `"outer inner"`},
+		// Only the nested functions see the hoisted function in advance.
+		{`{ fun h() { return f(); } res = h; fun f() { return "local"; } }`, "nil"},
+		{"res()", `"local"`},
+	}...)
+}
+
+func TestLocalFunRedecl(t *testing.T) {
+	assertEval(t, "already a variable with this name in this scope", []TestPair{
+		{"{ fun f() {} var f = 1; }", ""},
+	}...)
+}
+
+func TestBareBreakInClos(t *testing.T) {
+	assertEval(t, "expect 'break' in a loop", []TestPair{
+		{"for (var i = 0; i < 10; i = i + 1) { fun g() { break; } }", ""},
+	}...)
+}
+
+func TestBareContinueInClos(t *testing.T) {
+	assertEval(t, "expect 'continue' in a loop", []TestPair{
+		{"for (var i = 0; i < 10; i = i + 1) { fun g() { continue; } }", ""},
+	}...)
+}
+
+func TestBareBreakInMethod(t *testing.T) {
+	assertEval(t, "expect 'break' in a loop", []TestPair{
+		{"while (true) { class A { m() { break; } } }", ""},
+	}...)
+}
+
+func TestBareContinueInMethod(t *testing.T) {
+	assertEval(t, "expect 'continue' in a loop", []TestPair{
+		{"for (;;) { class A { m() { continue; } } }", ""},
+	}...)
+}
+
+func TestBareBreakInClosAfterLoop(t *testing.T) {
+	assertEval(t, "expect 'break' in a loop", []TestPair{
+		{"while (true) { fun f() { while (false) {} break; } }", ""},
+	}...)
+}
+
+func TestLoopInClosInLoop(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var n = 0;", "nil"},
+		{
+			heredoc.Doc(`
+				for (var i = 0; i < 3; i = i + 1) {
+					class A {
+						m() {
+							var j = 0;
+							while (true) { j = j + 1; if (j < 2) continue; break; }
+							return j;
+						}
+					}
+					n = n + A().m();
+				}
+			`),
+			"nil",
+		},
+		{"n", "6"},
+	}...)
+}
+
+func TestNestedLoopJump(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var n = 0; var m = 0;", "nil"},
+		{
+			heredoc.Doc(`
+				while (true) {
+					n = n + 1;
+					if (n > 5) break;
+					for (var i = 0; ; i = i + 1) {
+						if (i == 1) continue;
+						if (i >= 3) break;
+						m = m + 1;
+					}
+					if (n < 3) continue;
+					m = m + 100;
+				}
+			`),
+			"nil",
+		},
+		{"n", "6"},
+		{"m", "310"},
+	}...)
+}
+
+func TestBareReturnInClos(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var i;", "nil"},
+		{"for (i = 0; i < 10; i = i + 1) { fun g() { return; } }", "nil"},
+		{"i", "10"},
+	}...)
+}
+
+func TestClosNoEscape(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				fun outer() {
+					var x = "outside";
+					fun inner() { return x; }
+					return inner();
+				}
+			`),
+			"nil",
+		},
+		{"outer()", `"outside"`},
+	}...)
+}
+
+func TestClosEscape(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				fun outer() {
+					var x = "outside";
+					fun inner() { return x;} 
+					return inner;
+  				}
+			`),
+			"nil",
+		},
+		{"outer()()", `"outside"`},
+	}...)
+}
+
+func TestClosCurrying(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				fun f(j) { 
+					fun g(k) { return (1 + j) * k; }
+					return g;
+				}
+			`),
+			"nil",
+		},
+		{"f(2)(3)", "9"},
+	}...)
+}
+
+func TestClosRecursive(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var res;", "nil"},
+		{
+			heredoc.Doc(`
+				{
+					fun fact(i) { if (i <= 0) { return 1; } return i * fact(i - 1); }
+					res = fact(5);
+				}
+			`),
+			"nil",
+		},
+		{"res", "120"},
+	}...)
+}
+
+func TestClosCounter(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				fun make_counter() {
+					var i = 0;
+					fun count() { i = i + 1; return i; }
+					return count;
+				}
+				var counter = make_counter();
+			`),
+			"nil",
+		},
+		{"counter()", "1"},
+		{"counter()", "2"},
+	}...)
+}
+
+func TestClosShareRef(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				var globalSet; var globalGet;
+				fun main() {
+					var a = "initial";
+					fun set() { a = "updated"; }
+					fun get() { return a; }
+					globalSet = set; globalGet = get;
+				}
+				main();
+				globalSet();
+			`),
+			"nil",
+		},
+		{"globalGet()", `"updated"`},
+	}...)
+}
+
+func TestClosOpenAlias(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				fun main() {
+					var a = 1;
+					fun get() { return a; }
+					fun inc() { a = a + 1; }
+					a = 2;
+					inc();
+					return str(get()) + str(a);
+				}
+			`),
+			"nil",
+		},
+		// The open upvalue and the local are the same variable.
+		{"main()", `"33"`},
+	}...)
+}
+
+func TestRecoverOpenUpvals(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	_, err := vm_.Interpret(heredoc.Doc(`
+		fun f() {
+			var a = "stale";
+			fun g() { return a; }
+			nil + 1;
+		}
+		f();
+	`), false)
+	assert.ErrorContains(t, err, "operands must be all numbers or all strings")
+	// A new local in the same stack slot must not be mistaken for the captured one of the failed run.
+	_, err = vm_.Interpret(heredoc.Doc(`
+		fun h() {
+			var b = "fresh";
+			fun k() { return b; }
+			return k;
+		}
+		var res = h()();
+	`), false)
+	assert.Nil(t, err)
+	val, err := vm_.Interpret("res\n", true)
+	assert.Nil(t, err)
+	assert.Equal(t, `"fresh"`, fmt.Sprintf("%s", val))
+}
+
+func TestClosParamShadow(t *testing.T) {
+	assertEval(t, "already a variable with this name in this scope", []TestPair{
+		{
+			heredoc.Doc(`
+				var g = "global";
+				fun scope(l) {
+					var l = "local";
+					return l;
+				}
+				var l = scope(g);
+			`),
+			"",
+		},
+	}...)
+}
+
+func TestClosVarShadow(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				var a = "global";
+				var a1; var a2;
+				{
+					fun get_a() { return a; }
+					a1 = get_a();
+					var a = "block";
+					a2 = get_a();
+				}
+			`),
+			"nil",
+		},
+		{"a1", `"global"`},
+		{"a2", `"global"`},
+	}...)
+}
+
+// http://www.rosettacode.org/wiki/Man_or_boy_test#Lox
+var manOrBoy = heredoc.Doc(`
+	fun A(k, xa, xb, xc, xd, xe) {
+		fun B() {
+			k = k - 1;
+			return A(k, B, xa, xb, xc, xd);
+		}
+		if (k <= 0) { return xd() + xe(); }
+		return B();
+	}
+	fun I0()  { return  0; }
+	fun I1()  { return  1; }
+	fun I_1() { return -1; }
+`)
+
+func TestClosManOrBoy4(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{manOrBoy, "nil"},
+		{"A(4, I1, I_1, I_1, I1, I0)", "1"},
+	}...)
+}
+
+func TestClosManOrBoy10(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{manOrBoy, "nil"},
+		{"A(10, I1, I_1, I_1, I1, I0)", "-67"},
+	}...)
+}
+
+func TestClassEmpty(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"class Foo {}", "nil"},
+		{"Foo", "<class Foo>"},
+	}...)
+}
+
+func TestClassGetSet(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"class Foo {}", "nil"},
+		{"var foo = Foo();", "nil"},
+		{"foo", "<instanceof Foo>"},
+		{"foo.bar = 10086", "10086"},
+		{"foo.bar", "10086"},
+		{`foo.bar = "foobar"`, `"foobar"`},
+		{`foo.bar`, `"foobar"`},
+		{`foo.baz = foo.bar + "baz"`, `"foobarbaz"`},
+		{`foo.baz`, `"foobarbaz"`},
+	}...)
+}
+
+func TestClassGetUndefined(t *testing.T) {
+	assertEval(t, "undefined property 'bar'", []TestPair{
+		{"class Foo {}", "nil"},
+		{"Foo().bar", ""},
+	}...)
+}
+
+func TestClassGetInvalid(t *testing.T) {
+	assertEval(t, "only instances have properties", []TestPair{
+		{"true.story", ""},
+	}...)
+}
+
+func TestClassSetInvalid(t *testing.T) {
+	assertEval(t, "only instances have fields", []TestPair{
+		{"true.story = 42", ""},
+	}...)
+}
+
+func TestClassMethodUnbound(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				class Scone {
+					topping(first, second) {
+						return "scone with " + first + " and " + second;
+					}
+				}
+			`),
+			"nil",
+		},
+		{"var scone = Scone();", "nil"},
+		{`scone.topping("berries", "cream")`, `"scone with berries and cream"`},
+	}...)
+}
+
+func TestClassMethodBound(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{`class Egotist { speak() { return "Just " + this.name; } }`, "nil"},
+		{`var jimmy = Egotist(); jimmy.name = "Jimmy";`, "nil"},
+		{"jimmy.speak()", `"Just Jimmy"`},
+	}...)
+}
+
+func TestClassMethodBoundRef(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{`class Egotist { speak() { return "Just " + this.name; } }`, "nil"},
+		{`var jimmy = Egotist(); jimmy.name = "Jimmy";`, "nil"},
+		{"var s = jimmy.speak;", "nil"},
+		{"s()", `"Just Jimmy"`},
+	}...)
+}
+
+func TestPrintCallables(t *testing.T) {
+	t.Parallel()
+	var out bytes.Buffer
+	vm_ := vm.NewVM(vm.WithStdout(&out))
+	_, err := vm_.Interpret(heredoc.Doc(`
+		fun greet() { return "hi"; }
+		class Foo { greet() { return "hi"; } }
+		class Bar < Foo {}
+		print clock;
+		print greet;
+		print Foo;
+		print Foo().greet;
+		print Bar().greet;
+		print bind(greet);
+	`), false)
+	assert.Nil(t, err)
+	assert.Equal(t, heredoc.Doc(`
+		<native fun>
+		<fun greet>
+		<class Foo>
+		<bound greet of Foo>
+		<bound greet of Bar>
+		<partial <fun greet>>
+	`), out.String())
+}
+
+func TestClassMethodBoundNested(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				class Nested {
+					method() { 
+						fun f() { return this; }
+						return f();
+					}
+				}
+			`),
+			"nil",
+		},
+		{"Nested().method()", "<instanceof Nested>"},
+	}...)
+}
+
+func TestClassMethodBoundNestedEscaping(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				class Counter {
+					init() { this.n = 0; }
+					incrementer() {
+						fun incr() {
+							fun inner() { this.n = this.n + 1; return this; }
+							return inner();
+						}
+						return incr;
+					}
+				}
+				var counter = Counter();
+				var incr = counter.incrementer();
+			`),
+			"nil",
+		},
+		{"incr() == counter", "true"},
+		{"incr().n", "2"},
+		{"counter.n", "2"},
+	}...)
+}
+
+func TestBareThis(t *testing.T) {
+	assertEval(t, "can't use 'this' outside of a class", []TestPair{
+		{"this", ""},
+	}...)
+}
+
+func TestBareThisFun(t *testing.T) {
+	assertEval(t, "can't use 'this' outside of a class", []TestPair{
+		{"fun foo() { return this; }", ""},
+	}...)
+}
+
+func TestClassInit(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				class CoffeeMaker {
+					init(coffee) { this.coffee = coffee; }
+					brew() {
+						var res = "Enjoy your cup of " + this.coffee;
+						// No reusing the grounds!
+						this.coffee = nil;
+						return res;
+					}
+				}
+			`),
+			"nil",
+		},
+		{`var maker = CoffeeMaker("coffee and chicory");`, "nil"},
+		{"maker.brew()", `"Enjoy your cup of coffee and chicory"`},
+	}...)
+}
+
+func TestClassInitReturn(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"class Foo { init(name) { return; } }", "nil"},
+	}...)
+}
+
+func TestClassInitReturnVal(t *testing.T) {
+	assertEval(t, "can't return a value from an initializer", []TestPair{
+		{"class Bar { init(name) { return name; } }", ""},
+	}...)
+}
+
+func TestClassInitArity0(t *testing.T) {
+	assertEval(t, "expected 1 arguments but got 0", []TestPair{
+		{"class Bar { init(name) {} }", "nil"},
+		{"Bar()", "nil"},
+	}...)
+}
+
+func TestClassInitArityN(t *testing.T) {
+	assertEval(t, "expected 1 arguments but got 3", []TestPair{
+		{"class Bar { init(name) {} }", "nil"},
+		{"Bar(0, 1, 2)", "nil"},
+	}...)
+}
+
+func TestClassNoInitArity(t *testing.T) {
+	assertEval(t, "expected 0 arguments but got 3", []TestPair{
+		{"class Bar {}", "nil"},
+		{"Bar(0, 1, 2)", ""},
+	}...)
+}
+
+func TestClassInvokeOptimRegress(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				class Oops {
+					init() {
+						fun f() { this.foo = "bar"; }
+						this.field = f;
+					}
+				}
+			`),
+			"nil",
+		},
+		{"var oops = Oops();", "nil"},
+		{"oops.field();", "nil"},
+		{"oops.foo", `"bar"`},
+	}...)
+}
+
+func TestClassInheritance(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				class Doughnut { cook() { return "Dunk in the fryer."; } }
+				class Cruller < Doughnut { finish() { return "Glaze with icing."; } }
+			`),
+			"nil",
+		},
+		{"Doughnut().cook()", `"Dunk in the fryer."`},
+		{"Cruller().cook()", `"Dunk in the fryer."`},
+		{"Cruller().finish()", `"Glaze with icing."`},
+	}...)
+}
+
+func TestClassInheritanceResolution(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				class A {
+					greet() { return "A"; }
+					base() { return "A base"; }
+				}
+				class B < A { greet() { return "B"; } }
+				class C < B {}
+			`),
+			"nil",
+		},
+		// A subclass method overrides a superclass method.
+		{"B().greet()", `"B"`},
+		{"C().greet()", `"B"`},
+		// A superclass-only method resolves through two levels.
+		{"C().base()", `"A base"`},
+		{"var getBase = C().base;", "nil"},
+		{"getBase()", `"A base"`},
+		// A field shadows an inherited method, both as a property and as an invocation.
+		{"var c = C();", "nil"},
+		{`fun field() { return "field"; }`, "nil"},
+		{"c.base = field;", "nil"},
+		{"var getField = c.base;", "nil"},
+		{"getField()", `"field"`},
+		{"c.base()", `"field"`},
+		{"C().base()", `"A base"`},
+	}...)
+}
+
+func TestClassAbstract(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				class Greeter {
+					abstract name();
+					abstract greet(whom);
+					hello() { return "Hello from " + this.name(); }
+					abstract() { return "not abstract"; }
+				}
+				class English < Greeter {
+					name() { return "English"; }
+					greet(whom) { return "Hi, " + whom + "!"; }
+				}
+			`),
+			"nil",
+		},
+		{"English().hello()", `"Hello from English"`},
+		{`English().greet("Lox")`, `"Hi, Lox!"`},
+		{"English().abstract()", `"not abstract"`},
+		{"Greeter().greet", "<abstract fun greet>"},
+	}...)
+}
+
+func TestClassAbstractUnimplemented(t *testing.T) {
+	assertEval(t, "abstract method 'name' is not implemented", []TestPair{
+		{
+			heredoc.Doc(`
+				class Greeter {
+					abstract name();
+					hello() { return "Hello from " + this.name(); }
+				}
+				class Lazy < Greeter {}
+			`),
+			"nil",
+		},
+		{"var lazy = Lazy();", "nil"},
+		{"lazy.hello()", ""},
+	}...)
+}
+
+func TestClassAbstractInit(t *testing.T) {
+	assertEval(t, "an initializer can't be abstract", []TestPair{
+		{"class A { abstract init(); }", ""},
+	}...)
+}
+
+func TestChainedAssignment(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"class Box {}", "nil"},
+		{"var a = Box(); var b = Box();", "nil"},
+		{"a.x = b.y = 5", "5"},
+		{"a.x + b.y", "10"},
+		{"var n; { var m; n = a.x = m = b.y = 6; print m; }", "nil"},
+		{"n", "6"},
+		{"a.x", "6"},
+		// The assignments are evaluated from right to left, so `b.y` is set before `a.x` reads it.
+		{"a.x = (b.y = 7) + b.y", "14"},
+		{"a.x = b.y += 1", "8"},
+		{"a.x", "8"},
+	}...)
+}
+
+func TestChainedAssignmentStack(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	vm_.SetBreakpoint(7)
+	_, err := vm_.InterpretNoRecover(heredoc.Doc(`
+		class Box {}
+		var a = Box(); var b = Box();
+		a.x = b.y = 5;
+		fun f() { var l; a.x = l = b.y = 6; return l; }
+		f();
+		a.x = b.y += 1;
+		print a.x;
+	`), false)
+	var hit *e.BreakpointHit
+	assert.ErrorAs(t, err, &hit)
+	// No value is left over by the assignment statements.
+	assert.Equal(t, "[<fun ?>]", fmt.Sprintf("%s", vm_.Stack()))
+	vm_.ClearBreakpoint(7)
+	_, err = vm_.Continue()
+	assert.Nil(t, err)
+}
+
+func TestClassFieldSlots(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				class Base {
+					init(x) { this.x = x; this.tag = nil; }
+					peek() { return this.y; }
+				}
+				class Derived < Base {
+					init(x, y) { super.init(x); this.y = y; }
+				}
+				var d = Derived(1, 2);
+				d.extra = 3;
+				var b = Base(4);
+			`),
+			"nil",
+		},
+		{"d.x + d.y + d.extra", "6"},
+		{"d.tag", "nil"},
+		{"d.x = 10", "10"},
+		{"d.peek() + d.x", "12"},
+		{"fields(d)", `["extra", "tag", "x", "y"]`},
+		{"fields(b)", `["tag", "x"]`},
+	}...)
+}
+
+func TestClassFieldSlotUnset(t *testing.T) {
+	assertEval(t, "undefined property 'y'", []TestPair{
+		{"class Base { init(x) { if (x) this.y = x; } peek() { return this.y; } }", "nil"},
+		{"Base(1).peek()", "1"},
+		{"Base(false).peek()", ""},
+	}...)
+}
+
+func TestClassInheritanceSelf(t *testing.T) {
+	assertEval(t, "a class can't inherit from itself", []TestPair{
+		{"class A < A {}", ""},
+	}...)
+}
+
+func TestClassInheritanceSuperCall(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				class Duck {
+					init(name) { this.name = name; }
+					speak() { return this.name + ": Quack."; }
+				}
+				class DuckSpeaker < Duck {
+					speak() { return this.name + ": Double plus good."; }
+					speak_more() { return super.speak() + " Double plus good."; }
+				}
+			`),
+			"nil",
 		},
-		{"globalGet()", `"updated"`},
+		{`var jog = DuckSpeaker("Jog");`, "nil"},
+		{"jog.speak()", `"Jog: Double plus good."`},
+		{"jog.speak_more()", `"Jog: Quack. Double plus good."`},
+	}...)
+}
+
+func TestClassInheritanceSuperChainedResolution(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				class A { method() { return "A method"; } }
+				class B < A {
+                    method() { return "B method"; }
+                    test() { return super.method(); }
+                }
+				class C < B {}
+			`),
+			"nil",
+		},
+		{"C().test()", `"A method"`},
+	}...)
+}
+
+func TestBareSuper(t *testing.T) {
+	assertEval(t, "can't use 'super' outside of a class", []TestPair{
+		{"super.method();", ""},
+	}...)
+}
+
+func TestBareSuperInBaseClass(t *testing.T) {
+	assertEval(t, "can't use 'super' in a class with no superclass", []TestPair{
+		{"class A { method() { return super.method(); } }", ""},
+	}...)
+}
+
+func TestClassIndex(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{
+			heredoc.Doc(`
+				class Pair {
+					init(fst, snd) { this.fst = fst; this.snd = snd; }
+					__index__(i) {
+						if (i == 0) return this.fst;
+						if (i == 1) return this.snd;
+						return nil;
+					}
+					__setindex__(i, val) {
+						if (i == 0) this.fst = val;
+						if (i == 1) this.snd = val;
+						return "ignored";
+					}
+				}
+				var pair = Pair("foo", "bar");
+			`),
+			"nil",
+		},
+		{"pair[0]", `"foo"`},
+		{"pair[1 - 1 + 1]", `"bar"`},
+		{"pair[2]", "nil"},
+		{"pair[1] = 42", "42"},
+		{"pair.snd", "42"},
+		{"pair[0] = pair[1] = 7", "7"},
+		{"pair[0] + pair[1]", "14"},
+	}...)
+}
+
+func TestClassIndexDynamic(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{`class Foo { bar() { return "bar"; } }`, "nil"},
+		{"var foo = Foo();", "nil"},
+		{`var name = "ba" + "z";`, "nil"},
+		{"foo[name] = 42", "42"},
+		{"foo.baz", "42"},
+		{"foo.qux = 1;", "nil"},
+		{`foo["qux"] + foo[name]`, "43"},
+		{`foo["bar"]()`, `"bar"`},
+		// The overloads take precedence over dynamic field access.
+		{`class Map { __index__(k) { return k + "!"; } __setindex__(k, v) { this.last = v; } }`, "nil"},
+		{"var map = Map();", "nil"},
+		{`map["last"] = 7`, "7"},
+		{`map["last"]`, `"last!"`},
+		{"map.last", "7"},
+	}...)
+}
+
+func TestClassIndexDynamicUndefined(t *testing.T) {
+	assertEval(t, "undefined property 'nope'", []TestPair{
+		{"class Foo {}", "nil"},
+		{`Foo()["nope"]`, ""},
+	}...)
+}
+
+func TestFields(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"class Foo { method() {} }", "nil"},
+		{"var foo = Foo();", "nil"},
+		{"fields(foo)", "[]"},
+		{"foo.zeta = 1;", "nil"},
+		{"foo.alpha = 2;", "nil"},
+		{"fields(foo)", `["alpha", "zeta"]`},
+		{"var sum = 0;", "nil"},
+		{"for (name in fields(foo)) sum = sum + foo[name];", "nil"},
+		{"sum", "3"},
+	}...)
+}
+
+func TestFieldsNonInstance(t *testing.T) {
+	assertEval(t, "fields: argument must be an instance", []TestPair{
+		{"fields([1])", ""},
+	}...)
+}
+
+func TestClassIndexUndefined(t *testing.T) {
+	assertEval(t, "instances without an '__index__' method can only be indexed by strings", []TestPair{
+		{"class Foo {}", "nil"},
+		{"Foo()[0]", ""},
+	}...)
+}
+
+func TestClassSetIndexUndefined(t *testing.T) {
+	assertEval(t, "instances without a '__setindex__' method can only be indexed by strings", []TestPair{
+		{"class Foo { __index__(i) { return i; } }", "nil"},
+		{"Foo()[0] = 1", ""},
+	}...)
+}
+
+func TestIndexInvalid(t *testing.T) {
+	assertEval(t, "only lists, maps and instances with an '__index__' method can be indexed", []TestPair{
+		{"true[0]", ""},
+	}...)
+}
+
+var vectorClass = heredoc.Doc(`
+	class Vector {
+		init(x, y) { this.x = x; this.y = y; }
+		__add__(other) { return Vector(this.x + other.x, this.y + other.y); }
+		__eq__(other) { return this.x == other.x and this.y == other.y; }
+		__lt__(other) { return this.x * this.x + this.y * this.y < other.x * other.x + other.y * other.y; }
+	}
+`)
+
+func TestClassOverload(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{vectorClass, "nil"},
+		{"var v = Vector(1, 2) + Vector(3, 4);", "nil"},
+		{"v.x", "4"},
+		{"v.y", "6"},
+		{"(v + v + v).y", "18"},
+		{"Vector(1, 2) == Vector(1, 2)", "true"},
+		{"Vector(1, 2) == Vector(2, 1)", "false"},
+		{"Vector(1, 2) != Vector(2, 1)", "true"},
+		{"Vector(1, 2) < Vector(2, 2)", "true"},
+		{"Vector(1, 2) >= Vector(2, 2)", "false"},
+	}...)
+}
+
+func TestClassOverloadMissing(t *testing.T) {
+	assertEval(t, "operands must be numbers", []TestPair{
+		{vectorClass, "nil"},
+		{"Vector(1, 2) - Vector(1, 2)", ""},
+	}...)
+}
+
+func TestCompareNil(t *testing.T) {
+	assertEval(t, "cannot compare nil and number", []TestPair{
+		{"nil < 1", ""},
+	}...)
+}
+
+func TestCompareBool(t *testing.T) {
+	assertEval(t, "cannot compare boolean and boolean", []TestPair{
+		{"true > false", ""},
+	}...)
+}
+
+func TestCompareMixed(t *testing.T) {
+	assertEval(t, "cannot compare string and list", []TestPair{
+		{`"a" >= []`, ""},
+	}...)
+}
+
+func TestClassNoOverloadCompare(t *testing.T) {
+	assertEval(t, "cannot compare instance and number", []TestPair{
+		{"class Foo {}", "nil"},
+		{"Foo() <= 1", ""},
+	}...)
+}
+
+func TestClassNoOverloadEq(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"class Foo {}", "nil"},
+		{"var foo = Foo();", "nil"},
+		{"foo == foo", "true"},
+		{"foo == Foo()", "false"},
+	}...)
+}
+
+var pointClass = heredoc.Doc(`
+	class Point {
+		init(x, y) { this.x = x; this.y = y; }
+		toString() { return "Point(" + str(this.x) + ", " + str(this.y) + ")"; }
+	}
+`)
+
+func TestClassToString(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{pointClass, "nil"},
+		{"str(Point(1, 2.5))", `"Point(1, 2.5)"`},
+		{"class Foo {}", "nil"},
+		{"str(Foo())", `"<instanceof Foo>"`},
+		{`str("foo")`, `"foo"`},
+		{"str(nil)", `"nil"`},
+		{"str(str)", `"<native fun>"`},
+	}...)
+}
+
+func TestClassToStringInvalid(t *testing.T) {
+	assertEval(t, "'toString' must return a string", []TestPair{
+		{"class Foo { toString() { return 42; } }", "nil"},
+		{"str(Foo())", ""},
+	}...)
+}
+
+func TestPrintToString(t *testing.T) {
+	t.Parallel()
+	var out bytes.Buffer
+	vm_ := vm.NewVM()
+	vm_.SetStdout(&out)
+	_, err := vm_.Interpret(pointClass+`print Point(3, 4); print "foo"; print 42;`, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "Point(3, 4)\n\"foo\"\n42\n", out.String())
+}
+
+func TestPrintMany(t *testing.T) {
+	t.Parallel()
+	var out bytes.Buffer
+	vm_ := vm.NewVM()
+	vm_.SetStdout(&out)
+	_, err := vm_.Interpret(pointClass+`print 1, 2, 3; var a; print a = 4, a + 1, Point(0, 0);`, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "1 2 3\n4 5 Point(0, 0)\n", out.String())
+}
+
+var rangeClass = heredoc.Doc(`
+	class RangeIter {
+		init(lo, hi) { this.i = lo; this.hi = hi; }
+		__next__() {
+			if (this.i >= this.hi) return done;
+			var res = this.i;
+			this.i = this.i + 1;
+			return res;
+		}
+	}
+	class Range {
+		init(n) { this.n = n; }
+		__iter__() { return RangeIter(0, this.n); }
+	}
+`)
+
+func TestForIn(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{rangeClass, "nil"},
+		{"var sum = 0;", "nil"},
+		{"for (x in Range(5)) sum = sum + x;", "nil"},
+		{"sum", "10"},
+		{"for (x in Range(0)) sum = nil;", "nil"},
+		{"sum", "10"},
+		{"var pairs = 0;", "nil"},
+		{"for (i in Range(3)) { var j = i; for (k in Range(j)) { pairs = pairs + 1; } }", "nil"},
+		{"pairs", "3"},
+	}...)
+}
+
+func TestForInClos(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{rangeClass, "nil"},
+		{"var f0; var f2;", "nil"},
+		{
+			heredoc.Doc(`
+				for (x in Range(3)) {
+					fun f() { return x; }
+					if (x == 0) f0 = f;
+					if (x == 2) f2 = f;
+				}
+			`),
+			"nil",
+		},
+		{"f0()", "0"},
+		{"f2()", "2"},
+	}...)
+}
+
+func TestForInInvalid(t *testing.T) {
+	assertEval(t, "only lists and instances with an '__iter__' method can be iterated", []TestPair{
+		{"for (x in 42) print x;", ""},
+	}...)
+}
+
+func TestForInInvalidIter(t *testing.T) {
+	assertEval(t, "only instances with a '__next__' method can be iterators", []TestPair{
+		{"class Foo { __iter__() { return 42; } }", "nil"},
+		{"for (x in Foo()) print x;", ""},
+	}...)
+}
+
+func TestList(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"[]", "[]"},
+		{"[1, \"two\", nil,]", `[1, "two", nil]`},
+		{"var xs = [1, 2, [3]];", "nil"},
+		{"xs[0] + xs[1]", "3"},
+		{"xs[2][0]", "3"},
+		{"xs[1] = 42", "42"},
+		{"xs", "[1, 42, [3]]"},
+		{"len(xs) + len(\"héllo\")", "8"},
+		{"var sum = 0;", "nil"},
+		{"for (x in [1, 2, 3]) sum = sum + x;", "nil"},
+		{"sum", "6"},
+	}...)
+}
+
+func TestByteLen(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{`var s = "héllo, 世界";`, "nil"},
+		{"len(s)", "9"},
+		{"byteLen(s)", "14"},
+		{`byteLen("") == len("")`, "true"},
+	}...)
+}
+
+func TestByteLenNonStr(t *testing.T) {
+	assertEval(t, "byteLen: argument must be a string", []TestPair{
+		{"byteLen([1, 2])", ""},
+	}...)
+}
+
+func TestStrNatives(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{`split("a,b,,c", ",")`, `["a", "b", "", "c"]`},
+		{`split("héllo", "")`, `["h", "é", "l", "l", "o"]`},
+		{`split("", ",")`, `[""]`},
+		{`split("", "")`, `[]`},
+		{`join(["a", "b", "c"], ", ")`, `"a, b, c"`},
+		{`join([], ", ")`, `""`},
+		{`join(split("a b c", " "), "-")`, `"a-b-c"`},
+		{"trim(\"  \thi there \n\")", `"hi there"`},
+		{`trim("   ")`, `""`},
+		{`replace("banana", "an", "AN")`, `"bANANa"`},
+		{`replace("banana", "x", "y")`, `"banana"`},
+		{`replace("", "", "-")`, `"-"`},
+	}...)
+}
+
+func TestStrPredicates(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{`startsWith("golox", "go")`, "true"},
+		{`startsWith("golox", "lox")`, "false"},
+		{`startsWith("go", "golox")`, "false"},
+		{`startsWith("golox", "")`, "true"},
+		{`endsWith("golox", "lox")`, "true"},
+		{`endsWith("golox", "go")`, "false"},
+		{`endsWith("", "")`, "true"},
+		{`contains("golox", "olo")`, "true"},
+		{`contains("golox", "xol")`, "false"},
+		{`contains("", "")`, "true"},
+		{`contains("", "a")`, "false"},
+	}...)
+}
+
+func TestStrPredicateNonStr(t *testing.T) {
+	assertEval(t, "contains: arguments must be strings", []TestPair{
+		{`contains(["a"], "a")`, ""},
+	}...)
+}
+
+func TestOrdChr(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{`ord("A")`, "65"},
+		{`ord("abc")`, "97"},
+		{`chr(65)`, `"A"`},
+		{`ord("é")`, "233"},
+		{`chr(ord("é"))`, `"é"`},
+		{`chr(ord("世")) == "世"`, "true"},
+	}...)
+}
+
+func TestOrdEmpty(t *testing.T) {
+	assertEval(t, "ord: argument must not be empty", []TestPair{
+		{`ord("")`, ""},
+	}...)
+}
+
+func TestChrNonInt(t *testing.T) {
+	assertEval(t, "chr: argument must be an integer", []TestPair{
+		{"chr(65.5)", ""},
+	}...)
+}
+
+func TestChrOutOfRange(t *testing.T) {
+	assertEval(t, "chr: invalid code point 1114112", []TestPair{
+		{"chr(1114112)", ""},
+	}...)
+}
+
+func TestParseNumber(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{`parseNumber("42")`, "42"},
+		{`parseNumber("-3.25")`, "-3.25"},
+		{`parseNumber("1e3") + 1`, "1001"},
+		{`parseNumber("0xFF")`, "255"},
+		{`parseNumber("0b101")`, "5"},
+		{`parseNumber("1_000")`, "1000"},
+		{`parseNumber("-0xFF")`, "-255"},
+		{`parseNumber("+0b1_01")`, "5"},
+		{`parseNumber("-1_0e-1")`, "-1"},
+	}...)
+}
+
+func TestParseNumberMalformedLits(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	// Only the literals accepted by the Scanner are accepted, apart from the sign.
+	for _, s := range []string{
+		"", "-", "+-1", "--1", " 1", "1 ", "_1", "1_", "1__0", "0x_F", "0x", "1.", ".5", "1e",
+		"Inf", "-inf", "nan", "NaN", "1e3x",
+	} {
+		_, err := vm_.Interpret(fmt.Sprintf("parseNumber(%q)\n", s), true)
+		assert.ErrorContains(t, err, fmt.Sprintf("parseNumber: can't parse %q: invalid syntax", s), s)
+	}
+}
+
+func TestParseNumberMalformed(t *testing.T) {
+	assertEval(t, `parseNumber: can't parse "4x2": invalid syntax`, []TestPair{
+		{`parseNumber("4x2")`, ""},
+	}...)
+}
+
+func TestParseNumberMalformedHex(t *testing.T) {
+	assertEval(t, `parseNumber: can't parse "0xZZ": invalid syntax`, []TestPair{
+		{`parseNumber("0xZZ")`, ""},
+	}...)
+}
+
+func TestParseNumberNonStr(t *testing.T) {
+	assertEval(t, "parseNumber: arguments must be strings", []TestPair{
+		{"parseNumber(42)", ""},
+	}...)
+}
+
+func TestSplitNonStr(t *testing.T) {
+	assertEval(t, "split: arguments must be strings", []TestPair{
+		{`split("a b", 1)`, ""},
+	}...)
+}
+
+func TestJoinNonStrElem(t *testing.T) {
+	assertEval(t, "join: list elements must be strings", []TestPair{
+		{`join(["a", 1], ",")`, ""},
+	}...)
+}
+
+func TestClone(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var xs = [1, [2, 3], nil];", "nil"},
+		{"var ys = clone(xs);", "nil"},
+		{"ys[0] = 10;", "nil"},
+		{"ys[1][0] = 20;", "nil"},
+		{"xs", "[1, [2, 3], nil]"},
+		{"ys", "[10, [20, 3], nil]"},
+		// Shared references and cycles are preserved.
+		{"var inner = [1];", "nil"},
+		{"var zs = [inner, inner];", "nil"},
+		{"zs[0] = zs;", "nil"},
+		{"var ws = clone(zs);", "nil"},
+		{"ws[0] == ws and ws[1] != inner", "true"},
+		// Instances are kept as references.
+		{"class Foo {}", "nil"},
+		{"var foo = Foo();", "nil"},
+		{"clone([foo])[0] == foo", "true"},
+		{`clone("str") + str(clone(42))`, `"str42"`},
+	}...)
+}
+
+func TestFreeze(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var xs = freeze([1, [2]]);", "nil"},
+		{"xs[0] + len(xs)", "3"},
+		{"var sum = 0;", "nil"},
+		{"for (x in xs) sum = sum + len(str(x));", "nil"},
+		{"sum", "4"},
+		// Only the outer list is frozen.
+		{"xs[1][0] = 3", "3"},
+		{"var ys = clone(xs);", "nil"},
+		{"ys[0] = 4", "4"},
+		{"xs", "[1, [3]]"},
+	}...)
+}
+
+func TestFreezeWrite(t *testing.T) {
+	assertEval(t, "can't modify a frozen list", []TestPair{
+		{"var xs = [1, 2];", "nil"},
+		{"freeze(xs) == xs", "true"},
+		{"xs[0] = 3", ""},
+	}...)
+}
+
+func TestMap(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{`var m = map("a", 1, 2, "two");`, "nil"},
+		{"m", `{"a": 1, 2: "two"}`},
+		{`m["a"] + len(m)`, "3"},
+		{`m["missing"]`, "nil"},
+		// Strings and numbers are keys by content.
+		{`m["a" + ""] = 10`, "10"},
+		{"m[1 + 1]", `"two"`},
+		{"len(m)", "2"},
+		// Instances are keys by identity.
+		{"class Point { init(x) { this.x = x; } }", "nil"},
+		{"var p = Point(1); var q = Point(1); var alias = p;", "nil"},
+		{`m[p] = "p";`, "nil"},
+		{`m[q] = "q";`, "nil"},
+		{`m[alias] = "alias";`, "nil"},
+		{"len(m)", "4"},
+		{"m[p] + m[q]", `"aliasq"`},
+		// Lists are keys by identity too.
+		{"var xs = [1];", "nil"},
+		{"m[xs] = 1;", "nil"},
+		{"m[[1]]", "nil"},
+		{"m[xs]", "1"},
+	}...)
+}
+
+func TestMapIntNumKeys(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	vm_.SetIntMode(true)
+	_, err := vm_.Interpret(`var m = map(1, "one"); m[1.0] = "uno";`, false)
+	assert.Nil(t, err)
+	val, err := vm_.Interpret(`m[1] + str(len(m))`+"\n", true)
+	assert.Nil(t, err)
+	assert.Equal(t, `"uno1"`, fmt.Sprintf("%s", val))
+}
+
+func TestMapOddArgs(t *testing.T) {
+	assertEval(t, "map: expected an even number of arguments but got 3", []TestPair{
+		{"map(1, 2, 3)", ""},
+	}...)
+}
+
+func TestMapFreezeClone(t *testing.T) {
+	assertEval(t, "can't modify a frozen map", []TestPair{
+		{`var m = map("xs", [1]);`, "nil"},
+		{"var n = clone(m);", "nil"},
+		{`n["xs"][0] = 2;`, "nil"},
+		{`m["xs"][0] + n["xs"][0]`, "3"},
+		{`freeze(m)["xs"]`, "[1]"},
+		{`n["k"] = 1`, "1"},
+		{`m["k"] = 1`, ""},
+	}...)
+}
+
+func TestOperators(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"[true, false, nil]", "[true, false, nil]"},
+		{"[!true, !nil, -1, --2]", "[false, true, -1, 2]"},
+		{"[1 + 2, 1 - 2, 2 * 3, 3 / 2]", "[3, -1, 6, 1.5]"},
+		{"[1 == 1, 1 != 1, 1 < 2, 1 <= 1, 2 > 1, 1 >= 2]", "[true, false, true, true, true, false]"},
+		{"[nil and 1, 1 and 2, nil or 1, 1 or 2]", "[nil, 2, 1, 1]"},
+	}...)
+}
+
+func TestCompoundAssign(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var a = 1;", "nil"},
+		{"a += 2", "3"},
+		{"a *= 4", "12"},
+		{"a -= 2", "10"},
+		{"a /= 4", "2.5"},
+		{`var s = "a"; s += "b";`, "nil"},
+		{"s", `"ab"`},
+		{"fun f() { var x = 1; fun g() { x *= 3; } g(); x += 1; return x; }", "nil"},
+		{"f()", "4"},
+		{"class Foo { init() { this.n = 1; } }", "nil"},
+		{"var foo = Foo();", "nil"},
+		{"foo.n += 41", "42"},
+		// The container and the key are only evaluated once.
+		{"var calls = 0;", "nil"},
+		{"fun key(k) { calls += 1; return k; }", "nil"},
+		{`var m = map("k", 1);`, "nil"},
+		{`m[key("k")] += 1`, "2"},
+		{"var xs = [1, 2, 3];", "nil"},
+		{"fun list() { calls += 1; return xs; }", "nil"},
+		{"list()[key(1)] *= 2", "4"},
+		{`str(m["k"]) + str(xs) + str(calls)`, `"2[1, 4, 3]3"`},
 	}...)
 }
 
-func TestClosParamShadow(t *testing.T) {
-	assertEval(t, "already a variable with this name in this scope", []TestPair{
-		{
-			heredoc.Doc(`
-				var g = "global";
-				fun scope(l) {
-					var l = "local";
-					return l;
-				}
-				var l = scope(g);
-			`),
-			"",
-		},
+func TestCompoundAssignInvalid(t *testing.T) {
+	assertEval(t, "invalid assignment target", []TestPair{
+		{"var a = 1; var b = 2;", "nil"},
+		{"a + b += 1;", ""},
 	}...)
 }
 
-func TestClosVarShadow(t *testing.T) {
+func TestListIndexNonInt(t *testing.T) {
+	assertEval(t, "list index must be an integer", []TestPair{
+		{"[1, 2][0.5]", ""},
+	}...)
+}
+
+func TestListIndexOutOfRange(t *testing.T) {
+	assertEval(t, "list index 2 out of range for length 2", []TestPair{
+		{"[1, 2][2] = 3", ""},
+	}...)
+}
+
+func TestRange(t *testing.T) {
 	assertEval(t, "", []TestPair{
-		{
-			heredoc.Doc(`
-				var a = "global";
-				var a1; var a2;
-				{
-					fun get_a() { return a; }
-					a1 = get_a();
-					var a = "block";
-					a2 = get_a();
-				}
-			`),
-			"nil",
-		},
-		{"a1", `"global"`},
-		{"a2", `"global"`},
+		{"range(5)", "[0, 1, 2, 3, 4]"},
+		{"range(2, 5)", "[2, 3, 4]"},
+		{"range(1, 10, 3)", "[1, 4, 7]"},
+		{"range(3, 3)", "[]"},
+		{"range(5, 0, -2)", "[5, 3, 1]"},
+		{"range(0, 5, -1)", "[]"},
+		{"var sum = 0;", "nil"},
+		{"for (i in range(len([4, 5, 6]))) sum = sum + i;", "nil"},
+		{"sum", "3"},
 	}...)
 }
 
-// http://www.rosettacode.org/wiki/Man_or_boy_test#Lox
-var manOrBoy = heredoc.Doc(`
-	fun A(k, xa, xb, xc, xd, xe) {
-		fun B() {
-			k = k - 1;
-			return A(k, B, xa, xb, xc, xd);
-		}
-		if (k <= 0) { return xd() + xe(); }
-		return B();
-	}
-	fun I0()  { return  0; }
-	fun I1()  { return  1; }
-	fun I_1() { return -1; }
-`)
+func TestRangeTooMany(t *testing.T) {
+	assertEval(t, "range: too many elements", []TestPair{
+		{"len(range(0, 1e18))", ""},
+	}...)
+}
 
-func TestClosManOrBoy4(t *testing.T) {
+func TestRangeNearMaxInt(t *testing.T) {
+	// Stepping past the upper bound doesn't overflow.
 	assertEval(t, "", []TestPair{
-		{manOrBoy, "nil"},
-		{"A(4, I1, I_1, I_1, I1, I0)", "1"},
+		{"len(range(9223372036854773760, 9223372036854774784, 3000))", "1"},
 	}...)
 }
 
-func TestClosManOrBoy10(t *testing.T) {
+func TestRangeNonInt(t *testing.T) {
+	assertEval(t, "range: arguments must be integers", []TestPair{
+		{"range(1.5)", ""},
+	}...)
+}
+
+func TestRangeZeroStep(t *testing.T) {
+	assertEval(t, "range: step must not be zero", []TestPair{
+		{"range(0, 5, 0)", ""},
+	}...)
+}
+
+func TestRangeArity(t *testing.T) {
+	assertEval(t, "range: expected 1 to 3 arguments but got 0", []TestPair{
+		{"range()", ""},
+	}...)
+}
+
+func TestMinMax(t *testing.T) {
 	assertEval(t, "", []TestPair{
-		{manOrBoy, "nil"},
-		{"A(10, I1, I_1, I_1, I1, I0)", "-67"},
+		{"min([3, 1, 2])", "1"},
+		{"max([3, 1, 2])", "3"},
+		{"min([-1.5])", "-1.5"},
+		{"max(range(10))", "9"},
+		{`min(["pear", "apple", "fig"])`, `"apple"`},
+		{`max(["pear", "apple", "fig"])`, `"pear"`},
+		{"min(4, 2, 8)", "2"},
+		{"max(4, 2, 8)", "8"},
+		{`"b" > "a"`, "true"},
+		{`"ab" < "a"`, "false"},
 	}...)
 }
 
-func TestClassEmpty(t *testing.T) {
+func TestMinEmpty(t *testing.T) {
+	assertEval(t, "min: list must not be empty", []TestPair{
+		{"min([])", ""},
+	}...)
+}
+
+func TestMaxMixed(t *testing.T) {
+	assertEval(t, "max: cannot compare number and string", []TestPair{
+		{`max([1, "a"])`, ""},
+	}...)
+}
+
+func TestMinNonList(t *testing.T) {
+	assertEval(t, "min: a single argument must be a list", []TestPair{
+		{"min(1)", ""},
+	}...)
+}
+
+func TestSumProduct(t *testing.T) {
 	assertEval(t, "", []TestPair{
-		{"class Foo {}", "nil"},
-		{"Foo", "<class Foo>"},
+		{"sum([1, 2, 3.5])", "6.5"},
+		{"product([2, 3, 4])", "24"},
+		{"sum(range(101))", "5050"},
+		{"sum([])", "0"},
+		{"product([])", "1"},
+		{"sum([-7])", "-7"},
 	}...)
 }
 
-func TestClassGetSet(t *testing.T) {
+func TestSumNonNum(t *testing.T) {
+	assertEval(t, "sum: expected a number but got string", []TestPair{
+		{`sum([1, "2"])`, ""},
+	}...)
+}
+
+func TestProductNonList(t *testing.T) {
+	assertEval(t, "product: argument must be a list", []TestPair{
+		{"product(2)", ""},
+	}...)
+}
+
+func TestDivMod(t *testing.T) {
 	assertEval(t, "", []TestPair{
-		{"class Foo {}", "nil"},
-		{"var foo = Foo();", "nil"},
-		{"foo", "<instanceof Foo>"},
-		{"foo.bar = 10086", "10086"},
-		{"foo.bar", "10086"},
-		{`foo.bar = "foobar"`, `"foobar"`},
-		{`foo.bar`, `"foobar"`},
-		{`foo.baz = foo.bar + "baz"`, `"foobarbaz"`},
-		{`foo.baz`, `"foobarbaz"`},
+		{"floorDiv(7, 2)", "3"},
+		{"divmod(7, 2)", "[3, 1]"},
+		{"floorDiv(-7, 2)", "-4"},
+		{"divmod(-7, 2)", "[-4, 1]"},
+		{"divmod(7, -2)", "[-4, -1]"},
+		{"divmod(-7, -2)", "[3, -1]"},
+		{"divmod(6, 3)", "[2, 0]"},
+		{"divmod(7.5, 2)", "[3, 1.5]"},
 	}...)
 }
 
-func TestClassGetUndefined(t *testing.T) {
-	assertEval(t, "undefined property 'bar'", []TestPair{
-		{"class Foo {}", "nil"},
-		{"Foo().bar", ""},
+func TestDivModZero(t *testing.T) {
+	assertEval(t, "divmod: division by zero", []TestPair{
+		{"divmod(1, 0)", ""},
 	}...)
 }
 
-func TestClassGetInvalid(t *testing.T) {
-	assertEval(t, "only instances have properties", []TestPair{
-		{"true.story", ""},
+func TestFloorDivNonNum(t *testing.T) {
+	assertEval(t, "floorDiv: expected a number but got nil", []TestPair{
+		{"floorDiv(1, nil)", ""},
+	}...)
+}
+
+func TestIn(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var xs = [1, 2, \"three\", nil];", "nil"},
+		{"2 in xs", "true"},
+		{`"th" + "ree" in xs`, "true"},
+		{"nil in xs", "true"},
+		{"4 in xs", "false"},
+		{"[1] in [[1]]", "false"},
+		{`var m = map("a", 1, 2, nil);`, "nil"},
+		{`"a" in m`, "true"},
+		{"2 in m", "true"},
+		{"1 in m", "false"},
+		{`"ell" in "hello"`, "true"},
+		{`"" in "hello"`, "true"},
+		{`"olé" in "hello"`, "false"},
+		// `in` binds tighter than `==` and `and`, just like `<`.
+		{"2 in xs == true and !(5 in xs)", "true"},
+		{"var sum = 0; for (x in [1, 2]) sum = sum + x;", "nil"},
+		{"sum", "3"},
+	}...)
+}
+
+func TestInNonContainer(t *testing.T) {
+	assertEval(t, "the right operand of 'in' must be a list, a map or a string", []TestPair{
+		{"1 in 5", ""},
+	}...)
+}
+
+func TestInStrNonStr(t *testing.T) {
+	assertEval(t, "the left operand of 'in' must be a string when the right one is a string", []TestPair{
+		{`1 in "123"`, ""},
+	}...)
+}
+
+func TestSpread(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"fun sum3(a, b, c) { return a + b + c; }", "nil"},
+		{"var args = [1, 2, 3];", "nil"},
+		{"sum3(...args)", "6"},
+		{"sum3(10, ...[20, 30])", "60"},
+		{"sum3(...[], 1, ...[2], 3)", "6"},
+		{"var xs = [1, 2]; var ys = [3];", "nil"},
+		{"[...xs, ...ys]", "[1, 2, 3]"},
+		{"[0, ...xs, 9, ...[]]", "[0, 1, 2, 9]"},
+		{"[...[[1], [2]]]", "[[1], [2]]"},
+		{`join([...split("a,b", ","), "c"], "-")`, `"a-b-c"`},
+		{"class P { init(x, y) { this.x = x; this.y = y; } sum(a, b) { return this.x + this.y + a + b; } }", "nil"},
+		{"var p = P(...xs);", "nil"},
+		{"p.sum(...[3, 4])", "10"},
+		{"class Q < P { sum(a, b) { return super.sum(...[a, b]) * 10; } }", "nil"},
+		{"Q(...xs).sum(0, ...ys)", "60"},
+		{`len(...["abc"])`, "3"},
+	}...)
+}
+
+func TestSpreadArity(t *testing.T) {
+	assertEval(t, "expected 3 arguments but got 4", []TestPair{
+		{"fun sum3(a, b, c) { return a + b + c; }", "nil"},
+		{"sum3(1, ...[2, 3, 4])", ""},
+	}...)
+}
+
+func TestSpreadNonList(t *testing.T) {
+	assertEval(t, "only lists can be spread", []TestPair{
+		{"[...1]", ""},
+	}...)
+}
+
+func TestNamedArgs(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"fun rect(x, width, height) { return x * 100 + width * 10 + height; }", "nil"},
+		{"rect(x: 1, width: 2, height: 3)", "123"},
+		{"rect(height: 3, x: 1, width: 2)", "123"},
+		{"rect(1, height: 3, width: 2)", "123"},
+		{"rect(1, 2, height: 3)", "123"},
+		{"class P { init(x, y) { this.x = x; this.y = y; } diff(a, b) { return a - b; } }", "nil"},
+		{"P(y: 2, x: 1).x", "1"},
+		{"P(1, 2).diff(b: 1, a: 10)", "9"},
+		{"class Q < P { diff(a, b) { return super.diff(b: a, a: b); } }", "nil"},
+		{"Q(1, 2).diff(1, 10)", "9"},
+	}...)
+}
+
+func TestDynamicArgsNested(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"class P { diff(a, b) { return a - b; } pair(a, b) { return [a, b]; } }", "nil"},
+		{"var p = P();", "nil"},
+		{"p.diff(b: p.diff(...p.pair(5, 1)), a: p.pair(true and 10, nil or 20)[0])", "6"},
+		{"class Q < P { diff(a, b) { return super.diff(b: a, a: super.diff(...[b, (a == 0 and 1) or a])); } }", "nil"},
+		{"Q().diff(2, 10)", "6"},
+	}...)
+}
+
+func TestDynamicArgsDisassemble(t *testing.T) {
+	t.Parallel()
+	fun, err := vm.NewParser().Compile("var p; p.diff(b: 1, a: 2); p.diff(1, 2);", false)
+	assert.Nil(t, err)
+	dump := fun.Chunk().Disassemble("test")
+	// The method is got before the named arguments are evaluated.
+	assert.Regexp(t, `OpGetProp .*\n.*OpConstImm +1\n.*OpConstImm +2\n.*OpCallNamed`, dump)
+	assert.Contains(t, dump, "OpInvoke", dump)
+}
+
+func TestNamedArgsUnknown(t *testing.T) {
+	assertEval(t, "unknown parameter 'depth'", []TestPair{
+		{"fun rect(width, height) { return width * height; }", "nil"},
+		{"rect(width: 2, depth: 3)", ""},
+	}...)
+}
+
+func TestNamedArgsTwice(t *testing.T) {
+	assertEval(t, "parameter 'width' already has an argument", []TestPair{
+		{"fun rect(width, height) { return width * height; }", "nil"},
+		{"rect(2, width: 3)", ""},
+	}...)
+}
+
+func TestNamedArgsMissing(t *testing.T) {
+	assertEval(t, "missing argument for parameter 'height'", []TestPair{
+		{"fun rect(width, height) { return width * height; }", "nil"},
+		{"rect(width: 2)", ""},
+	}...)
+}
+
+func TestNamedArgsDuplicate(t *testing.T) {
+	assertEval(t, "duplicate named argument", []TestPair{
+		{"fun rect(width, height) { return width * height; }", "nil"},
+		{"rect(width: 2, width: 3)", ""},
+	}...)
+}
+
+func TestNamedArgsBeforePositional(t *testing.T) {
+	assertEval(t, "positional arguments must come before named arguments", []TestPair{
+		{"fun rect(width, height) { return width * height; }", "nil"},
+		{"rect(width: 2, 3)", ""},
+	}...)
+}
+
+func TestNamedArgsNative(t *testing.T) {
+	assertEval(t, "named arguments can only be passed to Lox functions", []TestPair{
+		{`len(x: "abc")`, ""},
+	}...)
+}
+
+func TestArguments(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"fun all() { return arguments; }", "nil"},
+		{"all()", "[]"},
+		{"all(1, 2, 3)", "[1, 2, 3]"},
+		{"fun rest(a, b) { var res = arguments; return [a, b, len(res), res]; }", "nil"},
+		{"rest(1, 2)", "[1, 2, 2, [1, 2]]"},
+		{`rest(1, 2, "x", nil)`, `[1, 2, 4, [1, 2, "x", nil]]`},
+		// Assigning to a parameter doesn't change the copy in `arguments`.
+		{"fun reassign(a) { a = 42; return arguments[0]; }", "nil"},
+		{"reassign(1)", "1"},
+		// `arguments` refers to the arguments of the innermost function.
+		{"fun outer(a) { fun inner() { return arguments; } return inner(a, a); }", "nil"},
+		{"outer(7)", "[7, 7]"},
+		{"class Sum { add() { return sum(arguments); } }", "nil"},
+		{"Sum().add(1, 2, 3)", "6"},
+		{"apply(bind(all, 1), [2, 3])", "[1, 2, 3]"},
+		{"var arguments = 1;", "nil"},
+		{"arguments", "1"},
+		{"fun shadowed() { var arguments = 2; return arguments; }", "nil"},
+		{"shadowed()", "2"},
+	}...)
+}
+
+func TestArgumentsTooFew(t *testing.T) {
+	assertEval(t, "expected at least 2 arguments but got 1", []TestPair{
+		{"fun rest(a, b) { return arguments; }", "nil"},
+		{"rest(1)", ""},
+	}...)
+}
+
+func TestArgumentsStrictArity(t *testing.T) {
+	assertEval(t, "expected 1 arguments but got 2", []TestPair{
+		{"fun f(a) { return a; }", "nil"},
+		{"f(1, 2)", ""},
+	}...)
+}
+
+func TestArgumentsInFinally(t *testing.T) {
+	assertEval(t, "can't use 'arguments' in a finally block", []TestPair{
+		{"fun f() { try {} finally { print arguments; } }", ""},
+	}...)
+}
+
+func TestApply(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"fun sum3(a, b, c) { return a + b + c; }", "nil"},
+		{"apply(sum3, [1, 2, 3])", "6"},
+		{"apply(sum3, range(3))", "3"},
+		{"call(sum3, 1, 2, 3)", "6"},
+		{`apply(len, ["abc"])`, "3"},
+		{"class P { init(x) { this.x = x; } }", "nil"},
+		{"apply(P, [42]).x", "42"},
+		{"call(clock) > 0", "true"},
+	}...)
+}
+
+func TestApplyArity(t *testing.T) {
+	assertEval(t, "expected 3 arguments but got 2", []TestPair{
+		{"fun sum3(a, b, c) { return a + b + c; }", "nil"},
+		{"apply(sum3, [1, 2])", ""},
+	}...)
+}
+
+func TestApplyNonList(t *testing.T) {
+	assertEval(t, "apply: second argument must be a list", []TestPair{
+		{"fun f(a) { return a; }", "nil"},
+		{"apply(f, 1)", ""},
+	}...)
+}
+
+func TestCallNoCallee(t *testing.T) {
+	assertEval(t, "call: expected at least 1 argument but got 0", []TestPair{
+		{"call()", ""},
+	}...)
+}
+
+func TestBind(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"fun add(a, b) { return a + b; }", "nil"},
+		{"var add10 = bind(add, 10);", "nil"},
+		{"add10(5) == 15", "true"},
+		{"add10", "<partial <fun add>>"},
+		{"fun sum3(a, b, c) { return a + b + c; }", "nil"},
+		{"bind(bind(sum3, 1), 2)(3)", "6"},
+		{"bind(sum3, 1, 2, 3)()", "6"},
+		{"class Pt { init(x, y) { this.x = x; this.y = y; } sum() { return this.x + this.y; } }", "nil"},
+		{"bind(Pt, 1)(2).sum()", "3"},
+		{`bind(join, ["a", "b"])("-")`, `"a-b"`},
+		{"apply(add10, [1])", "11"},
+	}...)
+}
+
+func TestBindArity(t *testing.T) {
+	assertEval(t, "expected 1 arguments but got 2", []TestPair{
+		{"fun add(a, b) { return a + b; }", "nil"},
+		{"bind(add, 10)(5, 6)", ""},
+	}...)
+}
+
+func TestBindTooMany(t *testing.T) {
+	assertEval(t, "bind: expected at most 2 arguments to bind but got 3", []TestPair{
+		{"fun add(a, b) { return a + b; }", "nil"},
+		{"bind(add, 1, 2, 3)", ""},
+	}...)
+}
+
+func TestCompose(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"fun inc(x) { return x + 1; }", "nil"},
+		{"fun double(x) { return x * 2; }", "nil"},
+		{"compose(inc, double)(3) == 7", "true"},
+		{"compose(double, inc)(3)", "8"},
+		{"fun add(a, b) { return a + b; }", "nil"},
+		{"compose(inc, add)(1, 2)", "4"},
+		{`compose(len, bind(join, ["a", "b"]))("--")`, "4"},
+		{"compose(inc, compose(inc, inc))(0)", "3"},
+	}...)
+}
+
+func TestComposeArity(t *testing.T) {
+	assertEval(t, "expected 1 arguments but got 2", []TestPair{
+		{"fun inc(x) { return x + 1; }", "nil"},
+		{"compose(inc, inc)(1, 2)", ""},
+	}...)
+}
+
+func TestGlobalThis(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var answer = 42;", "nil"},
+		{`globalThis["answer"]`, "42"},
+		{`globalThis["len"]("abc")`, "3"},
+		{`globalThis["gen" + "erated"] = 1`, "1"},
+		{"generated + 1", "2"},
+		{`globalThis["generated"] += 1;`, "nil"},
+		{"generated", "2"},
+		{"answer = 0;", "nil"},
+		{`globalThis["answer"]`, "0"},
+		{"globalThis", "<globals>"},
+	}...)
+}
+
+func TestGlobalThisUndefined(t *testing.T) {
+	assertEval(t, "undefined variable 'missing'", []TestPair{
+		{`globalThis["missing"]`, ""},
+	}...)
+}
+
+func TestGlobalThisNonStr(t *testing.T) {
+	assertEval(t, "globalThis can only be indexed by strings", []TestPair{
+		{"globalThis[1] = 2", ""},
+	}...)
+}
+
+func TestReadOnlyGlobals(t *testing.T) {
+	t.Parallel()
+	for _, pair := range []struct{ input, err string }{
+		{"var done = 1;", "at identifier `done`, can't redefine `done`"},
+		{"done = nil;", "at identifier `done`, can't assign to `done`"},
+		{"globalThis += 1;", "at identifier `globalThis`, can't assign to `globalThis`"},
+		{"fun done() {}", "at identifier `done`, can't redefine `done`"},
+		{"class globalThis {}", "at identifier `globalThis`, can't redefine `globalThis`"},
+		{"fun f() { done = 1; }", "at identifier `done`, can't assign to `done`"},
+		{`globalThis["done"] = 1;`, "runtime error [L1]: can't assign to `done`"},
+	} {
+		vm_ := vm.NewVM()
+		_, err := vm_.Interpret(pair.input, false)
+		assert.ErrorContains(t, err, pair.err, pair.input)
+		// Iterators can still be exhausted.
+		_, err = vm_.Interpret("var n = 0; for (x in [1, 2]) n += x;", false)
+		assert.Nil(t, err, pair.input)
+		n, _ := vm_.GetGlobal("n")
+		assert.Equal(t, "3", fmt.Sprintf("%s", n), pair.input)
+	}
+}
+
+func TestReadOnlyGlobalsAsLocals(t *testing.T) {
+	// Only the globals are read-only, so locals and parameters can still be named `done`.
+	assertEval(t, "", []TestPair{
+		{"fun f(done) { done = done + 1; return done; }", "nil"},
+		{"f(1)", "2"},
+		{"var n = 0; { var done = false; while (!done) { n += 1; done = n == 3; } }", "nil"},
+		{"n", "3"},
+		{"var sum = 0; for (done in [1, 2]) sum += done;", "nil"},
+		{"sum", "3"},
+		{"fun g() { fun done() { return 4; } return done(); }", "nil"},
+		{"g()", "4"},
+		{"for (x in [1]) {}", "nil"},
+	}...)
+}
+
+func TestErrorsInArgs(t *testing.T) {
+	t.Parallel()
+	parser := vm.NewParser()
+	_, err := parser.Compile(heredoc.Doc(`
+		fun f(a, b, c) {}
+		f(1 +, g(2, ), [3 *]);
+		print "still compiled";
+		var;
+	`), false)
+	var errs *multierror.Error
+	assert.ErrorAs(t, err, &errs)
+	reasons := []string{}
+	for _, err := range errs.Errors {
+		reasons = append(reasons, err.Error())
+	}
+	assert.Equal(t, []string{
+		"compilation error [L2]: at `,`, expect expression",
+		"compilation error [L2]: at `)`, expect expression",
+		"compilation error [L2]: at `]`, expect expression",
+		"compilation error [L4]: at `;`, expect variable name",
+	}, reasons)
+}
+
+func TestErrorsStrayToken(t *testing.T) {
+	t.Parallel()
+	parser := vm.NewParser()
+	// A stray token that no declaration can start with is skipped, both at the top level and in a block.
+	_, err := parser.Compile(heredoc.Doc(`
+		print 1;
+		)
+		print 2 +;
+		fun f() { print 1; ) print 2; }
+		print 3 *;
+	`), false)
+	var errs *multierror.Error
+	assert.ErrorAs(t, err, &errs)
+	reasons := []string{}
+	for _, err := range errs.Errors {
+		reasons = append(reasons, err.Error())
+	}
+	assert.Equal(t, []string{
+		"compilation error [L2]: at `)`, expect expression",
+		"compilation error [L3]: at `;`, expect expression",
+		"compilation error [L4]: at `)`, expect expression",
+		"compilation error [L5]: at `;`, expect expression",
+	}, reasons)
+}
+
+func TestWarnUnusedLocal(t *testing.T) {
+	t.Parallel()
+	parser := vm.NewParser()
+	_, err := parser.Compile(heredoc.Doc(`
+		var unusedGlobal = 1;
+		fun f(unusedParam) {
+			var used = 1;
+			{
+				var unused = 2;
+			}
+			return used;
+		}
+	`), false)
+	assert.Nil(t, err)
+	warnings := parser.Warnings()
+	var warning *e.CompilationWarning
+	assert.ErrorAs(t, warnings, &warning)
+	assert.Equal(t, "compilation warning [L5]: unused local variable `unused`", warning.Error())
+	assert.Len(t, warnings.(*multierror.Error).Errors, 1)
+	// The warnings are listed without a header calling them errors.
+	assert.Equal(t, "compilation warning [L5]: unused local variable `unused`", warnings.Error())
+	_, err = parser.Compile("{\n var a = 1;\n var b = 2;\n}", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "compilation warning [L3]: unused local variable `b`\n"+
+		"compilation warning [L2]: unused local variable `a`", parser.Warnings().Error())
+
+	// Like parameters, exception and loop variables are allowed to be unused.
+	_, err = parser.Compile(`{ try { throw 1; } catch (e) {} for (x in [1]) {} try {} catch (e) {} finally {} }`, false)
+	assert.Nil(t, err)
+	assert.Nil(t, parser.Warnings())
+
+	// Warnings don't leak into the next compilation.
+	_, err = parser.Compile("{ var used = 1; print used; }", false)
+	assert.Nil(t, err)
+	assert.Nil(t, parser.Warnings())
+}
+
+func TestWarnShadow(t *testing.T) {
+	t.Parallel()
+	src := heredoc.Doc(`
+		var count = 0;
+		fun f(x) {
+			var count = x;
+			print count;
+			{
+				var x = 2;
+				fun count() { return x; }
+				return count();
+			}
+		}
+		print f(1);
+	`)
+	parser := vm.NewParser()
+	_, err := parser.Compile(src, false)
+	assert.Nil(t, err)
+	assert.Nil(t, parser.Warnings(), "shadow warnings are disabled by default")
+
+	parser.SetWarnShadow(true)
+	_, err = parser.Compile(src, false)
+	assert.Nil(t, err)
+	warnings := []string{}
+	for _, w := range parser.Warnings().(*multierror.Error).Errors {
+		warnings = append(warnings, w.Error())
+	}
+	assert.Equal(t, []string{
+		"compilation warning [L3]: local variable `count` shadows a global variable",
+		// Local functions are hoisted, so they are declared at the start of the block.
+		"compilation warning [L7]: local variable `count` shadows a local variable of an enclosing scope",
+		"compilation warning [L6]: local variable `x` shadows a local variable of an enclosing scope",
+	}, warnings)
+
+	// The globals declared by earlier compilations are still known, e.g. in the REPL.
+	_, err = parser.Compile("{ var count = 1; print count; }", false)
+	assert.Nil(t, err)
+	assert.ErrorContains(t, parser.Warnings(), "local variable `count` shadows a global variable")
+}
+
+func TestWarnShadowOption(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM(vm.WithWarnShadow())
+	_, err := vm_.Interpret("var count = 0; { var count = 1; print count; }", false)
+	assert.Nil(t, err)
+	assert.ErrorContains(t, vm_.Warnings(), "local variable `count` shadows a global variable")
+}
+
+func TestWarnNativeRedef(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	_, err := vm_.Interpret("var clock = 5; fun str(x) { return x; } var notNative = 1;", false)
+	assert.Nil(t, err)
+	warnings := []string{}
+	for _, w := range vm_.Warnings().(*multierror.Error).Errors {
+		warnings = append(warnings, w.Error())
+	}
+	assert.Equal(t, []string{
+		"compilation warning [L1]: global variable `clock` redefines a native function",
+		"compilation warning [L1]: global variable `str` redefines a native function",
+	}, warnings)
+	// The redefinitions still take effect.
+	clock, _ := vm_.GetGlobal("clock")
+	assert.Equal(t, vm.VNum(5), clock)
+
+	// Neither a global redeclared by the user nor a local is reported.
+	_, err = vm_.Interpret("var clock = 6; { var len = 1; print len; }", false)
+	assert.Nil(t, err)
+	assert.Nil(t, vm_.Warnings())
+}
+
+func TestStrictNatives(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM(vm.WithStrictNatives())
+	_, err := vm_.Interpret("var clock = 5;", false)
+	assert.ErrorContains(t, err, "compilation error [L1]: at identifier `clock`, can't redefine native function `clock`")
+	// The native function is left intact.
+	clock, _ := vm_.GetGlobal("clock")
+	_, ok := clock.(*vm.VNativeFun)
+	assert.True(t, ok)
+}
+
+func TestStrictNativesRedefTwice(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM(vm.WithStrictNatives())
+	// A rejected redefinition doesn't make the next one look like a redeclared user global.
+	for i := 0; i < 2; i++ {
+		_, err := vm_.Interpret("var clock = 6;", false)
+		assert.ErrorContains(t, err, "can't redefine native function `clock`")
+	}
+	_, err := vm_.Interpret("var clock = 7;", true)
+	assert.ErrorContains(t, err, "can't redefine native function `clock`")
+	clock, _ := vm_.GetGlobal("clock")
+	_, ok := clock.(*vm.VNativeFun)
+	assert.True(t, ok)
+
+	// Neither does a global redefined by the user before a reset.
+	vm_.SetStrictNatives(false)
+	_, err = vm_.Interpret("var clock = 8;", false)
+	assert.Nil(t, err)
+	vm_.SetStrictNatives(true)
+	vm_.Reset()
+	_, err = vm_.Interpret("var clock = 9;", false)
+	assert.ErrorContains(t, err, "can't redefine native function `clock`")
+}
+
+func TestEscapedIdent(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"class Foo { `if`(x) { return x + 1; } `print`() { return this.`if`(41); } }", "nil"},
+		{"Foo().`if`(1)", "2"},
+		{"Foo().`print`()", "42"},
+		{"var `class` = 3;", "nil"},
+		{"`class` + 1", "4"},
+		// An escaped non-keyword is the same as the unescaped one.
+		{"var foo = 5;", "nil"},
+		{"`foo`", "5"},
+	}...)
+}
+
+func TestEscapedIdentUnterminated(t *testing.T) {
+	assertEval(t, "compilation error [L1]: unterminated escaped identifier", []TestPair{
+		{"var `foo = 1;", ""},
 	}...)
 }
 
-func TestClassSetInvalid(t *testing.T) {
-	assertEval(t, "only instances have fields", []TestPair{
-		{"true.story = 42", ""},
+func TestEscapedIdentEmpty(t *testing.T) {
+	assertEval(t, "compilation error [L1]: empty escaped identifier", []TestPair{
+		{"var `` = 1;", ""},
 	}...)
 }
 
-func TestClassMethodUnbound(t *testing.T) {
+func TestTryCatch(t *testing.T) {
 	assertEval(t, "", []TestPair{
 		{
 			heredoc.Doc(`
-				class Scone {
-					topping(first, second) {
-						return "scone with " + first + " and " + second;
-					}
+				fun thrower(x) { throw x + 1; }
+				fun middle() {
+					var local = "middle";
+					thrower(41);
+					return "unreachable";
+				}
+				var res;
+				try {
+					var local = "try";
+					middle();
+					res = "unreachable";
+				} catch (e) {
+					res = e;
 				}
 			`),
 			"nil",
 		},
-		{"var scone = Scone();", "nil"},
-		{`scone.topping("berries", "cream")`, `"scone with berries and cream"`},
+		{"res", "42"},
+		{"try { res = 1; } catch (e) { res = 2; }", "nil"},
+		{"res", "1"},
+		// Nested try blocks and rethrowing.
+		{"try { try { throw 1; } catch (e) { throw e + 1; } } catch (e) { res = e; }", "nil"},
+		{"res", "2"},
+		// A handler must be uninstalled when returning from a try block.
+		{"fun f() { try { return 3; } catch (e) { return -1; } }", "nil"},
+		{"try { f(); throw 4; } catch (e) { res = e; }", "nil"},
+		{"res", "4"},
 	}...)
 }
 
-func TestClassMethodBound(t *testing.T) {
+func TestTryCatchRuntimeError(t *testing.T) {
 	assertEval(t, "", []TestPair{
-		{`class Egotist { speak() { return "Just " + this.name; } }`, "nil"},
-		{`var jimmy = Egotist(); jimmy.name = "Jimmy";`, "nil"},
-		{"jimmy.speak()", `"Just Jimmy"`},
+		{"var msg;", "nil"},
+		{"try { print undefinedVar; } catch (e) { msg = e; }", "nil"},
+		{"msg", `"undefined variable 'undefinedVar'"`},
+		{"try { nil + 1; } catch (e) { msg = e; }", "nil"},
+		{"msg", `"operands must be all numbers or all strings"`},
 	}...)
 }
 
-func TestClassMethodBoundRef(t *testing.T) {
+func TestTryCatchUpval(t *testing.T) {
 	assertEval(t, "", []TestPair{
-		{`class Egotist { speak() { return "Just " + this.name; } }`, "nil"},
-		{`var jimmy = Egotist(); jimmy.name = "Jimmy";`, "nil"},
-		{"var s = jimmy.speak;", "nil"},
-		{"s()", `"Just Jimmy"`},
+		{
+			heredoc.Doc(`
+				var get;
+				fun f() {
+					var a = "captured";
+					fun g() { return a; }
+					get = g;
+					throw "oops";
+				}
+				try { f(); } catch (e) { var b = "clobbered"; }
+			`),
+			"nil",
+		},
+		{"get()", `"captured"`},
 	}...)
 }
 
-func TestClassMethodBoundNested(t *testing.T) {
+func TestTryCatchLoop(t *testing.T) {
 	assertEval(t, "", []TestPair{
+		{"var log = \"\";", "nil"},
 		{
 			heredoc.Doc(`
-				class Nested {
-					method() { 
-						fun f() { return this; }
-						return f();
+				for (var i = 0; i < 5; i = i + 1) {
+					try {
+						if (i == 1) continue;
+						if (i == 3) break;
+						log = log + str(i);
+					} catch (e) {
+						log = log + "!";
 					}
 				}
+				// The handlers of the loop body must have been uninstalled.
+				try { throw "x"; } catch (e) { log = log + e; }
 			`),
 			"nil",
 		},
-		{"Nested().method()", "<instanceof Nested>"},
+		{"log", `"02x"`},
 	}...)
 }
 
-func TestBareThis(t *testing.T) {
-	assertEval(t, "can't use 'this' outside of a class", []TestPair{
-		{"this", ""},
+func TestFinally(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var log = \"\";", "nil"},
+		// Normal completion.
+		{`try { log = log + "t"; } finally { log = log + "f"; }`, "nil"},
+		{"log", `"tf"`},
+		// A caught throw.
+		{`log = ""; try { throw "e"; } catch (e) { log = log + e; } finally { log = log + "f"; }`, "nil"},
+		{"log", `"ef"`},
+		// A throw caught outside, after running the finally block.
+		{`log = ""; try { try { throw "e"; } finally { log = log + "f"; } } catch (e) { log = log + e; }`, "nil"},
+		{"log", `"fe"`},
+		// A throw from the catch block.
+		{`log = ""; try { try { throw 1; } catch (e) { throw 2; } finally { log = log + "f"; } } catch (e) { log = log + str(e); }`, "nil"},
+		{"log", `"f2"`},
 	}...)
 }
 
-func TestBareThisFun(t *testing.T) {
-	assertEval(t, "can't use 'this' outside of a class", []TestPair{
-		{"fun foo() { return this; }", ""},
+func TestFinallyReturn(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var log = \"\";", "nil"},
+		{
+			heredoc.Doc(`
+				fun f(x) {
+					var local = "l";
+					try {
+						try {
+							return x + local;
+						} finally {
+							log = log + "inner";
+						}
+					} finally {
+						log = log + "outer" + local;
+					}
+					return "unreachable";
+				}
+			`),
+			"nil",
+		},
+		{`f("x")`, `"xl"`},
+		{"log", `"innerouterl"`},
+		// The handlers must have been uninstalled by the return.
+		{`log = ""; try { f("y"); throw "e"; } catch (e) { log = log + e; }`, "nil"},
+		{"log", `"innerouterle"`},
 	}...)
 }
 
-func TestClassInit(t *testing.T) {
+func TestFinallyLoop(t *testing.T) {
 	assertEval(t, "", []TestPair{
+		{"var log = \"\";", "nil"},
 		{
 			heredoc.Doc(`
-				class CoffeeMaker {
-					init(coffee) { this.coffee = coffee; }
-					brew() {
-						var res = "Enjoy your cup of " + this.coffee;
-						// No reusing the grounds!
-						this.coffee = nil;
-						return res;
+				fun f() {
+					for (var i = 0; i < 5; i = i + 1) {
+						try {
+							if (i == 1) continue;
+							if (i == 3) break;
+							log = log + str(i);
+						} finally {
+							log = log + "f";
+						}
 					}
 				}
 			`),
 			"nil",
 		},
-		{`var maker = CoffeeMaker("coffee and chicory");`, "nil"},
-		{"maker.brew()", `"Enjoy your cup of coffee and chicory"`},
+		{"f()", "nil"},
+		{"log", `"0ff2ff"`},
 	}...)
 }
 
-func TestClassInitReturn(t *testing.T) {
+func TestFinallyUncaught(t *testing.T) {
+	t.Parallel()
+	var out bytes.Buffer
+	vm_ := vm.NewVM()
+	vm_.SetStdout(&out)
+	_, err := vm_.Interpret(`try { print "try"; nil + 1; } finally { print "finally"; }`, false)
+	// The original runtime error is rethrown after the finally block.
+	assert.ErrorContains(t, err, "runtime error [L1]: operands must be all numbers or all strings")
+	assert.Equal(t, "\"try\"\n\"finally\"\n", out.String())
+
+	out.Reset()
+	_, err = vm_.Interpret(`try { throw "oops"; } finally { print "finally"; }`, false)
+	assert.ErrorContains(t, err, `uncaught exception: "oops"`)
+	assert.Equal(t, "\"finally\"\n", out.String())
+}
+
+func TestFinallyNoReturn(t *testing.T) {
+	assertEval(t, "can't return from a finally block", []TestPair{
+		{"fun f() { try {} finally { return 1; } }", ""},
+	}...)
+}
+
+func TestFinallyNoBreak(t *testing.T) {
+	assertEval(t, "can't break out of a finally block", []TestPair{
+		{"while (true) { try {} finally { break; } }", ""},
+	}...)
+}
+
+func TestFinallyNoContinue(t *testing.T) {
+	assertEval(t, "can't continue out of a finally block", []TestPair{
+		{"for (var i = 0; i < 3; i += 1) { try {} finally { continue; } }", ""},
+	}...)
+}
+
+func TestFinallyInnerLoop(t *testing.T) {
 	assertEval(t, "", []TestPair{
-		{"class Foo { init(name) { return; } }", "nil"},
+		{"var n = 0;", "nil"},
+		{"try {} finally { while (true) { n += 1; if (n < 3) continue; break; } }", "nil"},
+		{"n", "3"},
 	}...)
 }
 
-func TestClassInitReturnVal(t *testing.T) {
-	assertEval(t, "can't return a value from an initializer", []TestPair{
-		{"class Bar { init(name) { return name; } }", ""},
+func TestWith(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"var log = \"\";", "nil"},
+		{
+			heredoc.Doc(`
+				class Res {
+					init(name) { this.name = name; }
+					close() { log = log + "close " + this.name + ";"; }
+				}
+				class Ctx {
+					close() { log = log + "unreachable;"; }
+					__exit__() { log = log + "exit;"; }
+				}
+			`),
+			"nil",
+		},
+		// Normal completion.
+		{`with (r = Res("a")) { log = log + "use " + r.name + ";"; }`, "nil"},
+		{"log", `"use a;close a;"`},
+		// `__exit__` is preferred over `close`.
+		{`log = ""; with (c = Ctx()) { log = log + "use;"; }`, "nil"},
+		{"log", `"use;exit;"`},
+		// A return inside the block.
+		{
+			heredoc.Doc(`
+				fun f() {
+					with (r = Res("b")) {
+						return r.name;
+					}
+					return "unreachable";
+				}
+			`),
+			"nil",
+		},
+		{`log = "";`, "nil"},
+		{"f()", `"b"`},
+		{"log", `"close b;"`},
+		// A throw inside the block, with nested resources closed in reverse order.
+		{`log = ""; try { with (r = Res("c")) { with (s = Res("d")) { throw "e"; } } } catch (e) { log = log + e; }`, "nil"},
+		{"log", `"close d;close c;e"`},
+		// A break inside the block.
+		{`log = ""; while (true) { var x = 1; with (r = Res("f")) { var y = 2; break; } }`, "nil"},
+		{"log", `"close f;"`},
 	}...)
 }
 
-func TestClassInitArity0(t *testing.T) {
-	assertEval(t, "expected 1 arguments but got 0", []TestPair{
-		{"class Bar { init(name) {} }", "nil"},
-		{"Bar()", "nil"},
+func TestWithNoCleanup(t *testing.T) {
+	assertEval(t, "a resource of 'with' must have a 'close' or '__exit__' method", []TestPair{
+		{"class Res {}", "nil"},
+		{"with (r = Res()) {}", ""},
 	}...)
 }
 
-func TestClassInitArityN(t *testing.T) {
-	assertEval(t, "expected 1 arguments but got 3", []TestPair{
-		{"class Bar { init(name) {} }", "nil"},
-		{"Bar(0, 1, 2)", "nil"},
+func TestWithNonInstance(t *testing.T) {
+	assertEval(t, "only instances can be resources of 'with'", []TestPair{
+		{"with (r = 1) {}", ""},
 	}...)
 }
 
-func TestClassNoInitArity(t *testing.T) {
-	assertEval(t, "expected 0 arguments but got 3", []TestPair{
-		{"class Bar {}", "nil"},
-		{"Bar(0, 1, 2)", ""},
+func TestTryNoClause(t *testing.T) {
+	assertEval(t, "expect 'catch' or 'finally' after try block", []TestPair{
+		{"try {}", ""},
 	}...)
 }
 
-func TestClassInvokeOptimRegress(t *testing.T) {
+func TestThrowUncaught(t *testing.T) {
+	t.Parallel()
+	vm_ := vm.NewVM()
+	_, err := vm_.Interpret(heredoc.Doc(`
+		fun f() { throw "oops"; }
+		try { var ok = 1; } catch (e) {}
+		f();
+	`), false)
+	assert.ErrorContains(t, err, `runtime error [L1]: uncaught exception: "oops"`)
+	var thrown *vm.Thrown
+	assert.ErrorAs(t, err, &thrown)
+	assert.Equal(t, `"oops"`, fmt.Sprintf("%s", thrown.Val))
+}
+
+func TestClassAnonymous(t *testing.T) {
 	assertEval(t, "", []TestPair{
+		{`var obj = class { greet() { return "hi"; } }();`, "nil"},
+		{"obj.greet()", `"hi"`},
+		{"class {}", "<class (anonymous)>"},
 		{
 			heredoc.Doc(`
-				class Oops {
-					init() {
-						fun f() { this.foo = "bar"; }
-						this.field = f;
-					}
+				fun counter(start) {
+					return class {
+						init() { this.n = start; }
+						next() { this.n = this.n + 1; return this.n; }
+					};
 				}
 			`),
 			"nil",
 		},
-		{"var oops = Oops();", "nil"},
-		{"oops.field();", "nil"},
-		{"oops.foo", `"bar"`},
+		{"var c = counter(10)();", "nil"},
+		{"c.next() + c.next()", "23"},
 	}...)
 }
 
-func TestClassInheritance(t *testing.T) {
+func TestClassAnonymousStmt(t *testing.T) {
+	t.Parallel()
+	var out bytes.Buffer
+	vm_ := vm.NewVM()
+	vm_.SetStdout(&out)
+	_, err := vm_.Interpret(`class { init() { print "init"; } }();`, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "\"init\"\n", out.String())
+}
+
+func TestClassBadMethod(t *testing.T) {
+	assertEval(t, "expect method name", []TestPair{
+		{"class Foo { 42 }", ""},
+	}...)
+}
+
+func TestClassAnonymousInherit(t *testing.T) {
+	assertEval(t, "expect '{' before class body", []TestPair{
+		{"class Foo {}", "nil"},
+		{"class < Foo {}", ""},
+	}...)
+}
+
+func TestEnum(t *testing.T) {
 	assertEval(t, "", []TestPair{
+		{"enum Color { Red, Green, Blue, }", "nil"},
+		{"Color.Red == Color.Red", "true"},
+		{"Color.Red == Color.Green", "false"},
+		{"Color.Blue", "<instanceof Color.Blue>"},
+		{"enum Empty {}", "nil"},
 		{
 			heredoc.Doc(`
-				class Doughnut { cook() { return "Dunk in the fryer."; } }
-				class Cruller < Doughnut { finish() { return "Glaze with icing."; } }
+				fun name(c) {
+					enum Other { Red }
+					if (c == Other.Red) return "other";
+					if (c == Color.Red) return "red";
+					return "unknown";
+				}
 			`),
 			"nil",
 		},
-		{"Doughnut().cook()", `"Dunk in the fryer."`},
-		{"Cruller().cook()", `"Dunk in the fryer."`},
-		{"Cruller().finish()", `"Glaze with icing."`},
+		{"name(Color.Red)", `"red"`},
+		{"name(Color.Green)", `"unknown"`},
 	}...)
 }
 
-func TestClassInheritanceSelf(t *testing.T) {
-	assertEval(t, "a class can't inherit from itself", []TestPair{
-		{"class A < A {}", ""},
+func TestClassDistinctMethods(t *testing.T) {
+	assertEval(t, "", []TestPair{
+		{"class A { init() {} f() { return 1; } g() { return 2; } }", "nil"},
+		// Overriding in a subclass or reusing the name in a nested class is fine.
+		{"class B < A { f() { class C { f() { return 3; } } return C().f(); } }", "nil"},
+		{"B().f() + B().g()", "5"},
 	}...)
 }
 
-func TestClassInheritanceSuperCall(t *testing.T) {
+func TestClassDuplicateInit(t *testing.T) {
+	assertEval(t, "already a method with this name in this class", []TestPair{
+		{"class A { init() {} init(x) {} }", ""},
+	}...)
+}
+
+func TestClassDuplicateAbstract(t *testing.T) {
+	assertEval(t, "already a method with this name in this class", []TestPair{
+		{"class A { abstract f(); f() {} }", ""},
+	}...)
+}
+
+func TestEnumDuplicateMember(t *testing.T) {
+	assertEval(t, "already a member with this name in this enum", []TestPair{
+		{"enum Color { Red, Red }", ""},
+	}...)
+}
+
+func TestDecorator(t *testing.T) {
 	assertEval(t, "", []TestPair{
 		{
 			heredoc.Doc(`
-				class Duck {
-					init(name) { this.name = name; }
-					speak() { return this.name + ": Quack."; }
+				var calls = 0;
+				var lastArg;
+				fun traced(f) {
+					fun wrapper(n) {
+						calls += 1;
+						lastArg = n;
+						return f(n);
+					}
+					return wrapper;
 				}
-				class DuckSpeaker < Duck {
-					speak() { return this.name + ": Double plus good."; }
-					speak_more() { return super.speak() + " Double plus good."; }
+				fun twice(f) {
+					fun wrapper(n) { return f(f(n)); }
+					return wrapper;
 				}
 			`),
 			"nil",
 		},
-		{`var jog = DuckSpeaker("Jog");`, "nil"},
-		{"jog.speak()", `"Jog: Double plus good."`},
-		{"jog.speak_more()", `"Jog: Quack. Double plus good."`},
+		{"@traced fun fib(n) { if (n < 2) return n; return fib(n - 1) + fib(n - 2); }", "nil"},
+		{"fib(4)", "3"},
+		// The recursive calls go through the decorated function as well.
+		{"calls", "9"},
+		{"@traced @twice fun inc(n) { return n + 1; }", "nil"},
+		{"calls = 0;", "nil"},
+		{"inc(1)", "3"},
+		// `traced` wraps the result of `twice`, so it sees only the outer call.
+		{"calls", "1"},
+		{"lastArg", "1"},
+		{
+			heredoc.Doc(`
+				fun local() {
+					@twice
+					fun double(n) { return n * 2; }
+					return double(3);
+				}
+			`),
+			"nil",
+		},
+		{"local()", "12"},
+		{"class Math { @twice square(n) { return n * n; } }", "nil"},
+		{"Math().square(3)", "81"},
 	}...)
 }
 
-func TestClassInheritanceSuperChainedResolution(t *testing.T) {
+func TestDecoratorMethodThis(t *testing.T) {
 	assertEval(t, "", []TestPair{
 		{
 			heredoc.Doc(`
-				class A { method() { return "A method"; } }
+				var decorations = 0;
+				fun twice(f) {
+					decorations += 1;
+					fun wrapper(n) { return f(f(n)); }
+					return wrapper;
+				}
+				class A {
+					init(k) { this.k = k; }
+					@twice mul(n) { return n * this.k; }
+					callMul(n) { return this.mul(n); }
+				}
 				class B < A {
-                    method() { return "B method"; }
-                    test() { return super.method(); }
-                }
-				class C < B {}
+					@twice mul(n) { return super.mul(n) + 1; }
+				}
 			`),
 			"nil",
 		},
-		{"C().test()", `"A method"`},
+		{"var a = A(2);", "nil"},
+		{"a.mul(3)", "12"},
+		{"var m = a.mul;", "nil"},
+		{"m(1)", "4"},
+		{"a.callMul(1)", "4"},
+		// The decorators are applied once per instance.
+		{"decorations", "1"},
+		{"A(3).mul(1)", "9"},
+		{"decorations", "2"},
+		// Each instance of B decorates both B.mul and A.mul.
+		{"B(2).mul(1)", "21"},
+		{"decorations", "4"},
 	}...)
 }
 
-func TestBareSuper(t *testing.T) {
-	assertEval(t, "can't use 'super' outside of a class", []TestPair{
-		{"super.method();", ""},
+func TestDecoratorInit(t *testing.T) {
+	assertEval(t, "an initializer can't be decorated", []TestPair{
+		{"fun id(x) { return x; } class A { @id init() {} }", ""},
 	}...)
 }
 
-func TestBareSuperInBaseClass(t *testing.T) {
-	assertEval(t, "can't use 'super' in a class with no superclass", []TestPair{
-		{"class A { method() { return super.method(); } }", ""},
+func TestDecoratorNoFun(t *testing.T) {
+	assertEval(t, "expect 'fun' after decorators", []TestPair{
+		{"fun id(x) { return x; } @id var x = 1;", ""},
+	}...)
+}
+
+func TestDecoratorAbstract(t *testing.T) {
+	assertEval(t, "an abstract method can't be decorated", []TestPair{
+		{"fun id(x) { return x; } class A { @id abstract f(); }", ""},
+	}...)
+}
+
+func TestFoldStrConcat(t *testing.T) {
+	parser := vm.NewParser()
+	fun, err := parser.Compile(`print "a" + "b" + ("c" + "d");`, false)
+	assert.Nil(t, err)
+	dump := fun.Chunk().Disassemble("test")
+	assert.Equal(t, 1, strings.Count(dump, "OpConst "), dump)
+	assert.Contains(t, dump, `"abcd"`)
+	assert.NotContains(t, dump, "OpAdd")
+
+	assertEval(t, "", []TestPair{
+		{`var x = "x";`, "nil"},
+		{`"a" + "b" + "c"`, `"abc"`},
+		{`x + "a" + "b"`, `"xab"`},
+		{`"a" + "b" + x`, `"abx"`},
+		{`(true and "a") + "b"`, `"ab"`},
+	}...)
+}
+
+func TestFoldStrConcatMismatch(t *testing.T) {
+	assertEval(t, "operands must be all numbers or all strings", []TestPair{
+		{`"a" + 1`, ""},
 	}...)
 }
+
+func TestParserReuse(t *testing.T) {
+	t.Parallel()
+	parser := vm.NewParser()
+	_, err := parser.Compile("var = 1;", false)
+	assert.ErrorContains(t, err, "expect variable name")
+	// A failed compilation must not leak into the next one.
+	_, err = parser.Compile("var foo = 1;", false)
+	assert.Nil(t, err)
+	_, err = parser.Compile("1 + 2", true)
+	assert.Nil(t, err)
+}
+
+func TestScannerReset(t *testing.T) {
+	t.Parallel()
+	s := vm.NewScanner("var foo = 1;\nprint foo;")
+	scanAll(s)
+	s.Reset("print\n\"bar\";")
+	for _, want := range []vm.Token{
+		{Type: vm.TPrint, Line: 1, Runes: []rune("print")},
+		{Type: vm.TStr, Line: 2, Runes: []rune(`"bar"`)},
+		{Type: vm.TSemi, Line: 2, Runes: []rune(";")},
+		{Type: vm.TEOF, Line: 2, Runes: []rune{}},
+	} {
+		assert.Equal(t, want, s.ScanToken())
+	}
+}
+
+var replLines = []string{
+	"var foo = 1;",
+	"foo = foo + 2;",
+	"foo * 3",
+	"fun bar(baz) { return baz + foo; }",
+	"bar(4)",
+	"class Qux { quux() { return this; } }",
+	"Qux().quux()",
+}
+
+func TestParserReuseAllocs(t *testing.T) {
+	// Not parallel, since AllocsPerRun counts the allocations of the whole process.
+	compileAll := func(newParser func() *vm.Parser) func() {
+		return func() {
+			for _, line := range replLines {
+				_, _ = newParser().Compile(line, true)
+			}
+		}
+	}
+	fresh := testing.AllocsPerRun(100, compileAll(vm.NewParser))
+	parser := vm.NewParser()
+	reuse := testing.AllocsPerRun(100, compileAll(func() *vm.Parser { return parser }))
+	assert.Less(t, reuse, fresh)
+}
+
+func BenchmarkCompileFresh(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, line := range replLines {
+			_, _ = vm.NewParser().Compile(line, true)
+		}
+	}
+}
+
+func BenchmarkCompileReuse(b *testing.B) {
+	b.ReportAllocs()
+	parser := vm.NewParser()
+	for i := 0; i < b.N; i++ {
+		for _, line := range replLines {
+			_, _ = parser.Compile(line, true)
+		}
+	}
+}
+
+var scanSrc = strings.Repeat(heredoc.Doc(`
+	class Point {
+		init(x, y) { this.x = x; this.y = y; }
+		// Adds two points together.
+		add(other) { return Point(this.x + other.x, this.y + other.y); }
+	}
+	fun fib(n) {
+		if (n <= 1) return n;
+		return fib(n - 2) + fib(n - 1);
+	}
+	for (var i = 0; i < 10; i = i + 1) { print "fib: " + str(fib(i)); }
+`), 50)
+
+func scanAll(s *vm.Scanner) {
+	for s.ScanToken().Type != vm.TEOF {
+	}
+}
+
+func BenchmarkScanFresh(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		scanAll(vm.NewScanner(scanSrc))
+	}
+}
+
+func BenchmarkScanReset(b *testing.B) {
+	b.ReportAllocs()
+	s := vm.NewScanner("")
+	for i := 0; i < b.N; i++ {
+		s.Reset(scanSrc)
+		scanAll(s)
+	}
+}
+
+func BenchmarkCaptureThis(b *testing.B) {
+	b.ReportAllocs()
+	vm_ := vm.NewVM()
+	_, err := vm_.Interpret(heredoc.Doc(`
+		class Counter {
+			init() { this.n = 0; }
+			incr() {
+				fun step() { this.n = this.n + 1; }
+				step();
+			}
+		}
+		var counter = Counter();
+	`), false)
+	assert.Nil(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := vm_.Interpret("for (var i = 0; i < 1000; i = i + 1) counter.incr();", false)
+		assert.Nil(b, err)
+	}
+}
+
+func BenchmarkStrConsts(b *testing.B) {
+	b.ReportAllocs()
+	vm_ := vm.NewVM()
+	_, err := vm_.Interpret(heredoc.Doc(`
+		class Point { init(x, y) { this.x = x; this.y = y; } }
+		var p = Point(1, 2);
+		var total = 0;
+	`), false)
+	assert.Nil(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := vm_.Interpret("for (var i = 0; i < 1000; i = i + 1) { p.x = p.y + total; total = p.x; }", false)
+		assert.Nil(b, err)
+	}
+}
+
+func BenchmarkFields(b *testing.B) {
+	b.ReportAllocs()
+	vm_ := vm.NewVM()
+	_, err := vm_.Interpret(heredoc.Doc(`
+		class Vec {
+			init(x, y, z) { this.x = x; this.y = y; this.z = z; }
+			dot(other) { return this.x * other.x + this.y * other.y + this.z * other.z; }
+		}
+		var total = 0;
+	`), false)
+	assert.Nil(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := vm_.Interpret(heredoc.Doc(`
+			for (var i = 0; i < 1000; i = i + 1) {
+				var v = Vec(i, 1, 2);
+				v.y = v.x + v.z;
+				total = total + v.dot(v);
+			}
+		`), false)
+		assert.Nil(b, err)
+	}
+}
+
+// stringBuildingBenchmark runs `build(n)` which builds a string of length `n` in the way given by `body`.
+func stringBuildingBenchmark(b *testing.B, body string) {
+	b.ReportAllocs()
+	vm_ := vm.NewVM()
+	_, err := vm_.Interpret(fmt.Sprintf("fun build(n) { %s }", body), false)
+	assert.Nil(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		val, err := vm_.Interpret("len(build(3000))\n", true)
+		assert.Nil(b, err)
+		assert.Equal(b, vm.VNum(3000), val)
+	}
+}
+
+func BenchmarkStrConcat(b *testing.B) {
+	stringBuildingBenchmark(b, `
+		var s = "";
+		for (var i = 0; i < n; i = i + 3) { s = s + "a" + "b" + "c"; }
+		return s;
+	`)
+}
+
+func BenchmarkStrConcatChain(b *testing.B) {
+	stringBuildingBenchmark(b, `
+		var s = ""; var piece = "a";
+		for (var i = 0; i < n; i = i + 3) { s = s + piece + piece + piece; }
+		return s;
+	`)
+}
+
+func BenchmarkStringBuilder(b *testing.B) {
+	stringBuildingBenchmark(b, `
+		var sb = StringBuilder(); var piece = "a";
+		for (var i = 0; i < n; i = i + 3) { sb.append(piece, piece, piece); }
+		return sb.toString();
+	`)
+}
+
+func BenchmarkAddConst(b *testing.B) {
+	b.ReportAllocs()
+	vm_ := vm.NewVM()
+	_, err := vm_.Interpret(heredoc.Doc(`
+		fun product(n) {
+			var i = 1; var product = 1;
+			while (i <= n) { product = product * i; i = i + 1; }
+			return product;
+		}
+	`), false)
+	assert.Nil(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		val, err := vm_.Interpret("product(10)\n", true)
+		assert.Nil(b, err)
+		assert.Equal(b, vm.VNum(3628800), val)
+	}
+}